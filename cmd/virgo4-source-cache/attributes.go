@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// the attribute limits, as imposed by the cache table columns
+const (
+	maxRecordIDLength     = 256
+	maxRecordTypeLength   = 32
+	maxRecordSourceLength = 32
+)
+
+// the optional attribute giving when the record expires (RFC 3339), overriding RecordTTLs. only used
+// with ExpiryAttributes
+const attributeKeyRecordExpires = "expires"
+
+// recordAttributes are the attributes of a message that say what to do with its payload
+type recordAttributes struct {
+	id         string
+	recordType string
+	source     string
+	operation  string
+	expires    *time.Time // nil if not given
+}
+
+// parseAttributes extracts the record attributes from a message, checking they can be cached.
+// normalizing trims the attributes and lower cases the source; the expiry time of an update is
+// only read with expiries (ExpiryAttributes)
+func parseAttributes(msg awssqs.Message, normalize bool, expiries bool) (recordAttributes, error) {
+	var attrs recordAttributes
+	var missing []string
+
+	get := func(key string, value *string) {
+		v, found := msg.GetAttribute(key)
+		if normalize == true {
+			v = strings.TrimSpace(v)
+		}
+		if found == false || v == "" {
+			missing = append(missing, key)
+		}
+		*value = v
+	}
+
+	get(awssqs.AttributeKeyRecordId, &attrs.id)
+	get(awssqs.AttributeKeyRecordOperation, &attrs.operation)
+
+	switch attrs.operation {
+	case awssqs.AttributeValueRecordOperationUpdate:
+		get(awssqs.AttributeKeyRecordType, &attrs.recordType)
+		get(awssqs.AttributeKeyRecordSource, &attrs.source)
+
+	case awssqs.AttributeValueRecordOperationDelete:
+		// deletes only need the id, but we take whatever else there is
+		attrs.recordType, _ = msg.GetAttribute(awssqs.AttributeKeyRecordType)
+		attrs.source, _ = msg.GetAttribute(awssqs.AttributeKeyRecordSource)
+		if normalize == true {
+			attrs.recordType = strings.TrimSpace(attrs.recordType)
+			attrs.source = strings.TrimSpace(attrs.source)
+		}
+
+	case "":
+	default:
+		return attrs, fmt.Errorf("unknown operation [%s]", attrs.operation)
+	}
+
+	if len(missing) > 0 {
+		return attrs, fmt.Errorf("missing %s", strings.Join(missing, ", "))
+	}
+
+	if normalize == true {
+		attrs.source = strings.ToLower(attrs.source)
+	}
+
+	// a delete has nothing to expire, so is never refused over it
+	value, _ := msg.GetAttribute(attributeKeyRecordExpires)
+	if expiries == true && attrs.operation != awssqs.AttributeValueRecordOperationDelete && value != "" {
+		expires, err := time.Parse(time.RFC3339, strings.TrimSpace(value))
+		if err != nil {
+			return attrs, fmt.Errorf("%s is not an RFC 3339 time (is [%s])", attributeKeyRecordExpires, value)
+		}
+		expires = expires.UTC()
+		attrs.expires = &expires
+	}
+
+	type attributeLimit struct {
+		key   string
+		value string
+		max   int
+	}
+
+	// deletes only store the id
+	limits := []attributeLimit{{awssqs.AttributeKeyRecordId, attrs.id, maxRecordIDLength}}
+	if attrs.operation != awssqs.AttributeValueRecordOperationDelete {
+		limits = append(limits,
+			attributeLimit{awssqs.AttributeKeyRecordType, attrs.recordType, maxRecordTypeLength},
+			attributeLimit{awssqs.AttributeKeyRecordSource, attrs.source, maxRecordSourceLength})
+	}
+
+	// the columns count characters, not bytes
+	for _, limit := range limits {
+		if utf8.RuneCountInString(limit.value) > limit.max {
+			return attrs, fmt.Errorf("%s is longer than %d characters", limit.key, limit.max)
+		}
+	}
+
+	return attrs, nil
+}
+
+//
+// end of file
+//
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+func attributeMessage(id string, recordType string, source string, operation string) awssqs.Message {
+	return awssqs.Message{
+		Attribs: awssqs.Attributes{
+			{Name: awssqs.AttributeKeyRecordId, Value: id},
+			{Name: awssqs.AttributeKeyRecordType, Value: recordType},
+			{Name: awssqs.AttributeKeyRecordSource, Value: source},
+			{Name: awssqs.AttributeKeyRecordOperation, Value: operation},
+		},
+	}
+}
+
+func TestParseAttributes(t *testing.T) {
+	update := awssqs.AttributeValueRecordOperationUpdate
+	del := awssqs.AttributeValueRecordOperationDelete
+
+	for _, tc := range []struct {
+		msg   awssqs.Message
+		valid bool
+	}{
+		{attributeMessage("u1", "xml", "marc", update), true},
+		{attributeMessage("d1", "", "", del), true},
+		{attributeMessage("", "xml", "marc", update), false},
+		{attributeMessage("u2", "", "marc", update), false},
+		{attributeMessage("u3", "xml", "marc", "upsert"), false},
+		{attributeMessage("u4", "xml", strings.Repeat("s", 33), update), false},
+		{attributeMessage(strings.Repeat("i", 257), "xml", "marc", update), false},
+		{attributeMessage(strings.Repeat("é", 256), "xml", strings.Repeat("ü", 32), update), true},
+		{attributeMessage("d2", "xml", strings.Repeat("s", 33), del), true},
+		{awssqs.Message{}, false},
+	} {
+		_, err := parseAttributes(tc.msg, false, false)
+		if (err == nil) != tc.valid {
+			t.Errorf("%v: expected valid = %t, got %v", tc.msg.Attribs, tc.valid, err)
+		}
+	}
+}
+
+func TestNormalizeAttributes(t *testing.T) {
+	msg := attributeMessage(" u1 ", "xml ", " MARC", awssqs.AttributeValueRecordOperationUpdate)
+
+	attrs, err := parseAttributes(msg, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if attrs.id != "u1" || attrs.recordType != "xml" || attrs.source != "marc" {
+		t.Errorf("expected normalized attributes, got %+v", attrs)
+	}
+
+	// whitespace is only an attribute when not normalizing
+	if _, err = parseAttributes(attributeMessage(" ", "xml", "marc", awssqs.AttributeValueRecordOperationUpdate), true, false); err == nil {
+		t.Errorf("expected a blank id to be missing")
+	}
+}
+
+func TestExpiresAttribute(t *testing.T) {
+	msg := attributeMessage("u1", "xml", "marc", awssqs.AttributeValueRecordOperationUpdate)
+	msg.Attribs = append(msg.Attribs, awssqs.Attribute{Name: attributeKeyRecordExpires, Value: "2030-01-02T03:04:05-05:00"})
+
+	attrs, err := parseAttributes(msg, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if attrs.expires == nil || attrs.expires.Equal(time.Date(2030, 1, 2, 8, 4, 5, 0, time.UTC)) == false {
+		t.Errorf("expected the record to expire at 2030-01-02 08:04:05 UTC, got %v", attrs.expires)
+	}
+
+	msg.Attribs[len(msg.Attribs)-1].Value = "tomorrow"
+	if _, err = parseAttributes(msg, false, true); err == nil {
+		t.Errorf("expected a bad expiry time to be rejected")
+	}
+
+	// without ExpiryAttributes the attribute is ignored
+	if attrs, err = parseAttributes(msg, false, false); err != nil || attrs.expires != nil {
+		t.Errorf("expected the expiry time to be ignored, got %v (%v)", attrs.expires, err)
+	}
+
+	// and a delete is never refused over it
+	remove := attributeMessage("u1", "", "", awssqs.AttributeValueRecordOperationDelete)
+	remove.Attribs = append(remove.Attribs, awssqs.Attribute{Name: attributeKeyRecordExpires, Value: "tomorrow"})
+	if _, err = parseAttributes(remove, false, true); err != nil {
+		t.Errorf("expected the delete to be accepted: %s", err.Error())
+	}
+}
+
+//
+// end of file
+//
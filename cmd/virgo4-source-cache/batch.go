@@ -2,70 +2,32 @@ package main
 
 import (
 	"fmt"
-	dbx "github.com/go-ozzo/ozzo-dbx"
-	_ "github.com/lib/pq"
 	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
 	"log"
 	"math"
 	"sort"
 	"strings"
+	"time"
 )
 
-const cacheUpsertQuery = `
-INSERT
-INTO
-	{:table}
-		(id, type, source, payload, created_at, updated_at)
-VALUES
-	({:id}, {:type}, {:source}, {:payload}, now(), now())
-ON CONFLICT
-	(id)
-DO
-	UPDATE SET
-		(type, source, payload, updated_at)
-			= (EXCLUDED.type, EXCLUDED.source, EXCLUDED.payload, EXCLUDED.updated_at)
-`
-
-const cacheDeleteQuery = `
-DELETE
-FROM
-	{:table}
-WHERE
-	id = {:id}
-`
-
 type batchTransaction struct {
-	id          int
-	cache       *cacheService
-	queued      int
-	messages    []cacheMessage
-	deleteChan  chan<- []cacheMessage
-	upsertQuery string
-	deleteQuery string
-}
-
-func cleanQuery(query string, table string) string {
-	// converts a query to a more compact form
-	// maybe it makes a difference to pq?
-
-	q := query
-
-	q = strings.ReplaceAll(q, "{:table}", table)
-	q = strings.ReplaceAll(q, "\n", " ")
-	q = strings.ReplaceAll(q, "\t", "")
-	q = strings.Trim(q, " ")
-
-	return q
+	id            int
+	cache         *cacheService
+	queued        int
+	messages      []cacheMessage
+	invalid       map[string]int // validation failures in the batch, by action
+	badAttributes int            // messages dropped for their attributes
+	diffs         diffCounts     // the changes made by the updates, if logged
+	deleteChan    chan<- []cacheMessage
 }
 
 func newBatchTransaction(id int, cache *cacheService, deleteChan chan<- []cacheMessage) *batchTransaction {
 	b := batchTransaction{
-		id:          id,
-		cache:       cache,
-		queued:      0,
-		deleteChan:  deleteChan,
-		upsertQuery: cleanQuery(cacheUpsertQuery, cache.table),
-		deleteQuery: cleanQuery(cacheDeleteQuery, cache.table),
+		id:         id,
+		cache:      cache,
+		queued:     0,
+		invalid:    make(map[string]int),
+		deleteChan: deleteChan,
 	}
 
 	return &b
@@ -81,71 +43,170 @@ func (b *batchTransaction) queueRecord(msg cacheMessage) {
 	}
 }
 
-func (b *batchTransaction) sortMessages() {
-	sort.SliceStable(b.messages, func(i, j int) bool {
-		idi, _ := b.messages[i].message.GetAttribute(awssqs.AttributeKeyRecordId)
-		idj, _ := b.messages[j].message.GetAttribute(awssqs.AttributeKeyRecordId)
-		return idi < idj
-	})
-}
-
 func (b *batchTransaction) writeMessagesToCache() {
+	type cacheable struct {
+		msg   cacheMessage
+		attrs recordAttributes
+	}
+
+	records := make([]cacheable, 0, len(b.messages))
+
+	// invalid messages are dropped individually rather than failing the whole batch
+	for _, msg := range b.messages {
+		attrs, err := parseAttributes(msg.message, b.cache.normalize, b.cache.expiryAttrs)
+		if err != nil {
+			b.badAttributes++
+			log.Printf("[cache] worker %d: WARNING: dropping message with invalid attributes (id [%s]): %s", b.id, attrs.id, err.Error())
+			continue
+		}
+
+		records = append(records, cacheable{msg: msg, attrs: attrs})
+	}
+
 	// sort messages by id in attempt to prevent deadlocks
-	b.sortMessages()
-
-	// execute a transaction inline
-	// note: commits at the end automatically, or rolls back if error
-	err := b.cache.handle.Transactional(func(tx *dbx.Tx) error {
-
-		uq := tx.NewQuery(b.upsertQuery).Prepare()
-		dq := tx.NewQuery(b.deleteQuery).Prepare()
-
-		// execute statements within the transaction
-		for _, msg := range b.messages {
-			msgID, _ := msg.message.GetAttribute(awssqs.AttributeKeyRecordId)
-			msgType, _ := msg.message.GetAttribute(awssqs.AttributeKeyRecordType)
-			msgSource, _ := msg.message.GetAttribute(awssqs.AttributeKeyRecordSource)
-			msgOperation, _ := msg.message.GetAttribute(awssqs.AttributeKeyRecordOperation)
-
-			switch msgOperation {
-			case awssqs.AttributeValueRecordOperationUpdate:
-				// ozzo-dbx pgsql Upsert isn't selective on the "conflict update" clause, so we must specify it ourselves
-				_, err := uq.Bind(dbx.Params{
-					"id":      msgID,
-					"type":    msgType,
-					"source":  msgSource,
-					"payload": msg.message.Payload,
-				}).Execute()
-
-				if err != nil {
-					log.Printf("[cache] worker %d: ERROR: update execution failed: %s", b.id, err.Error())
-					return err
-				}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].attrs.id < records[j].attrs.id
+	})
+
+	ops := make([]cacheOperation, 0, len(records))
+	now := time.Now()
+
+	for _, r := range records {
+		msg := r.msg
+		msgID := r.attrs.id
+		msgType := r.attrs.recordType
+		msgSource := r.attrs.source
+
+		op := cacheOperation{
+			record: cacheRecord{
+				ID:      msgID,
+				Type:    msgType,
+				Source:  msgSource,
+				Payload: msg.message.Payload,
+			},
+		}
+
+		switch r.attrs.operation {
+		case awssqs.AttributeValueRecordOperationUpdate:
+			op.operation = cacheOperationUpsert
+			op.table = b.cache.router.table(msgSource, msgType)
 
-			case awssqs.AttributeValueRecordOperationDelete:
+			if b.cache.expiryAttrs == true {
+				op.record.ExpiresAt = r.attrs.expires
+			}
+			if op.record.ExpiresAt == nil {
+				op.record.ExpiresAt = b.cache.ttls.expires(msgSource, msgType, now)
+			}
 
-				_, err := dq.Bind(dbx.Params{
-					"id": msgID,
-				}).Execute()
+			action, err := b.cache.validators.validate(msgType, msg.message.Payload)
+			if err != nil {
+				b.invalid[action]++
+				log.Printf("[cache] worker %d: WARNING: %s record %s from %s failed validation (%s): %s", b.id, msgType, msgID, msgSource, action, err.Error())
 
-				if err != nil {
-					log.Printf("[cache] worker %d: ERROR: delete execution failed: %s", b.id, err.Error())
-					return err
+				switch action {
+				case validationReject:
+					// the message is still removed from the queue
+					continue
+
+				case validationQuarantine:
+					op.operation = cacheOperationQuarantine
+					op.table = b.cache.quarantineTable
+					op.reason = err.Error()
 				}
+			}
 
-			default:
-				// ignore?
+			ops = append(ops, op)
+
+			// if the source or type changed the record may be in another table; it moves with the update
+			if op.operation == cacheOperationUpsert {
+				for _, table := range b.cache.router.tables() {
+					if table != op.table {
+						ops = append(ops, cacheOperation{operation: cacheOperationDelete, table: table, record: op.record})
+					}
+				}
+			}
+
+		case awssqs.AttributeValueRecordOperationDelete:
+			// deletes don't reliably carry the source or type, so remove the id from every table
+			op.operation = cacheOperationDelete
+			for _, table := range b.cache.router.tables() {
+				op.table = table
+				ops = append(ops, op)
 			}
 		}
+	}
 
-		return nil
+	if b.cache.logDiffs == true {
+		b.countDiffs(ops)
+	}
+
+	// group the batch by table, keeping the id order (and so the order of updates to each id) within each
+	sort.SliceStable(ops, func(i, j int) bool {
+		return ops[i].table < ops[j].table
 	})
 
-	if err != nil {
+	// apply the batch in a single transaction; the store rolls back if any operation fails
+	if err := b.cache.store.WriteBatch(ops); err != nil {
 		log.Fatalf("[cache] worker %d: FATAL: transaction failed: %s", b.id, err.Error())
 	}
 }
 
+// diffCounts summarises the changes the updates in a batch make to the cached records
+type diffCounts struct {
+	new       int
+	changed   int
+	unchanged int
+	offloaded int // not compared; the cached payload is in the object store
+	added     int // lines
+	removed   int // lines
+}
+
+// countDiffs compares the updates in a batch with the cached records they replace, read in one go
+func (b *batchTransaction) countDiffs(ops []cacheOperation) {
+	var ids []string
+	for _, op := range ops {
+		if op.operation == cacheOperationUpsert {
+			ids = append(ids, op.record.ID)
+		}
+	}
+
+	if len(ids) == 0 {
+		return
+	}
+
+	cached, err := b.cache.store.GetBatch(ids)
+	if err != nil {
+		log.Printf("[cache] worker %d: WARNING: reading %d records to compare: %s", b.id, len(ids), err.Error())
+		return
+	}
+
+	for _, op := range ops {
+		if op.operation != cacheOperationUpsert {
+			continue
+		}
+
+		rec, ok := cached[op.record.ID]
+		switch {
+		case ok == false:
+			b.diffs.new++
+			continue
+		case rec.PayloadRef != "":
+			b.diffs.offloaded++
+			continue
+		}
+
+		d := diffPayloads(op.record.Type, rec.Payload, op.record.Payload)
+		if d.changed() == false {
+			b.diffs.unchanged++
+			continue
+		}
+
+		b.diffs.changed++
+		b.diffs.added += d.Added
+		b.diffs.removed += d.Removed
+	}
+}
+
 func stringCountMapToString(countMap map[string]int) string {
 	s := []string{}
 
@@ -199,6 +260,18 @@ func (b *batchTransaction) logBatchSummary() {
 	log.Printf("        worker %d: [tx] operations: %s", b.id, operationStr)
 	log.Printf("        worker %d: [tx] types: %s", b.id, typeStr)
 	log.Printf("        worker %d: [tx] sources: %s", b.id, sourceStr)
+
+	if b.badAttributes > 0 {
+		log.Printf("        worker %d: [tx] invalid attributes: %d", b.id, b.badAttributes)
+	}
+
+	if len(b.invalid) > 0 {
+		log.Printf("        worker %d: [tx] validation failures: %s", b.id, stringCountMapToString(b.invalid))
+	}
+
+	if b.cache.logDiffs == true {
+		log.Printf("        worker %d: [tx] updates: %d new, %d changed (+%d -%d lines), %d unchanged, %d offloaded (not compared)", b.id, b.diffs.new, b.diffs.changed, b.diffs.added, b.diffs.removed, b.diffs.unchanged, b.diffs.offloaded)
+	}
 }
 
 //func (b *batchTransaction) logBatchDetails() {
@@ -227,6 +300,8 @@ func (b *batchTransaction) flushRecords() {
 
 	flush.setStopNow()
 
+	b.cache.flushTimes.observe(flush.stop.Sub(flush.start), flush.stop)
+
 	log.Printf("[cache] worker %d: INFO: flushed %d messages (%0.2f mps)", b.id, flush.count, flush.getRate())
 
 	b.logBatchSummary()
@@ -236,6 +311,9 @@ func (b *batchTransaction) flushRecords() {
 	b.deleteChan <- b.messages
 
 	b.messages = nil
+	b.invalid = make(map[string]int)
+	b.badAttributes = 0
+	b.diffs = diffCounts{}
 }
 
 //
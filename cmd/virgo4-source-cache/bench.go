@@ -0,0 +1,357 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// benchOptions are the load generator settings shared by every benchmarked configuration
+type benchOptions struct {
+	messages      int     // messages per run
+	ids           int     // id cardinality
+	updatePercent int     // percentage of updates; the rest are deletes
+	payloadDist   string  // fixed, uniform or lognormal
+	payloadMin    int     // minimum payload size
+	payloadMax    int     // maximum payload size
+	payloadMedian int     // median payload size (lognormal)
+	payloadSigma  float64 // spread of payload sizes (lognormal)
+	seed          int64   // random seed, so every configuration sees the same messages
+	table         string  // the table written to
+	keep          bool    // keep the table afterwards
+	verbose       bool    // show pipeline logging
+}
+
+// benchResult is the outcome of one benchmarked configuration
+type benchResult struct {
+	workers   int
+	batchSize int
+	flushTime int
+	messages  int
+	elapsed   time.Duration
+	latencies []time.Duration // receive to delete, per message
+}
+
+// benchSource is a memorySource that records how long each message spent in the pipeline
+type benchSource struct {
+	*memorySource
+
+	sync.Mutex
+	received  map[awssqs.ReceiptHandle]time.Time
+	latencies []time.Duration
+}
+
+func newBenchSource(size int) *benchSource {
+	return &benchSource{
+		memorySource: newMemorySource(size),
+		received:     make(map[awssqs.ReceiptHandle]time.Time),
+	}
+}
+
+func (s *benchSource) ReceiveBatch(maxMessages uint, waitTime time.Duration) ([]awssqs.Message, error) {
+	messages, err := s.memorySource.ReceiveBatch(maxMessages, waitTime)
+
+	now := time.Now()
+
+	s.Lock()
+	for _, m := range messages {
+		s.received[m.ReceiptHandle] = now
+	}
+	s.Unlock()
+
+	return messages, err
+}
+
+func (s *benchSource) DeleteBatch(messages []awssqs.Message) ([]awssqs.OpStatus, error) {
+	ops, err := s.memorySource.DeleteBatch(messages)
+
+	now := time.Now()
+
+	s.Lock()
+	for ix, m := range messages {
+		if ix < len(ops) && ops[ix] == true {
+			s.latencies = append(s.latencies, now.Sub(s.received[m.ReceiptHandle]))
+			delete(s.received, m.ReceiptHandle)
+		}
+	}
+	s.Unlock()
+
+	return ops, err
+}
+
+func parseIntList(name string, value string) []int {
+	var list []int
+
+	for _, v := range strings.Split(value, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || n <= 0 {
+			log.Fatalf("FATAL: -%s must be a comma separated list of positive integers: [%s]", name, value)
+		}
+		list = append(list, n)
+	}
+
+	return list
+}
+
+// payloadSize picks a payload size from the configured distribution
+func (o benchOptions) payloadSize(r *rand.Rand) int {
+	size := o.payloadMin
+
+	switch o.payloadDist {
+	case "fixed":
+		return o.payloadMax
+
+	case "uniform":
+		size = o.payloadMin + r.Intn(o.payloadMax-o.payloadMin+1)
+
+	case "lognormal":
+		size = int(float64(o.payloadMedian) * math.Exp(r.NormFloat64()*o.payloadSigma))
+	}
+
+	if size < o.payloadMin {
+		size = o.payloadMin
+	}
+	if size > o.payloadMax {
+		size = o.payloadMax
+	}
+
+	return size
+}
+
+// generateMessages synthesizes the message stream for a run
+func (o benchOptions) generateMessages() []awssqs.Message {
+	r := rand.New(rand.NewSource(o.seed))
+
+	letters := "abcdefghijklmnopqrstuvwxyz0123456789 "
+
+	messages := make([]awssqs.Message, 0, o.messages)
+
+	for i := 0; i < o.messages; i++ {
+		id := fmt.Sprintf("bench-%08d", r.Intn(o.ids))
+
+		operation := awssqs.AttributeValueRecordOperationUpdate
+		if r.Intn(100) >= o.updatePercent {
+			operation = awssqs.AttributeValueRecordOperationDelete
+		}
+
+		var payload []byte
+
+		if operation == awssqs.AttributeValueRecordOperationUpdate {
+			payload = []byte(fmt.Sprintf("<record id=\"%s\"><data>", id))
+			for n := o.payloadSize(r) - len(payload) - len("</data></record>"); n > 0; n-- {
+				payload = append(payload, letters[r.Intn(len(letters))])
+			}
+			payload = append(payload, "</data></record>"...)
+		}
+
+		messages = append(messages, awssqs.Message{
+			Attribs: awssqs.Attributes{
+				{Name: awssqs.AttributeKeyRecordId, Value: id},
+				{Name: awssqs.AttributeKeyRecordType, Value: awssqs.AttributeValueRecordTypeXml},
+				{Name: awssqs.AttributeKeyRecordSource, Value: "bench"},
+				{Name: awssqs.AttributeKeyRecordOperation, Value: operation},
+			},
+			Payload: payload,
+		})
+	}
+
+	return messages
+}
+
+// benchExecute runs statements against the database behind the store for the benchmark table
+func benchExecute(cfg ServiceConfig, secrets *secretResolver, queries ...string) error {
+	store, err := NewCacheStore(cfg, secrets)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	handle := storeHandle(store)
+
+	for _, q := range queries {
+		if _, err = handle.NewQuery(cleanQuery(q, cfg.PostgresTable)).Execute(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// benchPrepareTable creates (if necessary) and empties the benchmark table
+func benchPrepareTable(cfg ServiceConfig, secrets *secretResolver, like string) error {
+	if cfg.CacheStore == storePostgres {
+		return benchExecute(cfg, secrets,
+			"CREATE TABLE IF NOT EXISTS {:table} (LIKE "+like+" INCLUDING ALL)",
+			"TRUNCATE {:table}")
+	}
+
+	// the sqlite store creates its own table
+	return benchExecute(cfg, secrets, "DELETE FROM {:table}")
+}
+
+// benchRun drives the messages through the real pipeline with the given configuration
+func benchRun(cfg ServiceConfig, secrets *secretResolver, messages []awssqs.Message) benchResult {
+	source := newBenchSource(cfg.WorkerQueueSize)
+	cache := NewDbCache(1, cfg, secrets)
+	defer cache.store.Close()
+
+	start := time.Now()
+
+	p := startPipeline(cfg, source, cache)
+
+	go func() {
+		for _, m := range messages {
+			source.Put(m)
+		}
+		source.Close()
+	}()
+
+	p.pollMessages()
+	p.shutdown()
+
+	return benchResult{
+		workers:   cfg.Workers,
+		batchSize: cfg.PostgresBatchSize,
+		flushTime: cfg.WorkerFlushTime,
+		messages:  len(messages),
+		elapsed:   time.Since(start),
+		latencies: source.latencies,
+	}
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	ix := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if ix < 0 {
+		ix = 0
+	}
+
+	return sorted[ix]
+}
+
+func benchReport(results []benchResult) {
+	fmt.Printf("%8s %10s %6s %10s %10s %10s %10s %10s %10s\n",
+		"workers", "batchsize", "flush", "messages", "mps", "p50", "p90", "p99", "max")
+
+	for _, r := range results {
+		sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+
+		mps := float64(r.messages) / r.elapsed.Seconds()
+
+		fmt.Printf("%8d %10d %5ds %10d %10.2f %10s %10s %10s %10s\n",
+			r.workers, r.batchSize, r.flushTime, r.messages, mps,
+			percentile(r.latencies, 0.50).Round(time.Millisecond),
+			percentile(r.latencies, 0.90).Round(time.Millisecond),
+			percentile(r.latencies, 0.99).Round(time.Millisecond),
+			percentile(r.latencies, 1.00).Round(time.Millisecond))
+	}
+}
+
+// bench is the load generator: it synthesizes messages and drives them through the real batching
+// and database code for each combination of the tuning knobs, reporting throughput and latency
+func bench(args []string) {
+	var opts benchOptions
+
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	configFile := fs.String(configFileFlag, "", "optional YAML configuration file for the storage backend settings")
+	workers := fs.String("workers", "1,2,4,8", "comma separated worker counts to benchmark")
+	batchSizes := fs.String("batch-sizes", "100,500", "comma separated database batch sizes to benchmark")
+	flushTimes := fs.String("flush-times", "1", "comma separated worker flush times (seconds) to benchmark")
+	deleters := fs.Int("deleters", 2, "deleter count")
+	queueSize := fs.Int("queue-size", 1000, "worker and delete queue size")
+	fs.IntVar(&opts.messages, "messages", 10000, "messages per configuration")
+	fs.IntVar(&opts.ids, "ids", 5000, "id cardinality")
+	fs.IntVar(&opts.updatePercent, "update-percent", 95, "percentage of messages that are updates; the rest are deletes")
+	fs.StringVar(&opts.payloadDist, "payload-dist", "lognormal", "payload size distribution: fixed, uniform or lognormal")
+	fs.IntVar(&opts.payloadMin, "payload-min", 256, "minimum payload size (bytes)")
+	fs.IntVar(&opts.payloadMax, "payload-max", 65536, "maximum payload size (bytes)")
+	fs.IntVar(&opts.payloadMedian, "payload-median", 4096, "median payload size (bytes, lognormal)")
+	fs.Float64Var(&opts.payloadSigma, "payload-sigma", 1.0, "payload size spread (lognormal)")
+	fs.Int64Var(&opts.seed, "seed", 1, "random seed")
+	fs.StringVar(&opts.table, "table", "source_cache_bench", "the table to benchmark against; it is emptied before each run")
+	fs.BoolVar(&opts.keep, "keep", false, "keep the benchmark table afterwards")
+	fs.BoolVar(&opts.verbose, "verbose", false, "show pipeline logging")
+	fs.Parse(args)
+
+	switch {
+	case opts.payloadDist != "fixed" && opts.payloadDist != "uniform" && opts.payloadDist != "lognormal":
+		log.Fatalf("FATAL: unsupported payload distribution: [%s]", opts.payloadDist)
+	case opts.payloadMin < 0 || opts.payloadMax < opts.payloadMin:
+		log.Fatalf("FATAL: invalid payload size range: %d - %d", opts.payloadMin, opts.payloadMax)
+	case opts.messages <= 0 || opts.ids <= 0:
+		log.Fatalf("FATAL: -messages and -ids must be positive")
+	case opts.updatePercent < 0 || opts.updatePercent > 100:
+		log.Fatalf("FATAL: -update-percent must be between 0 and 100")
+	}
+
+	cfg := *loadStoreConfiguration(*configFile)
+	secrets := newConfiguredSecretResolver(cfg)
+
+	// never benchmark against the cache itself
+	like := cfg.PostgresTable
+	if opts.table == like {
+		log.Fatalf("FATAL: benchmark table must not be the cache table [%s]", like)
+	}
+	cfg.PostgresTable = opts.table
+	cfg.PostgresRoutes = ""
+
+	cfg.PollTimeOut = 1
+	cfg.Deleters = *deleters
+	cfg.WorkerQueueSize = *queueSize
+	cfg.DeleteQueueSize = *queueSize
+
+	log.Printf("[bench] generating %d messages...", opts.messages)
+	messages := opts.generateMessages()
+
+	var results []benchResult
+
+	for _, w := range parseIntList("workers", *workers) {
+		for _, b := range parseIntList("batch-sizes", *batchSizes) {
+			for _, f := range parseIntList("flush-times", *flushTimes) {
+				cfg.Workers = w
+				cfg.PostgresBatchSize = b
+				cfg.WorkerFlushTime = f
+
+				if err := benchPrepareTable(cfg, secrets, like); err != nil {
+					log.Fatalf("FATAL: preparing benchmark table: %s", err.Error())
+				}
+
+				log.Printf("[bench] running: workers = %d, batch size = %d, flush time = %ds", w, b, f)
+
+				if opts.verbose == false {
+					log.SetOutput(io.Discard)
+				}
+
+				results = append(results, benchRun(cfg, secrets, messages))
+
+				log.SetOutput(os.Stderr)
+			}
+		}
+	}
+
+	if opts.keep == false {
+		if err := benchExecute(cfg, secrets, "DROP TABLE IF EXISTS {:table}"); err != nil {
+			log.Printf("[bench] WARNING: dropping benchmark table: %s", err.Error())
+		}
+	}
+
+	benchReport(results)
+}
+
+//
+// end of file
+//
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+//
+// payloads can be compressed at rest. compressed payloads are kept in the payload_data column with
+// the codec named in payload_codec (and an empty payload); uncompressed payloads stay in the payload
+// column with no codec, so rows written before compression was enabled (or with it disabled) read
+// exactly as they always did
+//
+
+// the supported payload codecs
+const (
+	codecNone = "none"
+	codecGzip = "gzip"
+	codecZstd = "zstd"
+)
+
+// encoders and decoders are safe for concurrent use when used a whole payload at a time
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// storedPayload is a payload as written to the cache table
+type storedPayload struct {
+	text  string      // the payload column; empty when compressed
+	data  interface{} // the payload_data column; nil when not compressed
+	codec string      // the payload_codec column; empty when not compressed
+	ref   string      // the payload_ref column; the object key when offloaded
+}
+
+// payloadCodec compresses payloads on the way into the cache
+type payloadCodec struct {
+	name string
+	min  int // smaller payloads are left alone
+}
+
+// newPayloadCodec - the factory
+func newPayloadCodec(cfg ServiceConfig) (*payloadCodec, error) {
+	switch cfg.PayloadCodec {
+	case codecNone, codecGzip, codecZstd:
+		return &payloadCodec{name: cfg.PayloadCodec, min: cfg.PayloadCompressMin}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported payload codec: [%s]", cfg.PayloadCodec)
+}
+
+// encode returns the payload as it should be stored. payloads are only stored compressed when that
+// makes them smaller
+func (c *payloadCodec) encode(payload []byte) (storedPayload, error) {
+	plain := storedPayload{text: string(payload)}
+
+	if c.name == codecNone || len(payload) < c.min {
+		return plain, nil
+	}
+
+	compressed, err := compressPayload(c.name, payload)
+	if err != nil {
+		return storedPayload{}, err
+	}
+
+	if len(compressed) >= len(payload) {
+		return plain, nil
+	}
+
+	return storedPayload{data: compressed, codec: c.name}, nil
+}
+
+func compressPayload(codec string, payload []byte) ([]byte, error) {
+	switch codec {
+	case codecGzip:
+		var buf bytes.Buffer
+
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+
+	case codecZstd:
+		return zstdEncoder.EncodeAll(payload, nil), nil
+	}
+
+	return nil, fmt.Errorf("unsupported payload codec: [%s]", codec)
+}
+
+// decodePayload reverses encode, given the stored columns
+func decodePayload(text []byte, data []byte, codec string) ([]byte, error) {
+	switch codec {
+	case "":
+		return text, nil
+
+	case codecGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+
+		return io.ReadAll(r)
+
+	case codecZstd:
+		return zstdDecoder.DecodeAll(data, nil)
+	}
+
+	return nil, fmt.Errorf("unsupported payload codec: [%s]", codec)
+}
+
+//
+// end of file
+//
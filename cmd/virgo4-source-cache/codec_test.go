@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPayloadCodecs(t *testing.T) {
+	payload := []byte(strings.Repeat(`{"field":"compressible"}`, 50))
+
+	for _, name := range []string{codecNone, codecGzip, codecZstd} {
+		codec, err := newPayloadCodec(ServiceConfig{PayloadCodec: name, PayloadCompressMin: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stored, err := codec.encode(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var data []byte
+		if stored.data != nil {
+			data = stored.data.([]byte)
+		}
+
+		decoded, err := decodePayload([]byte(stored.text), data, stored.codec)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err.Error())
+		}
+
+		if bytes.Equal(decoded, payload) == false {
+			t.Errorf("%s: payload did not survive the round trip", name)
+		}
+
+		if name != codecNone && (stored.codec != name || len(data) >= len(payload)) {
+			t.Errorf("%s: expected a compressed payload, got codec [%s] with %d bytes", name, stored.codec, len(data))
+		}
+
+		// small payloads are left alone
+		if stored, _ = codec.encode([]byte("<r/>")); stored.codec != "" || stored.text != "<r/>" {
+			t.Errorf("%s: expected the small payload to be stored as is", name)
+		}
+	}
+
+	if _, err := newPayloadCodec(ServiceConfig{PayloadCodec: "lz4"}); err == nil {
+		t.Errorf("expected an error for an unsupported codec")
+	}
+}
+
+//
+// end of file
+//
@@ -1,104 +1,692 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
 	"os"
+	"regexp"
 	"strconv"
+	"strings"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+	"gopkg.in/yaml.v3"
 )
 
 // ServiceConfig defines all of the service configuration parameters
 type ServiceConfig struct {
-	InQueueName       string
-	MessageBucketName string
-	PollTimeOut       int64
-	Workers           int
-	WorkerQueueSize   int
-	WorkerFlushTime   int
-	Deleters          int
-	DeleteQueueSize   int
-	PostgresHost      string
-	PostgresPort      int
-	PostgresUser      string
-	PostgresPass      string
-	PostgresDatabase  string
-	PostgresTable     string
-	PostgresBatchSize int
-}
-
-func ensureSet(env string) string {
-	val, set := os.LookupEnv(env)
+	InputMode            string
+	InputPath            string
+	InputWatch           bool
+	InQueueName          string
+	InQueueWeights       string
+	MessageBucketName    string
+	PollTimeOut          int64
+	Workers              int
+	WorkersMin           int
+	WorkersMax           int
+	WorkerQueueSize      int
+	WorkerFlushTime      int
+	Deleters             int
+	DeleteQueueSize      int
+	DeleteRetries        int
+	DeleteRetryWait      int
+	VisibilityTimeout    int
+	VisibilityExtend     bool
+	FlowHighWater        int
+	FlowLowWater         int
+	FlowMaxFlushTime     int
+	CacheStore           string
+	SqlitePath           string
+	PostgresDSN          string
+	PostgresHost         string
+	PostgresPort         int
+	PostgresUser         string
+	PostgresPass         string
+	PostgresDatabase     string
+	PostgresSSLMode      string
+	PostgresSSLCA        string
+	PostgresTimeout      int
+	PostgresMaxOpen      int
+	PostgresMaxIdle      int
+	PostgresLifetime     int
+	PostgresTable        string
+	PostgresRoutes       string
+	PostgresCreateTables bool
+	PostgresBatchSize    int
+	PostgresMigrate      bool
+	PayloadCodec         string
+	PayloadCompressMin   int
+	OffloadThreshold     int
+	OffloadLocation      string
+	NormalizeAttributes  bool
+	LogDiffs             bool
+	RateLimits           string
+	RecordTTLs           string
+	ExpiryAttributes     bool
+	ReapInterval         int
+	ValidateActions      string
+	ValidateSchemas      string
+	SecretsEndpoint      string
+	SecretsCacheTime     int
+	HTTPListen           string
+	HTTPToken            string
+	HistoryVersions      int
+}
 
-	if set == false {
-		log.Printf("FATAL: environment variable not set: [%s]", env)
-		os.Exit(1)
+// the largest batch we will write in a single transaction
+const maxBatchSize = 10000
+
+// the environment variable and flag naming the optional configuration file
+const configFileEnv = "VIRGO4_SOURCE_CACHE_CONFIG"
+const configFileFlag = "config"
+
+// what secrets look like when printed
+const redacted = "REDACTED"
+
+// table names are substituted directly into queries
+var validTableName = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// defaultConfiguration returns the configuration before any file, env or flag settings are applied
+func defaultConfiguration() ServiceConfig {
+	return ServiceConfig{
+		InputMode:          inputSqs,
+		PollTimeOut:        20,
+		Workers:            4,
+		WorkerQueueSize:    1000,
+		WorkerFlushTime:    5,
+		Deleters:           2,
+		DeleteQueueSize:    100,
+		DeleteRetries:      4,
+		DeleteRetryWait:    250,
+		VisibilityExtend:   true,
+		FlowHighWater:      80,
+		FlowLowWater:       50,
+		CacheStore:         storePostgres,
+		PostgresPort:       5432,
+		PostgresTimeout:    30,
+		PostgresLifetime:   1800,
+		PostgresTable:      "source_cache",
+		PostgresBatchSize:  500,
+		ReapInterval:       300,
+		PayloadCodec:       codecNone,
+		PayloadCompressMin: 512,
+		SecretsCacheTime:   300,
 	}
+}
 
-	return val
+//
+// configuration values; these satisfy flag.Value so the same setters serve the config file, env and flags
+//
+
+type stringValue struct{ p *string }
+
+func (v stringValue) Set(s string) error { *v.p = s; return nil }
+func (v stringValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return *v.p
 }
 
-func ensureSetAndNonEmpty(env string) string {
-	val := ensureSet(env)
+type intValue struct{ p *int }
 
-	if val == "" {
-		log.Printf("FATAL: environment variable set but empty: [%s]", env)
-		os.Exit(1)
+func (v intValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("not an integer: [%s]", s)
 	}
+	*v.p = n
+	return nil
+}
+func (v intValue) String() string {
+	if v.p == nil {
+		return "0"
+	}
+	return strconv.Itoa(*v.p)
+}
 
-	return val
+type int64Value struct{ p *int64 }
+
+func (v int64Value) Set(s string) error {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("not an integer: [%s]", s)
+	}
+	*v.p = n
+	return nil
+}
+func (v int64Value) String() string {
+	if v.p == nil {
+		return "0"
+	}
+	return strconv.FormatInt(*v.p, 10)
 }
 
-func envToInt(env string) int {
-	number := ensureSetAndNonEmpty(env)
+type boolValue struct{ p *bool }
 
-	n, err := strconv.Atoi(number)
+func (v boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("not a boolean: [%s]", s)
+	}
+	*v.p = b
+	return nil
+}
+func (v boolValue) String() string {
+	if v.p == nil {
+		return "false"
 	}
+	return strconv.FormatBool(*v.p)
+}
+func (v boolValue) IsBoolFlag() bool { return true }
 
-	return n
+// configItem is a single configuration setting. the env name is authoritative; the flag name
+// and config file key are derived from it
+type configItem struct {
+	name   string     // the ServiceConfig field
+	env    string     // environment variable
+	usage  string     // flag help
+	secret bool       // redact when printing
+	value  flag.Value // setter bound to the ServiceConfig field
 }
 
-// LoadConfiguration will load the service configuration from env/cmdline
-// and return a pointer to it. Any failures are fatal.
-func LoadConfiguration() *ServiceConfig {
+// the flag name: VIRGO4_SOURCE_CACHE_POSTGRES_HOST -> postgres-host, VIRGO4_SQS_MESSAGE_BUCKET -> sqs-message-bucket
+func (i configItem) flag() string {
+	name := strings.TrimPrefix(i.env, "VIRGO4_SOURCE_CACHE_")
+	name = strings.TrimPrefix(name, "VIRGO4_")
+	return strings.ReplaceAll(strings.ToLower(name), "_", "-")
+}
+
+// the config file key: postgres_host
+func (i configItem) key() string {
+	return strings.ReplaceAll(i.flag(), "-", "_")
+}
+
+// configItems returns the configuration settings bound to the specified configuration
+func configItems(cfg *ServiceConfig) []configItem {
+	return []configItem{
+		{"InputMode", "VIRGO4_SOURCE_CACHE_INPUT", "message source: sqs or file", false, stringValue{&cfg.InputMode}},
+		{"InputPath", "VIRGO4_SOURCE_CACHE_INPUT_PATH", "file, directory or - (stdin) to read messages from in file mode", false, stringValue{&cfg.InputPath}},
+		{"InputWatch", "VIRGO4_SOURCE_CACHE_INPUT_WATCH", "watch the input directory for new files in file mode", false, boolValue{&cfg.InputWatch}},
+		{"InQueueName", "VIRGO4_SOURCE_CACHE_IN_QUEUE", "inbound queue name, or a comma separated list of queues in priority order", false, stringValue{&cfg.InQueueName}},
+		{"InQueueWeights", "VIRGO4_SOURCE_CACHE_IN_QUEUE_WEIGHTS", "comma separated polling weights, one per inbound queue; empty for strict priority", false, stringValue{&cfg.InQueueWeights}},
+		{"MessageBucketName", "VIRGO4_SQS_MESSAGE_BUCKET", "bucket for oversize SQS messages", false, stringValue{&cfg.MessageBucketName}},
+		{"PollTimeOut", "VIRGO4_SOURCE_CACHE_POLL_TIMEOUT", "queue poll timeout (seconds)", false, int64Value{&cfg.PollTimeOut}},
+		{"Workers", "VIRGO4_SOURCE_CACHE_WORKERS", "worker count", false, intValue{&cfg.Workers}},
+		{"WorkersMin", "VIRGO4_SOURCE_CACHE_WORKERS_MIN", "fewest workers when scaling (default: workers)", false, intValue{&cfg.WorkersMin}},
+		{"WorkersMax", "VIRGO4_SOURCE_CACHE_WORKERS_MAX", "most workers when scaling (default: workers)", false, intValue{&cfg.WorkersMax}},
+		{"WorkerQueueSize", "VIRGO4_SOURCE_CACHE_WORKER_QUEUE_SIZE", "worker queue size", false, intValue{&cfg.WorkerQueueSize}},
+		{"WorkerFlushTime", "VIRGO4_SOURCE_CACHE_WORKER_FLUSH_TIME", "idle time before a worker flushes a partial batch (seconds)", false, intValue{&cfg.WorkerFlushTime}},
+		{"Deleters", "VIRGO4_SOURCE_CACHE_DELETERS", "deleter count", false, intValue{&cfg.Deleters}},
+		{"DeleteQueueSize", "VIRGO4_SOURCE_CACHE_DELETE_QUEUE_SIZE", "delete queue size", false, intValue{&cfg.DeleteQueueSize}},
+		{"DeleteRetries", "VIRGO4_SOURCE_CACHE_DELETE_RETRIES", "times a failed message delete is retried before giving up on it", false, intValue{&cfg.DeleteRetries}},
+		{"DeleteRetryWait", "VIRGO4_SOURCE_CACHE_DELETE_RETRY_WAIT", "wait before the first delete retry, doubling for each after (milliseconds)", false, intValue{&cfg.DeleteRetryWait}},
+		{"VisibilityTimeout", "VIRGO4_SOURCE_CACHE_VISIBILITY_TIMEOUT", "inbound queue visibility timeout (seconds, 0 = ask the queue)", false, intValue{&cfg.VisibilityTimeout}},
+		{"VisibilityExtend", "VIRGO4_SOURCE_CACHE_VISIBILITY_EXTEND", "extend the visibility timeout of messages not yet deleted as it runs out", false, boolValue{&cfg.VisibilityExtend}},
+		{"FlowHighWater", "VIRGO4_SOURCE_CACHE_FLOW_HIGH_WATER", "pause polling when the worker or delete queue is this full (percent)", false, intValue{&cfg.FlowHighWater}},
+		{"FlowLowWater", "VIRGO4_SOURCE_CACHE_FLOW_LOW_WATER", "resume polling when the worker and delete queues are below this (percent)", false, intValue{&cfg.FlowLowWater}},
+		{"FlowMaxFlushTime", "VIRGO4_SOURCE_CACHE_FLOW_MAX_FLUSH_TIME", "also pause polling while batches take longer than this to flush (milliseconds, 0 = never)", false, intValue{&cfg.FlowMaxFlushTime}},
+		{"CacheStore", "VIRGO4_SOURCE_CACHE_STORE", "storage backend: postgres or sqlite", false, stringValue{&cfg.CacheStore}},
+		{"SqlitePath", "VIRGO4_SOURCE_CACHE_SQLITE_PATH", "sqlite database file", false, stringValue{&cfg.SqlitePath}},
+		{"PostgresDSN", "VIRGO4_SOURCE_CACHE_POSTGRES_DSN", "postgres connection string (key=value or URL); replaces the host, port, user, password and database settings", true, stringValue{&cfg.PostgresDSN}},
+		{"PostgresHost", "VIRGO4_SOURCE_CACHE_POSTGRES_HOST", "postgres host", false, stringValue{&cfg.PostgresHost}},
+		{"PostgresPort", "VIRGO4_SOURCE_CACHE_POSTGRES_PORT", "postgres port", false, intValue{&cfg.PostgresPort}},
+		{"PostgresUser", "VIRGO4_SOURCE_CACHE_POSTGRES_USER", "postgres user", false, stringValue{&cfg.PostgresUser}},
+		{"PostgresPass", "VIRGO4_SOURCE_CACHE_POSTGRES_PASS", "postgres password", true, stringValue{&cfg.PostgresPass}},
+		{"PostgresDatabase", "VIRGO4_SOURCE_CACHE_POSTGRES_DATABASE", "postgres database", false, stringValue{&cfg.PostgresDatabase}},
+		{"PostgresSSLMode", "VIRGO4_SOURCE_CACHE_POSTGRES_SSLMODE", "postgres TLS mode: disable, require, verify-ca or verify-full (default: the driver default, require)", false, stringValue{&cfg.PostgresSSLMode}},
+		{"PostgresSSLCA", "VIRGO4_SOURCE_CACHE_POSTGRES_SSLROOTCERT", "CA certificate file used to verify the postgres server", false, stringValue{&cfg.PostgresSSLCA}},
+		{"PostgresTimeout", "VIRGO4_SOURCE_CACHE_POSTGRES_CONNECT_TIMEOUT", "postgres connect timeout (seconds)", false, intValue{&cfg.PostgresTimeout}},
+		{"PostgresMaxOpen", "VIRGO4_SOURCE_CACHE_POSTGRES_MAX_OPEN", "maximum open postgres connections (default: workers + 2)", false, intValue{&cfg.PostgresMaxOpen}},
+		{"PostgresMaxIdle", "VIRGO4_SOURCE_CACHE_POSTGRES_MAX_IDLE", "maximum idle postgres connections (default: workers)", false, intValue{&cfg.PostgresMaxIdle}},
+		{"PostgresLifetime", "VIRGO4_SOURCE_CACHE_POSTGRES_CONN_LIFETIME", "maximum postgres connection lifetime (seconds, 0 = unlimited)", false, intValue{&cfg.PostgresLifetime}},
+		{"PostgresTable", "VIRGO4_SOURCE_CACHE_POSTGRES_TABLE", "cache table", false, stringValue{&cfg.PostgresTable}},
+		{"PostgresRoutes", "VIRGO4_SOURCE_CACHE_POSTGRES_ROUTES", "comma separated source, source/type or */type = table routes; unrouted records go to the cache table", false, stringValue{&cfg.PostgresRoutes}},
+		{"PostgresCreateTables", "VIRGO4_SOURCE_CACHE_POSTGRES_CREATE_TABLES", "create missing routed tables like the cache table", false, boolValue{&cfg.PostgresCreateTables}},
+		{"PostgresBatchSize", "VIRGO4_SOURCE_CACHE_POSTGRES_BATCH_SIZE", "messages written per transaction", false, intValue{&cfg.PostgresBatchSize}},
+		{"PostgresMigrate", "VIRGO4_SOURCE_CACHE_POSTGRES_MIGRATE", "apply any pending schema migrations at startup, rather than refusing to run", false, boolValue{&cfg.PostgresMigrate}},
+		{"PayloadCodec", "VIRGO4_SOURCE_CACHE_PAYLOAD_CODEC", "payload compression at rest: none, gzip or zstd", false, stringValue{&cfg.PayloadCodec}},
+		{"PayloadCompressMin", "VIRGO4_SOURCE_CACHE_PAYLOAD_COMPRESS_MIN", "payloads smaller than this (bytes) are not compressed", false, intValue{&cfg.PayloadCompressMin}},
+		{"OffloadThreshold", "VIRGO4_SOURCE_CACHE_OFFLOAD_THRESHOLD", "payloads at least this large (bytes) are written to the offload location; 0 to keep everything in the table", false, intValue{&cfg.OffloadThreshold}},
+		{"OffloadLocation", "VIRGO4_SOURCE_CACHE_OFFLOAD_LOCATION", "where large payloads are written: s3://bucket/prefix or file:///directory", false, stringValue{&cfg.OffloadLocation}},
+		{"NormalizeAttributes", "VIRGO4_SOURCE_CACHE_NORMALIZE_ATTRIBUTES", "trim the message attributes and lower case the source", false, boolValue{&cfg.NormalizeAttributes}},
+		{"LogDiffs", "VIRGO4_SOURCE_CACHE_LOG_DIFFS", "log the size of the changes each batch of updates makes, at the cost of reading the cached records first", false, boolValue{&cfg.LogDiffs}},
+		{"RateLimits", "VIRGO4_SOURCE_CACHE_RATE_LIMITS", "comma separated source = records a second[:burst]: limit the write rate of records from the source, delaying the rest", false, stringValue{&cfg.RateLimits}},
+		{"RecordTTLs", "VIRGO4_SOURCE_CACHE_RECORD_TTLS", "comma separated key = ttl (like 36h or 30d), keys as for PostgresRoutes: expire records with the source and/or type after the ttl", false, stringValue{&cfg.RecordTTLs}},
+		{"ExpiryAttributes", "VIRGO4_SOURCE_CACHE_EXPIRY_ATTRIBUTES", "accept the expires attribute (an RFC 3339 time) on messages, overriding RecordTTLs", false, boolValue{&cfg.ExpiryAttributes}},
+		{"HistoryVersions", "VIRGO4_SOURCE_CACHE_HISTORY_VERSIONS", "earlier versions of each record to keep for diffs (not those with offloaded payloads); 0 for none", false, intValue{&cfg.HistoryVersions}},
+		{"ReapInterval", "VIRGO4_SOURCE_CACHE_REAP_INTERVAL", "how often expired records are deleted (seconds), when records can expire; 0 to never delete them", false, intValue{&cfg.ReapInterval}},
+		{"ValidateActions", "VIRGO4_SOURCE_CACHE_VALIDATE", "comma separated type = reject, quarantine or warn: validate payloads of the record type and what to do with invalid ones; * for every other type", false, stringValue{&cfg.ValidateActions}},
+		{"ValidateSchemas", "VIRGO4_SOURCE_CACHE_VALIDATE_SCHEMAS", "comma separated type = schema file: XML Schema (.xsd, needs xmllint, run once per payload) or JSON Schema to validate payloads of the record type against", false, stringValue{&cfg.ValidateSchemas}},
+		{"SecretsEndpoint", "VIRGO4_SOURCE_CACHE_SECRETS_ENDPOINT", "alternative Secrets Manager endpoint URL (e.g. a local stub)", false, stringValue{&cfg.SecretsEndpoint}},
+		{"SecretsCacheTime", "VIRGO4_SOURCE_CACHE_SECRETS_CACHE_TIME", "how long resolved secrets are cached (seconds)", false, intValue{&cfg.SecretsCacheTime}},
+		{"HTTPListen", "VIRGO4_SOURCE_CACHE_HTTP_LISTEN", "address to serve the http endpoints (/stats, /diff) on, like :8080; empty for none", false, stringValue{&cfg.HTTPListen}},
+		{"HTTPToken", "VIRGO4_SOURCE_CACHE_HTTP_TOKEN", "bearer token required by the http endpoints; /diff is only served with one", true, stringValue{&cfg.HTTPToken}},
+	}
+}
+
+// newConfigFlagSet returns a flag set for the configuration settings bound to cfg, plus the config file flag
+func newConfigFlagSet(name string, cfg *ServiceConfig, configFile *string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+
+	fs.StringVar(configFile, configFileFlag, "", fmt.Sprintf("optional YAML configuration file (env: %s)", configFileEnv))
+
+	for _, item := range configItems(cfg) {
+		fs.Var(item.value, item.flag(), fmt.Sprintf("%s (env: %s)", item.usage, item.env))
+	}
+
+	return fs
+}
+
+// loadConfigFile applies the settings in a YAML configuration file
+func loadConfigFile(cfg *ServiceConfig, path string) error {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var settings map[string]yaml.Node
+	if err = yaml.Unmarshal(contents, &settings); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	items := make(map[string]configItem)
+	for _, item := range configItems(cfg) {
+		items[item.key()] = item
+	}
+
+	var problems []string
+
+	for key, node := range settings {
+		item, ok := items[key]
+
+		switch {
+		case ok == false:
+			problems = append(problems, fmt.Sprintf("unknown setting [%s]", key))
+
+		case node.Kind != yaml.ScalarNode:
+			problems = append(problems, fmt.Sprintf("%s: expected a single value", key))
+
+		default:
+			if err = item.value.Set(node.Value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", key, err.Error()))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s: %s", path, strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// loadConfiguration builds the configuration from, in increasing order of precedence: the defaults,
+// the optional configuration file, the environment and the command line flags
+func loadConfiguration(name string, args []string) (*ServiceConfig, error) {
+	// parse the flags up front to find the config file and validate them, but apply them last
+	var scratch ServiceConfig
+	configFile := os.Getenv(configFileEnv)
+
+	fs := newConfigFlagSet(name, &scratch, &configFile)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	cfg := defaultConfiguration()
+
+	if configFile != "" {
+		if err := loadConfigFile(&cfg, configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, item := range configItems(&cfg) {
+		if val := os.Getenv(item.env); val != "" {
+			if err := item.value.Set(val); err != nil {
+				return nil, fmt.Errorf("%s: %s", item.env, err.Error())
+			}
+		}
+	}
+
+	items := make(map[string]configItem)
+	for _, item := range configItems(&cfg) {
+		items[item.flag()] = item
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if item, ok := items[f.Name]; ok == true && err == nil {
+			err = item.value.Set(f.Value.String())
+		}
+	})
+
+	return &cfg, err
+}
+
+// validateStore reports all problems with the storage backend settings
+func (cfg *ServiceConfig) validateStore() []string {
+	var problems []string
+
+	required := func(name string, value string) {
+		if value == "" {
+			problems = append(problems, fmt.Sprintf("%s is required", name))
+		}
+	}
+
+	switch cfg.CacheStore {
+	case storePostgres:
+		if cfg.PostgresDSN == "" {
+			required("PostgresHost", cfg.PostgresHost)
+			required("PostgresUser", cfg.PostgresUser)
+			required("PostgresPass", cfg.PostgresPass)
+			required("PostgresDatabase", cfg.PostgresDatabase)
+
+			if cfg.PostgresPort <= 0 || cfg.PostgresPort > 65535 {
+				problems = append(problems, fmt.Sprintf("PostgresPort must be between 1 and 65535 (is %d)", cfg.PostgresPort))
+			}
+		}
+
+		switch cfg.PostgresSSLMode {
+		case "", "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+		default:
+			problems = append(problems, fmt.Sprintf("PostgresSSLMode must be one of disable, allow, prefer, require, verify-ca or verify-full (is [%s])", cfg.PostgresSSLMode))
+		}
+
+		if cfg.PostgresSSLCA != "" {
+			if _, err := os.Stat(cfg.PostgresSSLCA); err != nil {
+				problems = append(problems, fmt.Sprintf("PostgresSSLCA: %s", err.Error()))
+			}
+		}
+
+		if cfg.PostgresTimeout < 0 || cfg.PostgresMaxOpen < 0 || cfg.PostgresMaxIdle < 0 || cfg.PostgresLifetime < 0 {
+			problems = append(problems, "PostgresTimeout, PostgresMaxOpen, PostgresMaxIdle and PostgresLifetime cannot be negative")
+		}
+
+		if cfg.PostgresMaxOpen > 0 && cfg.PostgresMaxIdle > cfg.PostgresMaxOpen {
+			problems = append(problems, fmt.Sprintf("PostgresMaxIdle (%d) cannot be more than PostgresMaxOpen (%d)", cfg.PostgresMaxIdle, cfg.PostgresMaxOpen))
+		}
+
+	case storeSqlite:
+		required("SqlitePath", cfg.SqlitePath)
+
+	default:
+		problems = append(problems, fmt.Sprintf("CacheStore must be %s or %s (is [%s])", storePostgres, storeSqlite, cfg.CacheStore))
+	}
+
+	if validTableName.MatchString(cfg.PostgresTable) == false {
+		problems = append(problems, fmt.Sprintf("PostgresTable must be a lower case SQL identifier (is [%s])", cfg.PostgresTable))
+	}
+
+	if _, err := newPayloadCodec(*cfg); err != nil {
+		problems = append(problems, fmt.Sprintf("PayloadCodec must be %s, %s or %s (is [%s])", codecNone, codecGzip, codecZstd, cfg.PayloadCodec))
+	}
+
+	if cfg.PayloadCompressMin < 0 {
+		problems = append(problems, fmt.Sprintf("PayloadCompressMin cannot be negative (is %d)", cfg.PayloadCompressMin))
+	}
+
+	if cfg.OffloadThreshold < 0 {
+		problems = append(problems, fmt.Sprintf("OffloadThreshold cannot be negative (is %d)", cfg.OffloadThreshold))
+	}
+
+	if cfg.OffloadThreshold > 0 && cfg.OffloadLocation == "" {
+		problems = append(problems, "OffloadLocation is required when OffloadThreshold is set")
+	}
+
+	if cfg.OffloadLocation != "" {
+		if _, err := NewObjectStore(cfg.OffloadLocation); err != nil {
+			problems = append(problems, fmt.Sprintf("OffloadLocation: %s", err.Error()))
+		}
+	}
+
+	if _, err := parseRoutes(cfg.PostgresRoutes, cfg.PostgresTable); err != nil {
+		problems = append(problems, fmt.Sprintf("PostgresRoutes: %s", err.Error()))
+	}
+
+	if cfg.SecretsCacheTime < 0 {
+		problems = append(problems, fmt.Sprintf("SecretsCacheTime cannot be negative (is %d)", cfg.SecretsCacheTime))
+	}
+
+	// secret files should be there now; Secrets Manager secrets are only checked when they are used
+	for _, item := range configItems(cfg) {
+		value := item.value.String()
+		if item.secret == true && strings.HasPrefix(value, "file://") {
+			if _, err := os.Stat(strings.TrimPrefix(value, "file://")); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", item.name, err.Error()))
+			}
+		}
+	}
+
+	return problems
+}
+
+// validate reports all problems with the configuration
+func (cfg *ServiceConfig) validate() []string {
+	var problems []string
+
+	positive := func(name string, value int) {
+		if value <= 0 {
+			problems = append(problems, fmt.Sprintf("%s must be greater than 0 (is %d)", name, value))
+		}
+	}
+
+	switch cfg.InputMode {
+	case inputSqs:
+		names := parseQueueNames(cfg.InQueueName)
+		if len(names) == 0 {
+			problems = append(problems, "InQueueName is required")
+		}
+		if _, err := parseQueueWeights(cfg.InQueueWeights, len(names)); err != nil {
+			problems = append(problems, fmt.Sprintf("InQueueWeights: %s", err.Error()))
+		}
+		if cfg.MessageBucketName == "" {
+			problems = append(problems, "MessageBucketName is required")
+		}
+
+	case inputFile:
+		if cfg.InputPath == "" {
+			problems = append(problems, "InputPath is required")
+		}
+
+	default:
+		problems = append(problems, fmt.Sprintf("InputMode must be %s or %s (is [%s])", inputSqs, inputFile, cfg.InputMode))
+	}
+
+	if cfg.PollTimeOut < 0 || cfg.PollTimeOut > int64(awssqs.MAX_SQS_WAIT_TIME) {
+		problems = append(problems, fmt.Sprintf("PollTimeOut must be between 0 and %d (is %d)", awssqs.MAX_SQS_WAIT_TIME, cfg.PollTimeOut))
+	}
+
+	positive("Workers", cfg.Workers)
+	positive("WorkerQueueSize", cfg.WorkerQueueSize)
+
+	if cfg.WorkersMin < 0 || (cfg.WorkersMin > 0 && cfg.WorkersMin > cfg.Workers) {
+		problems = append(problems, fmt.Sprintf("WorkersMin must be between 1 and Workers (is %d)", cfg.WorkersMin))
+	}
+
+	if cfg.WorkersMax < 0 || (cfg.WorkersMax > 0 && cfg.WorkersMax < cfg.Workers) {
+		problems = append(problems, fmt.Sprintf("WorkersMax cannot be less than Workers (is %d)", cfg.WorkersMax))
+	}
+	positive("WorkerFlushTime", cfg.WorkerFlushTime)
+	positive("Deleters", cfg.Deleters)
+	positive("DeleteQueueSize", cfg.DeleteQueueSize)
+
+	if cfg.DeleteRetries < 0 || cfg.DeleteRetryWait < 0 {
+		problems = append(problems, "DeleteRetries and DeleteRetryWait cannot be negative")
+	}
+
+	if cfg.FlowLowWater <= 0 || cfg.FlowLowWater >= cfg.FlowHighWater || cfg.FlowHighWater > 100 {
+		problems = append(problems, fmt.Sprintf("FlowLowWater (%d) and FlowHighWater (%d) must be percentages with low below high", cfg.FlowLowWater, cfg.FlowHighWater))
+	}
+
+	if cfg.FlowMaxFlushTime < 0 {
+		problems = append(problems, fmt.Sprintf("FlowMaxFlushTime cannot be negative (is %d)", cfg.FlowMaxFlushTime))
+	}
+
+	if cfg.VisibilityTimeout < 0 || cfg.VisibilityTimeout > maxVisibilityTimeout {
+		problems = append(problems, fmt.Sprintf("VisibilityTimeout must be between 0 and %d (is %d)", maxVisibilityTimeout, cfg.VisibilityTimeout))
+	}
+
+	if cfg.PostgresBatchSize <= 0 || cfg.PostgresBatchSize > maxBatchSize {
+		problems = append(problems, fmt.Sprintf("PostgresBatchSize must be between 1 and %d (is %d)", maxBatchSize, cfg.PostgresBatchSize))
+	}
+
+	if _, err := newValidationRegistry(*cfg); err != nil {
+		problems = append(problems, fmt.Sprintf("ValidateActions/ValidateSchemas: %s", err.Error()))
+	}
+
+	if _, err := newSourceLimiter(*cfg); err != nil {
+		problems = append(problems, fmt.Sprintf("RateLimits: %s", err.Error()))
+	}
+
+	if _, err := newTTLPolicy(*cfg); err != nil {
+		problems = append(problems, fmt.Sprintf("RecordTTLs: %s", err.Error()))
+	}
+
+	if cfg.HistoryVersions < 0 {
+		problems = append(problems, fmt.Sprintf("HistoryVersions must not be negative (is %d)", cfg.HistoryVersions))
+	}
+
+	if cfg.ReapInterval < 0 {
+		problems = append(problems, fmt.Sprintf("ReapInterval must not be negative (is %d)", cfg.ReapInterval))
+	}
+
+	return append(problems, cfg.validateStore()...)
+}
+
+// redacted returns a copy of the configuration with the secrets removed; secret references are
+// left alone, they only say where to find the secret
+func (cfg ServiceConfig) redacted() ServiceConfig {
+	for _, item := range configItems(&cfg) {
+		if item.secret == true && item.value.String() != "" && isSecretReference(item.value.String()) == false {
+			item.value.Set(redacted)
+		}
+	}
+
+	return cfg
+}
+
+// logConfiguration shows the effective configuration, with the secrets redacted
+func logConfiguration(cfg ServiceConfig) {
+	safe := cfg.redacted()
+
+	for _, item := range configItems(&safe) {
+		log.Printf("[CONFIG] %-20s = [%s]", item.name, item.value.String())
+	}
+}
+
+// configYAML renders the configuration as a config file, with the secrets redacted
+func configYAML(cfg ServiceConfig) ([]byte, error) {
+	safe := cfg.redacted()
+
+	doc := yaml.Node{Kind: yaml.MappingNode}
+
+	for _, item := range configItems(&safe) {
+		doc.Content = append(doc.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: item.key()},
+			&yaml.Node{Kind: yaml.ScalarNode, Value: item.value.String()})
+	}
+
+	return yaml.Marshal(&doc)
+}
+
+func fatalProblems(problems []string) {
+	for _, p := range problems {
+		log.Printf("[CONFIG] ERROR: %s", p)
+	}
+
+	log.Printf("FATAL: %d configuration problem(s)", len(problems))
+	os.Exit(1)
+}
+
+// LoadConfiguration will load the service configuration from file/env/cmdline
+// and return a pointer to it. Any failures are fatal, and all problems are reported.
+func LoadConfiguration(args []string) *ServiceConfig {
 
 	log.Printf("Loading configuration...")
 
-	var cfg ServiceConfig
-
-	cfg.InQueueName = ensureSetAndNonEmpty("VIRGO4_SOURCE_CACHE_IN_QUEUE")
-	cfg.MessageBucketName = ensureSetAndNonEmpty("VIRGO4_SQS_MESSAGE_BUCKET")
-	cfg.PollTimeOut = int64(envToInt("VIRGO4_SOURCE_CACHE_POLL_TIMEOUT"))
-	cfg.Workers = envToInt("VIRGO4_SOURCE_CACHE_WORKERS")
-	cfg.WorkerQueueSize = envToInt("VIRGO4_SOURCE_CACHE_WORKER_QUEUE_SIZE")
-	cfg.WorkerFlushTime = envToInt("VIRGO4_SOURCE_CACHE_WORKER_FLUSH_TIME")
-	cfg.Deleters = envToInt("VIRGO4_SOURCE_CACHE_DELETERS")
-	cfg.DeleteQueueSize = envToInt("VIRGO4_SOURCE_CACHE_DELETE_QUEUE_SIZE")
-	cfg.PostgresHost = ensureSetAndNonEmpty("VIRGO4_SOURCE_CACHE_POSTGRES_HOST")
-	cfg.PostgresPort = envToInt("VIRGO4_SOURCE_CACHE_POSTGRES_PORT")
-	cfg.PostgresUser = ensureSetAndNonEmpty("VIRGO4_SOURCE_CACHE_POSTGRES_USER")
-	cfg.PostgresPass = ensureSetAndNonEmpty("VIRGO4_SOURCE_CACHE_POSTGRES_PASS")
-	cfg.PostgresDatabase = ensureSetAndNonEmpty("VIRGO4_SOURCE_CACHE_POSTGRES_DATABASE")
-	cfg.PostgresTable = ensureSetAndNonEmpty("VIRGO4_SOURCE_CACHE_POSTGRES_TABLE")
-	cfg.PostgresBatchSize = envToInt("VIRGO4_SOURCE_CACHE_POSTGRES_BATCH_SIZE")
-
-	log.Printf("[CONFIG] InQueueName       = [%s]", cfg.InQueueName)
-	log.Printf("[CONFIG] MessageBucketName = [%s]", cfg.MessageBucketName)
-	log.Printf("[CONFIG] PollTimeOut       = [%d]", cfg.PollTimeOut)
-	log.Printf("[CONFIG] Workers           = [%d]", cfg.Workers)
-	log.Printf("[CONFIG] WorkerQueueSize   = [%d]", cfg.WorkerQueueSize)
-	log.Printf("[CONFIG] WorkerFlushTime   = [%d]", cfg.WorkerFlushTime)
-	log.Printf("[CONFIG] Deleters          = [%d]", cfg.Deleters)
-	log.Printf("[CONFIG] DeleteQueueSize   = [%d]", cfg.DeleteQueueSize)
-	log.Printf("[CONFIG] PostgresHost      = [%s]", cfg.PostgresHost)
-	log.Printf("[CONFIG] PostgresPort      = [%d]", cfg.PostgresPort)
-	log.Printf("[CONFIG] PostgresUser      = [%s]", cfg.PostgresUser)
-	log.Printf("[CONFIG] PostgresPass      = [REDACTED]")
-	log.Printf("[CONFIG] PostgresDatabase  = [%s]", cfg.PostgresDatabase)
-	log.Printf("[CONFIG] PostgresTable     = [%s]", cfg.PostgresTable)
-	log.Printf("[CONFIG] PostgresBatchSize = [%d]", cfg.PostgresBatchSize)
-
-	return &cfg
+	cfg, err := loadConfiguration("serve", args)
+	if err != nil {
+		log.Fatalf("FATAL: %s", err.Error())
+	}
+
+	logConfiguration(*cfg)
+
+	if problems := cfg.validate(); len(problems) > 0 {
+		fatalProblems(problems)
+	}
+
+	return cfg
+}
+
+// loadStoreConfiguration loads the configuration for commands that only need the storage backend,
+// from the optional config file. Any failures are fatal.
+func loadStoreConfiguration(configFile string) *ServiceConfig {
+	var args []string
+	if configFile != "" {
+		args = []string{"-" + configFileFlag, configFile}
+	}
+
+	return loadStoreCommandConfiguration("store", args)
+}
+
+// loadStoreCommandConfiguration loads the configuration for commands that only need the storage backend,
+// accepting the full set of configuration flags. Any failures are fatal.
+func loadStoreCommandConfiguration(name string, args []string) *ServiceConfig {
+	cfg, err := loadConfiguration(name, args)
+	if err != nil {
+		log.Fatalf("FATAL: %s", err.Error())
+	}
+
+	if problems := cfg.validateStore(); len(problems) > 0 {
+		fatalProblems(problems)
+	}
+
+	return cfg
+}
+
+// configCommand implements the config subcommand
+func configCommand(args []string) {
+	if len(args) == 0 || args[0] != "print" {
+		log.Fatalf("FATAL: usage: config print [flags]")
+	}
+
+	cfg, err := loadConfiguration("config print", args[1:])
+	if err != nil {
+		log.Fatalf("FATAL: %s", err.Error())
+	}
+
+	out, err := configYAML(*cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	os.Stdout.Write(out)
+
+	// report any problems, but still show what we have
+	problems := cfg.validate()
+	for _, p := range problems {
+		fmt.Fprintf(os.Stderr, "# ERROR: %s\n", p)
+	}
+
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+func envWithDefault(env string, defaultValue string) string {
+	val, set := os.LookupEnv(env)
+
+	if set == false || val == "" {
+		return defaultValue
+	}
+
+	return val
 }
 
 //
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigurationPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yml")
+	contents := "workers: 8\ndeleters: 3\npostgres_host: file.example\n"
+	if err := os.WriteFile(file, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("VIRGO4_SOURCE_CACHE_DELETERS", "5")
+	t.Setenv("VIRGO4_SOURCE_CACHE_POSTGRES_HOST", "env.example")
+
+	cfg, err := loadConfiguration("test", []string{"-config", file, "-postgres-host", "flag.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// default < file < env < flag
+	if cfg.WorkerQueueSize != defaultConfiguration().WorkerQueueSize {
+		t.Errorf("WorkerQueueSize: expected the default, got %d", cfg.WorkerQueueSize)
+	}
+	if cfg.Workers != 8 {
+		t.Errorf("Workers: expected the file value 8, got %d", cfg.Workers)
+	}
+	if cfg.Deleters != 5 {
+		t.Errorf("Deleters: expected the env value 5, got %d", cfg.Deleters)
+	}
+	if cfg.PostgresHost != "flag.example" {
+		t.Errorf("PostgresHost: expected the flag value, got %s", cfg.PostgresHost)
+	}
+}
+
+func TestConfigurationValidation(t *testing.T) {
+	cfg := defaultConfiguration()
+	cfg.Workers = 0
+	cfg.PostgresBatchSize = maxBatchSize + 1
+	cfg.PostgresTable = "source_cache; drop table x"
+
+	problems := strings.Join(cfg.validate(), "\n")
+
+	// every problem is reported, not just the first
+	for _, expected := range []string{"InQueueName", "Workers", "PostgresBatchSize", "PostgresHost", "PostgresPass", "PostgresTable"} {
+		if strings.Contains(problems, expected) == false {
+			t.Errorf("expected a problem with %s in:\n%s", expected, problems)
+		}
+	}
+}
+
+func TestConfigurationRedacted(t *testing.T) {
+	cfg := defaultConfiguration()
+	cfg.PostgresPass = "hunter2"
+
+	out, err := configYAML(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(out), "hunter2") == true {
+		t.Errorf("secret not redacted:\n%s", out)
+	}
+
+	if cfg.PostgresPass != "hunter2" {
+		t.Errorf("redaction modified the original configuration")
+	}
+}
+
+//
+// end of file
+//
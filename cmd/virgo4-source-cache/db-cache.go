@@ -1,36 +1,65 @@
 package main
 
 import (
-	"fmt"
 	"log"
-
-	dbx "github.com/go-ozzo/ozzo-dbx"
-	_ "github.com/lib/pq"
 )
 
 type cacheService struct {
-	handle *dbx.DB
-	table  string
-	size   int
+	store           CacheStore
+	router          *cacheRouter
+	validators      *validationRegistry
+	quarantineTable string
+	normalize       bool
+	logDiffs        bool
+	flushTimes      *flushLatency
+	limits          *sourceLimiter
+	ttls            *ttlPolicy
+	expiryAttrs     bool // messages can say when their records expire
+	size            int
 }
 
 // NewDbCache - the factory
-func NewDbCache(id int, cfg ServiceConfig) *cacheService {
+func NewDbCache(id int, cfg ServiceConfig, secrets *secretResolver) *cacheService {
+
+	// connect to the storage backend
+	log.Printf("[main] creating %s cache store %d", cfg.CacheStore, id)
+
+	store, err := NewCacheStore(cfg, secrets)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	router, err := newCacheRouter(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// connect to database
-	log.Printf("[main] creating postgres connection %d", id)
+	validators, err := newValidationRegistry(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	connStr := fmt.Sprintf("user=%s password=%s dbname=%s host=%s port=%d connect_timeout=%d",
-		cfg.PostgresUser, cfg.PostgresPass, cfg.PostgresDatabase, cfg.PostgresHost, cfg.PostgresPort, 30)
+	limits, err := newSourceLimiter(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	db, err := dbx.MustOpen("postgres", connStr)
+	ttls, err := newTTLPolicy(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	return &cacheService{
-		handle: db,
-		table:  cfg.PostgresTable,
-		size:   cfg.PostgresBatchSize,
+		store:           store,
+		router:          router,
+		validators:      validators,
+		quarantineTable: cfg.PostgresTable + quarantineSuffix,
+		normalize:       cfg.NormalizeAttributes,
+		logDiffs:        cfg.LogDiffs,
+		flushTimes:      newFlushLatency(),
+		limits:          limits,
+		ttls:            ttls,
+		expiryAttrs:     cfg.ExpiryAttributes,
+		size:            cfg.PostgresBatchSize,
 	}
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+//
+// messages are cached and then deleted from the queue; a message whose delete fails is redelivered
+// once its visibility timeout expires and is cached again. the delivery tracker counts the deletes,
+// the retries and the failures, and notices messages coming back around
+//
+
+// a message first received longer ago than this has been received before; redelivery is not possible
+// sooner than the visibility timeout, which is much longer than any clock skew
+const redeliveryThreshold = 10 * time.Second
+
+// how long the identities of undeleted messages are remembered, waiting for them to come back
+const undeletedLifetime = time.Hour
+
+// deliveryCounts are the message delivery totals
+type deliveryCounts struct {
+	Deleted     int64 `json:"deleted"`
+	Retried     int64 `json:"delete_retries"` // deletes retried after failing
+	Undeleted   int64 `json:"undeleted"`      // deletes given up on; the message will be redelivered
+	Redelivered int64 `json:"redelivered"`    // received before, by us or by another consumer
+	Duplicates  int64 `json:"duplicates"`     // redelivered after we failed to delete them
+}
+
+func (c deliveryCounts) String() string {
+	return fmt.Sprintf("deleted %d, delete retries %d, undeleted %d, redelivered %d, duplicates %d",
+		c.Deleted, c.Retried, c.Undeleted, c.Redelivered, c.Duplicates)
+}
+
+// deliveryTracker accounts for what becomes of each message
+type deliveryTracker struct {
+	sync.Mutex
+	counts    deliveryCounts
+	undeleted map[string]time.Time // the identities of messages we failed to delete, and when
+}
+
+// newDeliveryTracker - the factory
+func newDeliveryTracker() *deliveryTracker {
+	return &deliveryTracker{undeleted: make(map[string]time.Time)}
+}
+
+// messageIdentity identifies a message across deliveries: the record id and when it was sent. empty
+// if the source doesn't say when messages were sent
+func messageIdentity(msg awssqs.Message) string {
+	if msg.FirstSent == 0 {
+		return ""
+	}
+
+	id, _ := msg.GetAttribute(awssqs.AttributeKeyRecordId)
+
+	return id + "@" + strconv.FormatUint(msg.FirstSent, 10)
+}
+
+// received notes messages just received from the source, counting those delivered before
+func (d *deliveryTracker) received(messages []awssqs.Message, now time.Time) {
+	d.Lock()
+	defer d.Unlock()
+
+	for _, msg := range messages {
+		if msg.FirstReceived == 0 {
+			continue
+		}
+
+		firstReceived := time.UnixMilli(int64(msg.FirstReceived))
+		if now.Sub(firstReceived) < redeliveryThreshold {
+			continue
+		}
+
+		d.counts.Redelivered++
+
+		identity := messageIdentity(msg)
+		if _, ok := d.undeleted[identity]; ok == true && identity != "" {
+			d.counts.Duplicates++
+			delete(d.undeleted, identity)
+		}
+	}
+}
+
+// deleted counts messages deleted from the source
+func (d *deliveryTracker) deleted(count int) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.counts.Deleted += int64(count)
+}
+
+// retried counts delete attempts repeated for failed messages
+func (d *deliveryTracker) retried(count int) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.counts.Retried += int64(count)
+}
+
+// undeletable notes messages that could not be deleted, so we recognise them when they are redelivered
+func (d *deliveryTracker) undeletable(messages []awssqs.Message, now time.Time) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.counts.Undeleted += int64(len(messages))
+
+	for identity, when := range d.undeleted {
+		if now.Sub(when) > undeletedLifetime {
+			delete(d.undeleted, identity)
+		}
+	}
+
+	for _, msg := range messages {
+		if identity := messageIdentity(msg); identity != "" {
+			d.undeleted[identity] = now
+		}
+	}
+}
+
+// totals returns the counts so far
+func (d *deliveryTracker) totals() deliveryCounts {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.counts
+}
+
+//
+// end of file
+//
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+func TestDeliveryTracking(t *testing.T) {
+	d := newDeliveryTracker()
+	now := time.Now()
+
+	msg := testMessage("r1", awssqs.AttributeValueRecordOperationUpdate, "<r/>")
+	msg.FirstSent = uint64(now.Add(-time.Minute).UnixMilli())
+
+	// first delivery
+	msg.FirstReceived = uint64(now.UnixMilli())
+	d.received([]awssqs.Message{msg}, now)
+	d.undeletable([]awssqs.Message{msg}, now)
+
+	// and again, after the visibility timeout
+	later := now.Add(time.Minute)
+	d.received([]awssqs.Message{msg}, later)
+
+	// a message someone else failed to delete
+	other := testMessage("r2", awssqs.AttributeValueRecordOperationUpdate, "<r/>")
+	other.FirstSent = msg.FirstSent
+	other.FirstReceived = msg.FirstReceived
+	d.received([]awssqs.Message{other}, later)
+
+	totals := d.totals()
+	if totals.Undeleted != 1 || totals.Redelivered != 2 || totals.Duplicates != 1 {
+		t.Fatalf("expected 1 undeleted, 2 redelivered and 1 duplicate, got %s", totals)
+	}
+}
+
+// flakySource fails each message's first delete
+type flakySource struct {
+	*memorySource
+	failed map[awssqs.ReceiptHandle]bool
+}
+
+func (f *flakySource) DeleteBatch(messages []awssqs.Message) ([]awssqs.OpStatus, error) {
+	var retry []awssqs.Message
+	for _, msg := range messages {
+		if f.failed[msg.ReceiptHandle] == true {
+			retry = append(retry, msg)
+		}
+		f.failed[msg.ReceiptHandle] = true
+	}
+
+	ops := make([]awssqs.OpStatus, len(messages))
+	if len(retry) == 0 {
+		return ops, awssqs.ErrOneOrMoreOperationsUnsuccessful
+	}
+
+	return f.memorySource.DeleteBatch(retry)
+}
+
+func TestDeleteRetry(t *testing.T) {
+	source := &flakySource{memorySource: newMemorySource(10), failed: make(map[awssqs.ReceiptHandle]bool)}
+	source.Put(testMessage("r1", awssqs.AttributeValueRecordOperationUpdate, "<r/>"))
+	source.Put(testMessage("r2", awssqs.AttributeValueRecordOperationUpdate, "<r/>"))
+
+	received, err := source.ReceiveBatch(10, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var messages []cacheMessage
+	for _, msg := range received {
+		messages = append(messages, cacheMessage{message: msg, received: time.Now()})
+	}
+
+	d := newDeliveryTracker()
+	cfg := ServiceConfig{DeleteRetries: 2, DeleteRetryWait: 1}
+
+	if err = blockDelete(1, cfg, source, d, messages); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(source.Deleted()); n != 2 {
+		t.Fatalf("expected both messages to be deleted, got %d", n)
+	}
+
+	if totals := d.totals(); totals.Deleted != 2 || totals.Retried != 2 || totals.Undeleted != 0 {
+		t.Fatalf("expected 2 deleted after 2 retries, got %s", totals)
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,620 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+//
+// diffs show what an update changes: the cached payload against an incoming one. xml and json
+// payloads are first laid out a line per element (or value) in a canonical form, so that the diff shows
+// the fields that changed rather than reformatting; other payloads are compared line by line. with
+// HistoryVersions the cache also keeps earlier versions of each record, numbered back from the cached
+// one (1 is the version it replaced), and the cached record can be compared with any of them
+//
+
+// the diff formats
+const (
+	diffFormatXML  = "xml"
+	diffFormatJSON = "json"
+	diffFormatText = "text"
+)
+
+// lines of unchanged context shown around each change
+const diffContext = 3
+
+// the comparison gives up on the lines it hasn't matched after this many steps, and shows them all as
+// changed. the diff takes O((N+M)D) time for N and M lines with D of them changed, and O(N+M) space
+const maxDiffSteps = 10000000
+
+// the ways a line can differ
+type diffOp int
+
+const (
+	diffEqual diffOp = iota
+	diffDelete
+	diffInsert
+)
+
+// diffLine is a line of the edit script
+type diffLine struct {
+	op   diffOp
+	text string
+	old  int // line number in the old payload (from 1), for equal and deleted lines
+	new  int // line number in the new payload (from 1), for equal and inserted lines
+}
+
+// payloadDiff is the difference between two payloads
+type payloadDiff struct {
+	Format  string `json:"format"`
+	Added   int    `json:"added"`
+	Removed int    `json:"removed"`
+	lines   []diffLine
+}
+
+// changed reports whether the payloads differ
+func (d payloadDiff) changed() bool {
+	return d.Added > 0 || d.Removed > 0
+}
+
+// diffFormat returns how payloads of the record type are compared
+func diffFormat(recordType string) string {
+	switch recordType {
+	case "xml":
+		return diffFormatXML
+	case "json":
+		return diffFormatJSON
+	}
+
+	return diffFormatText
+}
+
+// canonicalXML lays out an xml payload an element, text or comment per line, indented by depth,
+// with the attributes in name order
+func canonicalXML(payload []byte) ([]string, error) {
+	var lines []string
+
+	d := xml.NewDecoder(bytes.NewReader(payload))
+	depth := 0
+
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return lines, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		indent := strings.Repeat("  ", depth)
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			attrs := make([]string, 0, len(t.Attr))
+			for _, a := range t.Attr {
+				attrs = append(attrs, fmt.Sprintf(" %s=%q", xmlName(a.Name), a.Value))
+			}
+			sort.Strings(attrs)
+			lines = append(lines, fmt.Sprintf("%s<%s%s>", indent, xmlName(t.Name), strings.Join(attrs, "")))
+			depth++
+
+		case xml.EndElement:
+			depth--
+			lines = append(lines, fmt.Sprintf("%s</%s>", strings.Repeat("  ", depth), xmlName(t.Name)))
+
+		case xml.CharData:
+			for _, text := range strings.Split(string(t), "\n") {
+				if text = strings.TrimSpace(text); text != "" {
+					lines = append(lines, indent+text)
+				}
+			}
+
+		case xml.Comment:
+			lines = append(lines, fmt.Sprintf("%s<!--%s-->", indent, t))
+
+		case xml.ProcInst:
+			lines = append(lines, fmt.Sprintf("%s<?%s %s?>", indent, t.Target, t.Inst))
+		}
+	}
+}
+
+// xmlName formats a (possibly namespaced) name
+func xmlName(n xml.Name) string {
+	if n.Space == "" {
+		return n.Local
+	}
+
+	return n.Space + ":" + n.Local
+}
+
+// canonicalJSON lays out a json payload indented, with object keys in order
+func canonicalJSON(payload []byte) ([]string, error) {
+	d := json.NewDecoder(bytes.NewReader(payload))
+	d.UseNumber()
+
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Split(string(out), "\n"), nil
+}
+
+// textLines splits a payload into lines
+func textLines(payload []byte) []string {
+	if len(payload) == 0 {
+		return nil
+	}
+
+	return strings.Split(strings.TrimSuffix(string(payload), "\n"), "\n")
+}
+
+// payloadLines lays out a payload for comparison, falling back to text if it doesn't parse
+func payloadLines(format string, payload []byte) ([]string, string) {
+	var lines []string
+	var err error
+
+	// nothing (a new or deleted record) is the same in any format
+	if len(payload) == 0 {
+		return nil, format
+	}
+
+	switch format {
+	case diffFormatXML:
+		lines, err = canonicalXML(payload)
+	case diffFormatJSON:
+		lines, err = canonicalJSON(payload)
+	default:
+		return textLines(payload), diffFormatText
+	}
+
+	if err != nil {
+		return textLines(payload), diffFormatText
+	}
+
+	return lines, format
+}
+
+// myersDiff builds an edit script by Myers' linear space algorithm: find the middle snake of the
+// shortest edit path, then the paths either side of it
+type myersDiff struct {
+	script []diffLine
+	steps  int // left before giving up
+}
+
+// diffLines returns the edit script turning a into b
+func diffLines(a []string, b []string) []diffLine {
+	m := myersDiff{steps: maxDiffSteps}
+	m.compare(a, b, 0, 0)
+
+	return m.script
+}
+
+// compare appends the edit script turning a into b; they start at lines i+1 and j+1 of the payloads
+func (m *myersDiff) compare(a []string, b []string, i int, j int) {
+	// the common prefix and suffix need no search
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	m.equal(a[:prefix], i, j)
+
+	ma := a[prefix : len(a)-suffix]
+	mb := b[prefix : len(b)-suffix]
+	mi, mj := i+prefix, j+prefix
+
+	switch {
+	case len(ma) == 0 || len(mb) == 0:
+		m.replace(ma, mb, mi, mj)
+
+	default:
+		x, y, u, v, ok := m.middleSnake(ma, mb)
+		if ok == false {
+			// too far apart to compare line by line; everything in between changed
+			m.replace(ma, mb, mi, mj)
+			break
+		}
+
+		m.compare(ma[:x], mb[:y], mi, mj)
+		m.equal(ma[x:u], mi+x, mj+y)
+		m.compare(ma[u:], mb[v:], mi+u, mj+v)
+	}
+
+	m.equal(a[len(a)-suffix:], i+len(a)-suffix, j+len(b)-suffix)
+}
+
+// equal appends lines common to both payloads
+func (m *myersDiff) equal(lines []string, i int, j int) {
+	for k, text := range lines {
+		m.script = append(m.script, diffLine{op: diffEqual, text: text, old: i + k + 1, new: j + k + 1})
+	}
+}
+
+// replace appends lines deleted from a and inserted from b
+func (m *myersDiff) replace(a []string, b []string, i int, j int) {
+	for k, text := range a {
+		m.script = append(m.script, diffLine{op: diffDelete, text: text, old: i + k + 1})
+	}
+	for k, text := range b {
+		m.script = append(m.script, diffLine{op: diffInsert, text: text, new: j + k + 1})
+	}
+}
+
+// middleSnake finds the run of equal lines (a[x:u] and b[y:v]) in the middle of a shortest edit path,
+// searching forward from the start and backward from the end until the paths meet. a and b differ in
+// their first and last lines. ok is false if the search runs out of steps
+func (m *myersDiff) middleSnake(a []string, b []string) (x int, y int, u int, v int, ok bool) {
+	n, mm := len(a), len(b)
+	delta := n - mm
+	odd := delta%2 != 0
+	limit := (n + mm + 1) / 2
+
+	// forward[k] is the furthest x reached on diagonal k (x - y = k) from the start; backward[k] the
+	// furthest reached from the end, counting back, on diagonal k of the reversed payloads
+	offset := limit + 1
+	forward := make([]int, 2*offset+1)
+	backward := make([]int, 2*offset+1)
+
+	for d := 0; d <= limit; d++ {
+		m.steps -= 2*d + 1
+		if m.steps < 0 {
+			return 0, 0, 0, 0, false
+		}
+
+		for k := -d; k <= d; k += 2 {
+			if k == -d || (k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+			y = x - k
+
+			u, v = x, y
+			for u < n && v < mm && a[u] == b[v] {
+				u++
+				v++
+			}
+			forward[offset+k] = u
+
+			// the backward paths on this diagonal are those of d-1 steps
+			if kb := delta - k; odd == true && kb >= -(d-1) && kb <= d-1 && u+backward[offset+kb] >= n {
+				return x, y, u, v, true
+			}
+		}
+
+		for kb := -d; kb <= d; kb += 2 {
+			var xb int
+			if kb == -d || (kb != d && backward[offset+kb-1] < backward[offset+kb+1]) {
+				xb = backward[offset+kb+1]
+			} else {
+				xb = backward[offset+kb-1] + 1
+			}
+			yb := xb - kb
+
+			ub, vb := xb, yb
+			for ub < n && vb < mm && a[n-1-ub] == b[mm-1-vb] {
+				ub++
+				vb++
+			}
+			backward[offset+kb] = ub
+
+			if k := delta - kb; odd == false && k >= -d && k <= d && forward[offset+k]+ub >= n {
+				return n - ub, mm - vb, n - xb, mm - yb, true
+			}
+		}
+	}
+
+	// should never get here
+	return 0, 0, n, mm, false
+}
+
+// diffPayloads compares the cached payload of a record of the type with a new one
+func diffPayloads(recordType string, oldPayload []byte, newPayload []byte) payloadDiff {
+	format := diffFormat(recordType)
+
+	a, formatA := payloadLines(format, oldPayload)
+	b, formatB := payloadLines(format, newPayload)
+
+	// if either doesn't parse, compare both as text
+	if formatA != formatB {
+		a, b = textLines(oldPayload), textLines(newPayload)
+		formatA = diffFormatText
+	}
+
+	d := payloadDiff{Format: formatA, lines: diffLines(a, b)}
+
+	for _, l := range d.lines {
+		switch l.op {
+		case diffDelete:
+			d.Removed++
+		case diffInsert:
+			d.Added++
+		}
+	}
+
+	return d
+}
+
+// unified renders the diff in the unified style, with diffContext lines around each change
+func (d payloadDiff) unified() string {
+	var out strings.Builder
+
+	n := len(d.lines)
+
+	for start := 0; start < n; {
+		// find the next change
+		for start < n && d.lines[start].op == diffEqual {
+			start++
+		}
+		if start == n {
+			break
+		}
+
+		// the hunk takes in the changes that follow within 2*diffContext lines
+		end := start + 1
+		for {
+			next := end
+			for next < n && d.lines[next].op == diffEqual {
+				next++
+			}
+			if next == n || next-end > 2*diffContext {
+				break
+			}
+			end = next + 1
+		}
+
+		from := max(start-diffContext, 0)
+		to := min(end+diffContext, n)
+
+		fmt.Fprintf(&out, "@@ -%d +%d @@\n", firstLine(d.lines[from:to], true), firstLine(d.lines[from:to], false))
+		for _, l := range d.lines[from:to] {
+			switch l.op {
+			case diffEqual:
+				out.WriteString(" " + l.text + "\n")
+			case diffDelete:
+				out.WriteString("-" + l.text + "\n")
+			case diffInsert:
+				out.WriteString("+" + l.text + "\n")
+			}
+		}
+
+		start = to
+	}
+
+	return out.String()
+}
+
+// firstLine returns the first old (or new) line number in a run of lines
+func firstLine(lines []diffLine, old bool) int {
+	for _, l := range lines {
+		if old == true && l.old > 0 {
+			return l.old
+		}
+		if old == false && l.new > 0 {
+			return l.new
+		}
+	}
+
+	return 0
+}
+
+// recordDiff is the difference an incoming message would make to the cached record
+type recordDiff struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Source  string `json:"source"`
+	Version int    `json:"version,omitempty"` // the earlier version compared with the cached record
+	New     bool   `json:"new"`               // there is no cached record
+	Deleted bool   `json:"deleted"`
+	payloadDiff
+	Diff string `json:"diff"`
+}
+
+// diffMessage compares an incoming message with the cached record it would replace
+func diffMessage(store CacheStore, msg awssqs.Message, normalize bool) (recordDiff, error) {
+	attrs, err := parseAttributes(msg, normalize, false)
+	if err != nil {
+		return recordDiff{}, err
+	}
+
+	rd := recordDiff{ID: attrs.id, Type: attrs.recordType, Source: attrs.source}
+
+	var old []byte
+	rec, err := store.Get(attrs.id)
+	switch {
+	case err == errRecordNotFound:
+		rd.New = true
+	case err != nil:
+		return rd, err
+	default:
+		old = rec.Payload
+		if rd.Type == "" {
+			rd.Type = rec.Type
+		}
+	}
+
+	var payload []byte
+	if attrs.operation == awssqs.AttributeValueRecordOperationDelete {
+		rd.Deleted = true
+	} else {
+		payload = msg.Payload
+	}
+
+	rd.payloadDiff = diffPayloads(rd.Type, old, payload)
+	rd.Diff = rd.payloadDiff.unified()
+
+	return rd, nil
+}
+
+// diffVersion compares an earlier version of a record with the cached record (or nothing, if the record
+// has since been deleted)
+func diffVersion(store CacheStore, id string, version int) (recordDiff, error) {
+	rd := recordDiff{ID: id, Version: version}
+
+	versions, err := store.History(id)
+	if err != nil {
+		return rd, err
+	}
+
+	if version < 1 || version > len(versions) {
+		return rd, fmt.Errorf("record %s has %d earlier version(s) (asked for %d)", id, len(versions), version)
+	}
+
+	old := versions[version-1]
+	rd.Type, rd.Source = old.Type, old.Source
+
+	var payload []byte
+	rec, err := store.Get(id)
+	switch {
+	case err == errRecordNotFound:
+		rd.Deleted = true
+	case err != nil:
+		return rd, err
+	default:
+		payload = rec.Payload
+		rd.Type, rd.Source = rec.Type, rec.Source
+	}
+
+	rd.payloadDiff = diffPayloads(rd.Type, old.Payload, payload)
+	rd.Diff = rd.payloadDiff.unified()
+
+	return rd, nil
+}
+
+// printDiff shows a diff as json or in the unified style, with a summary line
+func printDiff(rd recordDiff, asJSON bool) {
+	if asJSON == true {
+		out, _ := json.Marshal(rd)
+		fmt.Println(string(out))
+		return
+	}
+
+	status := ""
+	switch {
+	case rd.Version > 0:
+		status = fmt.Sprintf(" (since version -%d)", rd.Version)
+		if rd.Deleted == true {
+			status += " (deleted)"
+		}
+	case rd.New == true:
+		status = " (new)"
+	case rd.Deleted == true:
+		status = " (deleted)"
+	case rd.changed() == false:
+		status = " (unchanged)"
+	}
+
+	fmt.Fprintf(os.Stdout, "=== %s %s/%s: +%d -%d %s lines%s\n%s", rd.ID, rd.Source, rd.Type, rd.Added, rd.Removed, rd.Format, status, rd.Diff)
+}
+
+// diffCommand implements the diff subcommand
+func diffCommand(args []string) {
+	usage := "FATAL: usage: diff [-json] <message file | -> | -version <n> <id> [flags]"
+
+	asJSON := false
+	if len(args) > 0 && args[0] == "-json" {
+		asJSON = true
+		args = args[1:]
+	}
+
+	// a cached record against one of its earlier versions
+	if len(args) > 0 && args[0] == "-version" {
+		if len(args) < 3 {
+			log.Fatal(usage)
+		}
+
+		version, err := strconv.Atoi(args[1])
+		if err != nil || version < 1 {
+			log.Fatalf("FATAL: -version: expected a positive number (is [%s])", args[1])
+		}
+
+		id := args[2]
+		cfg := loadStoreCommandConfiguration("diff", args[3:])
+
+		store, err := NewCacheStore(*cfg, newConfiguredSecretResolver(*cfg))
+		if err != nil {
+			log.Fatalf("FATAL: %s", err.Error())
+		}
+		defer store.Close()
+
+		rd, err := diffVersion(store, id, version)
+		if err != nil {
+			log.Fatalf("FATAL: %s", err.Error())
+		}
+
+		printDiff(rd, asJSON)
+		return
+	}
+
+	if len(args) == 0 || (strings.HasPrefix(args[0], "-") == true && args[0] != "-") {
+		log.Fatal(usage)
+	}
+
+	input := args[0]
+	args = args[1:]
+
+	cfg := loadStoreCommandConfiguration("diff", args)
+
+	// the messages are read just as the service reads them in file mode
+	fileCfg := *cfg
+	fileCfg.InputPath = input
+	fileCfg.InputWatch = false
+
+	source, err := newFileSource(fileCfg)
+	if err != nil {
+		log.Fatalf("FATAL: %s", err.Error())
+	}
+
+	store, err := NewCacheStore(*cfg, newConfiguredSecretResolver(*cfg))
+	if err != nil {
+		log.Fatalf("FATAL: %s", err.Error())
+	}
+	defer store.Close()
+
+	for {
+		messages, err := source.ReceiveBatch(awssqs.MAX_SQS_BLOCK_COUNT, 0)
+		if err == io.EOF {
+			return
+		}
+
+		if err != nil {
+			log.Fatalf("FATAL: %s", err.Error())
+		}
+
+		for _, msg := range messages {
+			rd, err := diffMessage(store, msg, cfg.NormalizeAttributes)
+			if err != nil {
+				log.Printf("[diff] WARNING: %s", err.Error())
+				continue
+			}
+
+			printDiff(rd, asJSON)
+		}
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestDiffXML(t *testing.T) {
+	old := `<record id="1"><title>Old title</title><author>Someone</author></record>`
+	updated := "<record  id='1'>\n  <title>New title</title>\n  <author>Someone</author>\n</record>\n"
+
+	// reformatting isn't a change; the title is
+	d := diffPayloads("xml", []byte(old), []byte(updated))
+	if d.Format != diffFormatXML || d.Added != 1 || d.Removed != 1 {
+		t.Fatalf("expected a one line xml change, got %s +%d -%d:\n%s", d.Format, d.Added, d.Removed, d.unified())
+	}
+
+	if out := d.unified(); strings.Contains(out, "-    Old title\n+    New title\n") == false {
+		t.Errorf("expected the title change in the diff, got:\n%s", out)
+	}
+}
+
+func TestDiffJSON(t *testing.T) {
+	d := diffPayloads("json", []byte(`{"b": 2, "a": 1}`), []byte(`{"a":1,"b":2}`))
+	if d.changed() == true {
+		t.Errorf("expected reordered keys to be unchanged, got:\n%s", d.unified())
+	}
+
+	// a payload that doesn't parse is compared as text
+	d = diffPayloads("json", []byte(`{"a":1}`), []byte(`{"a":`))
+	if d.Format != diffFormatText || d.Added != 1 || d.Removed != 1 {
+		t.Errorf("expected a text diff, got %s +%d -%d", d.Format, d.Added, d.Removed)
+	}
+}
+
+func TestDiffHunks(t *testing.T) {
+	var old, updated []string
+	for ix := 0; ix < 20; ix++ {
+		old = append(old, string(rune('a'+ix)))
+	}
+	updated = append(updated, old...)
+	updated[1] = "changed"
+	updated[15] = "changed"
+
+	d := diffPayloads("text", []byte(strings.Join(old, "\n")), []byte(strings.Join(updated, "\n")))
+
+	// the changes are far enough apart for a hunk each
+	if hunks := strings.Count(d.unified(), "@@ -"); hunks != 2 || d.Added != 2 || d.Removed != 2 {
+		t.Fatalf("expected 2 hunks of one line each, got:\n%s", d.unified())
+	}
+
+	if strings.HasPrefix(d.unified(), "@@ -1 +1 @@\n a\n-b\n+changed\n c\n") == false {
+		t.Errorf("unexpected first hunk:\n%s", d.unified())
+	}
+}
+
+// lcsLength is the length of the longest common subsequence, the slow way
+func lcsLength(a []string, b []string) int {
+	row := make([]int, len(b)+1)
+	for i := len(a) - 1; i >= 0; i-- {
+		diagonal := 0
+		for j := len(b) - 1; j >= 0; j-- {
+			below := row[j]
+			if a[i] == b[j] {
+				row[j] = diagonal + 1
+			} else {
+				row[j] = max(row[j], row[j+1])
+			}
+			diagonal = below
+		}
+	}
+
+	return row[0]
+}
+
+func TestDiffLines(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	lines := func() []string {
+		l := make([]string, r.Intn(30))
+		for ix := range l {
+			l[ix] = string(rune('a' + r.Intn(4)))
+		}
+		return l
+	}
+
+	for run := 0; run < 1000; run++ {
+		a, b := lines(), lines()
+		script := diffLines(a, b)
+
+		// the script turns a into b, with as few changes as possible...
+		var oldLines, newLines []string
+		changes := 0
+		for _, l := range script {
+			if l.op != diffInsert {
+				if a[l.old-1] != l.text {
+					t.Fatalf("%v to %v: line %d is not %s", a, b, l.old, l.text)
+				}
+				oldLines = append(oldLines, l.text)
+			}
+			if l.op != diffDelete {
+				if b[l.new-1] != l.text {
+					t.Fatalf("%v to %v: new line %d is not %s", a, b, l.new, l.text)
+				}
+				newLines = append(newLines, l.text)
+			}
+			if l.op != diffEqual {
+				changes++
+			}
+		}
+
+		if strings.Join(oldLines, "") != strings.Join(a, "") || strings.Join(newLines, "") != strings.Join(b, "") {
+			t.Fatalf("%v to %v: the script gives %v to %v", a, b, oldLines, newLines)
+		}
+
+		if expected := len(a) + len(b) - 2*lcsLength(a, b); changes != expected {
+			t.Fatalf("%v to %v: expected %d changes, got %d", a, b, expected, changes)
+		}
+	}
+
+	// ...and gives up on payloads too far apart, rather than taking forever
+	var x, y []string
+	for ix := 0; ix < 20000; ix++ {
+		x = append(x, "x")
+		y = append(y, "y")
+	}
+	if script := diffLines(x, y); len(script) != 40000 {
+		t.Fatalf("expected every line to change, got %d lines", len(script))
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// records can be given a lifetime, for sources (temporary holdings, test feeds) that shouldn't stay in
+// the cache forever. RecordTTLs is a comma separated list of key=ttl, the keys as for PostgresRoutes;
+// the most specific matching key wins. with ExpiryAttributes a message can instead carry its own expiry
+// time in the expires attribute. the expiry time is stored with the record; expired records are no
+// longer found, and the reaper deletes them in batches every ReapInterval seconds
+//
+
+// ttlPolicy gives the lifetime of records by source and type
+type ttlPolicy struct {
+	ttls map[string]time.Duration
+}
+
+// parseTTL parses a lifetime: a duration like 36h, or a number of days like 30d
+func parseTTL(value string) (time.Duration, error) {
+	var ttl time.Duration
+	var err error
+
+	if days, found := strings.CutSuffix(value, "d"); found == true {
+		var n int
+		if n, err = strconv.Atoi(days); err == nil {
+			ttl = time.Duration(n) * 24 * time.Hour
+		}
+	} else {
+		ttl, err = time.ParseDuration(value)
+	}
+
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("ttl must be a positive duration or number of days (is [%s])", value)
+	}
+
+	return ttl, nil
+}
+
+// newTTLPolicy - the factory. returns nil if no records expire by configuration
+func newTTLPolicy(cfg ServiceConfig) (*ttlPolicy, error) {
+	settings, err := parseTypeSettings(cfg.RecordTTLs)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(settings) == 0 {
+		return nil, nil
+	}
+
+	p := ttlPolicy{ttls: make(map[string]time.Duration)}
+
+	for key, value := range settings {
+		if err = checkRouteKey(key); err != nil {
+			return nil, err
+		}
+
+		if p.ttls[key], err = parseTTL(value); err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+
+	return &p, nil
+}
+
+// expires returns when a record with the source and type written now expires, or nil if it doesn't
+func (p *ttlPolicy) expires(source string, recordType string, now time.Time) *time.Time {
+	if p == nil {
+		return nil
+	}
+
+	for _, key := range routeKeys(source, recordType) {
+		if ttl, ok := p.ttls[key]; ok == true {
+			expires := now.Add(ttl).UTC()
+			return &expires
+		}
+	}
+
+	return nil
+}
+
+// reaper deletes expired records
+type reaper struct {
+	store     CacheStore
+	tables    []string
+	history   string // the history table, whose versions of the reaped records go too
+	payloads  *payloadStorage
+	chunkSize int
+	interval  time.Duration
+}
+
+// newReaper - the factory. returns nil if reaping is disabled, or no records can expire
+func newReaper(cfg ServiceConfig, store CacheStore) (*reaper, error) {
+	if cfg.ReapInterval == 0 || storeHandle(store) == nil {
+		return nil, nil
+	}
+
+	if cfg.RecordTTLs == "" && cfg.ExpiryAttributes == false {
+		return nil, nil
+	}
+
+	router, err := newCacheRouter(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	payloads, err := newPayloadStorage(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	r := reaper{
+		store:     store,
+		tables:    router.tables(),
+		history:   router.defaultTable + historySuffix,
+		payloads:  payloads,
+		chunkSize: cfg.PostgresBatchSize,
+		interval:  time.Duration(cfg.ReapInterval) * time.Second,
+	}
+
+	return &r, nil
+}
+
+// reap deletes the records that expired before now, returning how many
+func (r *reaper) reap(now time.Time) (int, error) {
+	reaped := 0
+
+	for _, table := range r.tables {
+		result, err := purgeTable(storeHandle(r.store), table, r.history, r.payloads, purgeFilter{expiredBy: now}, r.chunkSize, 0, nil)
+		reaped += result.deleted
+		if err != nil {
+			return reaped, fmt.Errorf("%s: %w", table, err)
+		}
+	}
+
+	return reaped, nil
+}
+
+// run reaps every interval until stop is closed
+func (r *reaper) run(stop <-chan struct{}) {
+	if r == nil {
+		return
+	}
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			reaped, err := r.reap(now)
+			if err != nil {
+				log.Printf("[reaper] ERROR: reaping expired records: %s", err.Error())
+			}
+			if reaped > 0 {
+				log.Printf("[reaper] deleted %d expired record(s)", reaped)
+			}
+		}
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTLPolicy(t *testing.T) {
+	p, err := newTTLPolicy(ServiceConfig{RecordTTLs: "temp=30d, temp/json=1h, */json=36h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+
+	for _, tc := range []struct {
+		source, recordType string
+		ttl                time.Duration
+	}{
+		{"temp", "xml", 30 * 24 * time.Hour},
+		{"temp", "json", time.Hour},
+		{"marc", "json", 36 * time.Hour},
+	} {
+		expires := p.expires(tc.source, tc.recordType, now)
+		if expires == nil || expires.Sub(now) != tc.ttl {
+			t.Errorf("%s/%s: expected to expire after %s, got %v", tc.source, tc.recordType, tc.ttl, expires)
+		}
+	}
+
+	if expires := p.expires("marc", "xml", now); expires != nil {
+		t.Errorf("expected marc/xml records not to expire, got %s", expires)
+	}
+
+	for _, bad := range []string{"temp=0d", "temp=forever", "*=1h", "temp/*=1h"} {
+		if _, err := newTTLPolicy(ServiceConfig{RecordTTLs: bad}); err == nil {
+			t.Errorf("expected ttl [%s] to be rejected", bad)
+		}
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// the file extensions picked up when reading a directory
+var fileSourceExtensions = []string{".json", ".jsonl"}
+
+// fileMessage is the on-disk representation of a message. files contain one or more of these,
+// either one per line (JSONL) or as consecutive JSON documents
+type fileMessage struct {
+	Attributes map[string]string `json:"attributes"`
+	Payload    string            `json:"payload"`
+}
+
+// message converts the file message to the message SQS would have delivered
+func (fm fileMessage) message() awssqs.Message {
+	msg := awssqs.Message{Payload: []byte(fm.Payload)}
+
+	// sorted for predictable attribute order
+	keys := make([]string, 0, len(fm.Attributes))
+	for k := range fm.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		msg.Attribs = append(msg.Attribs, awssqs.Attribute{Name: k, Value: fm.Attributes[k]})
+	}
+
+	return msg
+}
+
+// fileSource is a MessageSource that reads messages from a file, a directory of files or a
+// JSONL stream on stdin, for feeding records straight into the cache without SQS.  a directory
+// can optionally be watched for new files (which should be moved into place complete), otherwise
+// the source is exhausted (io.EOF) once everything has been read
+type fileSource struct {
+	path    string          // file, directory or "-" for stdin
+	watch   bool            // keep watching the directory for new files
+	seen    map[string]bool // files already queued for reading
+	pending []string        // files waiting to be read
+
+	current  *os.File      // the file being read
+	reader   *bufio.Reader // the reader the decoder reads from
+	decoder  *json.Decoder // the decoder for the file being read
+	name     string        // the name of the file being read
+	position int           // messages read from the current file
+	skipped  int           // malformed messages skipped in the current file
+	stdin    bool          // stdin has already been opened
+}
+
+// newFileSource - the factory
+func newFileSource(cfg ServiceConfig) (*fileSource, error) {
+	s := fileSource{
+		path:  cfg.InputPath,
+		watch: cfg.InputWatch,
+		seen:  make(map[string]bool),
+	}
+
+	if s.path != "-" {
+		info, err := os.Stat(s.path)
+		if err != nil {
+			return nil, err
+		}
+
+		if s.watch == true && info.IsDir() == false {
+			return nil, fmt.Errorf("input path must be a directory to be watched: [%s]", s.path)
+		}
+	}
+
+	if err := s.scan(); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// scan queues any input files not seen before, in name order
+func (s *fileSource) scan() error {
+	if s.path == "-" {
+		if s.stdin == false {
+			s.stdin = true
+			s.pending = append(s.pending, s.path)
+		}
+		return nil
+	}
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+
+	var files []string
+
+	if info.IsDir() == false {
+		files = []string{s.path}
+	} else {
+		entries, err := os.ReadDir(s.path)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			if e.IsDir() == true {
+				continue
+			}
+
+			for _, ext := range fileSourceExtensions {
+				if strings.HasSuffix(e.Name(), ext) {
+					files = append(files, filepath.Join(s.path, e.Name()))
+					break
+				}
+			}
+		}
+	}
+
+	sort.Strings(files)
+
+	for _, f := range files {
+		if s.seen[f] == false {
+			s.seen[f] = true
+			s.pending = append(s.pending, f)
+		}
+	}
+
+	return nil
+}
+
+// next returns the next message from the input, or io.EOF if nothing is currently available
+func (s *fileSource) next() (*awssqs.Message, error) {
+	for {
+		if s.decoder == nil {
+			if len(s.pending) == 0 {
+				return nil, io.EOF
+			}
+
+			if err := s.open(s.pending[0]); err != nil {
+				return nil, err
+			}
+
+			s.pending = s.pending[1:]
+		}
+
+		var fm fileMessage
+
+		err := s.decoder.Decode(&fm)
+		if err == io.EOF {
+			log.Printf("[file] INFO: read %d messages from %s (%d skipped)", s.position, s.name, s.skipped)
+			s.close()
+			continue
+		}
+
+		if err != nil {
+			log.Printf("[file] ERROR: %s: message %d: %s; skipping it", s.name, s.position+s.skipped+1, err.Error())
+			s.skipped++
+
+			// a message of the wrong shape has been read past; anything else is skipped to the end of the line
+			if _, wrongType := err.(*json.UnmarshalTypeError); wrongType == false {
+				s.resync()
+			}
+			continue
+		}
+
+		s.position++
+
+		msg := fm.message()
+		msg.ReceiptHandle = awssqs.ReceiptHandle(fmt.Sprintf("file:%s:%d", s.name, s.position))
+
+		return &msg, nil
+	}
+}
+
+// resync skips the rest of the line the decoder stopped on, starting a new decoder at the next line
+func (s *fileSource) resync() {
+	// the decoder's unread input comes first
+	s.reader = bufio.NewReader(io.MultiReader(s.decoder.Buffered(), s.reader))
+	s.reader.ReadString('\n')
+	s.decoder = json.NewDecoder(s.reader)
+}
+
+func (s *fileSource) open(name string) error {
+	s.name = name
+	s.position = 0
+	s.skipped = 0
+
+	if name == "-" {
+		s.name = "stdin"
+		s.reader = bufio.NewReader(os.Stdin)
+		s.decoder = json.NewDecoder(s.reader)
+		return nil
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[file] INFO: reading %s", name)
+
+	s.current = f
+	s.reader = bufio.NewReader(f)
+	s.decoder = json.NewDecoder(s.reader)
+
+	return nil
+}
+
+func (s *fileSource) close() {
+	if s.current != nil {
+		s.current.Close()
+	}
+
+	s.current = nil
+	s.reader = nil
+	s.decoder = nil
+}
+
+func (s *fileSource) ReceiveBatch(maxMessages uint, waitTime time.Duration) ([]awssqs.Message, error) {
+	var messages []awssqs.Message
+
+	deadline := time.Now().Add(waitTime)
+
+	for uint(len(messages)) < maxMessages {
+		msg, err := s.next()
+
+		if err == io.EOF {
+			// return what we have
+			if len(messages) > 0 {
+				break
+			}
+
+			if s.watch == false {
+				return nil, io.EOF
+			}
+
+			// nothing yet; look for new files until the wait time expires
+			if time.Now().After(deadline) == true {
+				break
+			}
+
+			time.Sleep(time.Second)
+
+			if err = s.scan(); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, *msg)
+	}
+
+	return messages, nil
+}
+
+func (s *fileSource) DeleteBatch(messages []awssqs.Message) ([]awssqs.OpStatus, error) {
+	// input files are left untouched
+	ops := make([]awssqs.OpStatus, len(messages))
+	for ix := range ops {
+		ops[ix] = true
+	}
+
+	return ops, nil
+}
+
+//
+// end of file
+//
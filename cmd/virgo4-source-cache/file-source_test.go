@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSourceSkipsMalformedLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.jsonl")
+
+	lines := `{"attributes": {"id": "one"}, "payload": "1"}
+{"attributes": {"id": "two"}, "payload": 
+{"attributes": {"id": "three"}, "payload": 3}
+{"attributes": {"id": "four"}, "payload": "4"}
+`
+	if err := os.WriteFile(path, []byte(lines), 0644); err != nil {
+		t.Fatalf("writing input: %s", err.Error())
+	}
+
+	s, err := newFileSource(ServiceConfig{InputPath: path})
+	if err != nil {
+		t.Fatalf("file source: %s", err.Error())
+	}
+
+	// the truncated and mistyped messages are skipped; the rest of the file is still read
+	messages, err := s.ReceiveBatch(10, 0)
+	if err != nil {
+		t.Fatalf("receiving: %s", err.Error())
+	}
+
+	var payloads []string
+	for _, m := range messages {
+		payloads = append(payloads, string(m.Payload))
+	}
+
+	if len(payloads) != 2 || payloads[0] != "1" || payloads[1] != "4" {
+		t.Fatalf("expected payloads [1 4], got %v", payloads)
+	}
+
+	if _, err = s.ReceiveBatch(10, 0); err != io.EOF {
+		t.Fatalf("expected the source to be exhausted, got %v", err)
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// the polling loop would otherwise block on a full worker queue holding a batch of received messages,
+// their visibility clocks ticking. instead polling pauses while the worker or delete queue is above its
+// high water mark, or flushes are slower than FlowMaxFlushTime, and resumes once everything is back
+// below the low water mark
+//
+
+// how often a paused polling loop checks whether it can resume
+const flowCheckInterval = 250 * time.Millisecond
+
+// flush times older than this no longer say anything about the database
+const flushLatencyWindow = 30 * time.Second
+
+// the weight of each new flush time in the average
+const flushLatencyWeight = 0.2
+
+// flushLatency is the recent average time taken to flush a batch to the cache
+type flushLatency struct {
+	sync.Mutex
+	average time.Duration
+	last    time.Time
+}
+
+// newFlushLatency - the factory
+func newFlushLatency() *flushLatency {
+	return &flushLatency{}
+}
+
+// observe adds a flush time to the average
+func (l *flushLatency) observe(d time.Duration, now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.last.IsZero() == true {
+		l.average = d
+	} else {
+		l.average = time.Duration(flushLatencyWeight*float64(d) + (1-flushLatencyWeight)*float64(l.average))
+	}
+
+	l.last = now
+}
+
+// recent returns the average flush time, or 0 if there have been no flushes lately
+func (l *flushLatency) recent(now time.Time) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+
+	if now.Sub(l.last) > flushLatencyWindow {
+		return 0
+	}
+
+	return l.average
+}
+
+// flowControl decides when the polling loop should pause
+type flowControl struct {
+	urgentChan  chan cacheMessage
+	processChan chan cacheMessage
+	deleteChan  chan []cacheMessage
+	latency     *flushLatency
+	high        int           // percent
+	low         int           // percent
+	maxFlush    time.Duration // 0 to ignore flush times
+
+	paused bool
+	since  time.Time
+}
+
+// newFlowControl - the factory
+func newFlowControl(cfg ServiceConfig, urgentChan chan cacheMessage, processChan chan cacheMessage, deleteChan chan []cacheMessage, latency *flushLatency) *flowControl {
+	return &flowControl{
+		urgentChan:  urgentChan,
+		processChan: processChan,
+		deleteChan:  deleteChan,
+		latency:     latency,
+		high:        cfg.FlowHighWater,
+		low:         cfg.FlowLowWater,
+		maxFlush:    time.Duration(cfg.FlowMaxFlushTime) * time.Millisecond,
+	}
+}
+
+// pressure returns the reasons polling should stop, measured against the mark (percent)
+func (f *flowControl) pressure(mark int, now time.Time) []string {
+	var reasons []string
+
+	full := func(name string, length int, capacity int) {
+		if capacity > 0 && length*100 >= capacity*mark {
+			reasons = append(reasons, fmt.Sprintf("%s queue %d/%d", name, length, capacity))
+		}
+	}
+
+	full("urgent", len(f.urgentChan), cap(f.urgentChan))
+	full("worker", len(f.processChan), cap(f.processChan))
+	full("delete", len(f.deleteChan), cap(f.deleteChan))
+
+	if f.maxFlush > 0 {
+		limit := f.maxFlush * time.Duration(mark) / time.Duration(f.high)
+		if latency := f.latency.recent(now); latency >= limit {
+			reasons = append(reasons, fmt.Sprintf("flush time %s", latency.Round(time.Millisecond)))
+		}
+	}
+
+	return reasons
+}
+
+// wait returns once polling may continue, reporting when it pauses and resumes
+func (f *flowControl) wait() {
+	for {
+		now := time.Now()
+
+		if f.paused == false {
+			reasons := f.pressure(f.high, now)
+			if len(reasons) == 0 {
+				return
+			}
+
+			f.paused = true
+			f.since = now
+			log.Printf("[flow] pausing polling: %s", strings.Join(reasons, ", "))
+
+		} else if reasons := f.pressure(f.low, now); len(reasons) == 0 {
+			f.paused = false
+			log.Printf("[flow] resuming polling after %s", now.Sub(f.since).Round(time.Millisecond))
+			return
+		}
+
+		time.Sleep(flowCheckInterval)
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFlowPressure(t *testing.T) {
+	processChan := make(chan cacheMessage, 10)
+	deleteChan := make(chan []cacheMessage, 10)
+	latency := newFlushLatency()
+
+	f := newFlowControl(ServiceConfig{FlowHighWater: 80, FlowLowWater: 50, FlowMaxFlushTime: 1000}, nil, processChan, deleteChan, latency)
+	now := time.Now()
+
+	for ix := 0; ix < 7; ix++ {
+		processChan <- cacheMessage{}
+	}
+
+	// between the marks: no reason to pause, but no reason to resume either
+	if reasons := f.pressure(f.high, now); len(reasons) != 0 {
+		t.Fatalf("expected no pressure at the high water mark, got %v", reasons)
+	}
+	if reasons := f.pressure(f.low, now); len(reasons) != 1 {
+		t.Fatalf("expected worker queue pressure at the low water mark, got %v", reasons)
+	}
+
+	processChan <- cacheMessage{}
+	if reasons := f.pressure(f.high, now); len(reasons) != 1 {
+		t.Fatalf("expected worker queue pressure at the high water mark, got %v", reasons)
+	}
+
+	// slow flushes count too, until they are old news
+	for len(processChan) > 0 {
+		<-processChan
+	}
+
+	latency.observe(2*time.Second, now)
+	if reasons := f.pressure(f.high, now); len(reasons) != 1 {
+		t.Fatalf("expected flush time pressure, got %v", reasons)
+	}
+	if reasons := f.pressure(f.high, now.Add(2*flushLatencyWindow)); len(reasons) != 0 {
+		t.Fatalf("expected stale flush times to be ignored, got %v", reasons)
+	}
+}
+
+//
+// end of file
+//
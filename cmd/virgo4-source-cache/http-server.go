@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//
+// while it runs, the service can serve:
+//
+//   GET  /stats   the cache statistics and the message delivery totals. the table statistics are
+//                 computed on demand and kept for a while, so that a dashboard polling the endpoint
+//                 doesn't keep the database busy
+//   POST /diff    the difference a message (as in file mode: attributes and payload) would make to
+//                 the cached record. it reads any record, so it is only served with an HTTPToken
+//   GET  /diff?id=<id>&version=<n>
+//                 the difference between an earlier version of a record and the cached one
+//
+// with an HTTPToken every request must carry it as a bearer token
+//
+
+// how long computed statistics are served before they are computed again
+const statsCacheTime = time.Minute
+
+// the largest message /diff accepts
+const maxDiffRequestBytes = 16 << 20
+
+// the server timeouts; statistics can take a while to compute
+const (
+	httpReadHeaderTimeout = 10 * time.Second
+	httpReadTimeout       = time.Minute
+	httpWriteTimeout      = 5 * time.Minute
+	httpIdleTimeout       = 2 * time.Minute
+)
+
+// requireToken wraps a handler to refuse requests without the bearer token
+func requireToken(token string, next http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serviceStats are what /stats serves
+type serviceStats struct {
+	Tables     []tableStats    `json:"tables"`
+	Deliveries *deliveryCounts `json:"deliveries,omitempty"` // while serving
+}
+
+// statsHandler serves the cache statistics as JSON
+type statsHandler struct {
+	store      CacheStore
+	tables     []string
+	deliveries *deliveryTracker
+
+	sync.Mutex
+	stats    []tableStats
+	computed time.Time
+}
+
+// newStatsHandler - the factory
+func newStatsHandler(store CacheStore, tables []string, deliveries *deliveryTracker) *statsHandler {
+	return &statsHandler{store: store, tables: tables, deliveries: deliveries}
+}
+
+func (h *statsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// one request computes; the rest wait for its answer
+	h.Lock()
+	now := time.Now()
+	if h.stats == nil || now.Sub(h.computed) > statsCacheTime {
+		stats, err := computeStats(storeHandle(h.store), h.tables, now)
+		if err != nil {
+			h.Unlock()
+			log.Printf("[stats] ERROR: computing statistics: %s", err.Error())
+			http.Error(w, "cannot compute statistics", http.StatusInternalServerError)
+			return
+		}
+		h.stats = stats
+		h.computed = now
+	}
+	stats := serviceStats{Tables: h.stats}
+	h.Unlock()
+
+	if h.deliveries != nil {
+		totals := h.deliveries.totals()
+		stats.Deliveries = &totals
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// diffHandler compares posted messages with the cached records
+type diffHandler struct {
+	store     CacheStore
+	normalize bool
+}
+
+// newDiffHandler - the factory
+func newDiffHandler(store CacheStore, normalize bool) *diffHandler {
+	return &diffHandler{store: store, normalize: normalize}
+}
+
+func (h *diffHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		h.serveVersion(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var fm fileMessage
+	body := http.MaxBytesReader(w, r.Body, maxDiffRequestBytes)
+	if err := json.NewDecoder(body).Decode(&fm); err != nil {
+		http.Error(w, fmt.Sprintf("bad message: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	rd, err := diffMessage(h.store, fm.message(), h.normalize)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cannot compare message: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rd)
+}
+
+// serveVersion compares an earlier version of a record with the cached one
+func (h *diffHandler) serveVersion(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	version, err := strconv.Atoi(r.URL.Query().Get("version"))
+	if id == "" || err != nil {
+		http.Error(w, "expected an id and a version", http.StatusBadRequest)
+		return
+	}
+
+	rd, err := diffVersion(h.store, id, version)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cannot compare versions: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rd)
+}
+
+// startHTTPServer serves the endpoints on the configured address, if there is one
+func startHTTPServer(cfg ServiceConfig, secrets *secretResolver, cache *cacheService, deliveries *deliveryTracker) error {
+	if cfg.HTTPListen == "" {
+		return nil
+	}
+
+	token, err := secrets.Resolve(cfg.HTTPToken)
+	if err != nil {
+		return fmt.Errorf("HTTPToken: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/stats", newStatsHandler(cache.store, cache.router.tables(), deliveries))
+
+	var handler http.Handler = mux
+	if token == "" {
+		log.Printf("[http] serving /stats on %s; /diff needs an HTTPToken", cfg.HTTPListen)
+	} else {
+		mux.Handle("/diff", newDiffHandler(cache.store, cfg.NormalizeAttributes))
+		handler = requireToken(token, mux)
+		log.Printf("[http] serving /stats and /diff on %s", cfg.HTTPListen)
+	}
+
+	server := &http.Server{
+		Addr:              cfg.HTTPListen,
+		Handler:           handler,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		ReadTimeout:       httpReadTimeout,
+		WriteTimeout:      httpWriteTimeout,
+		IdleTimeout:       httpIdleTimeout,
+	}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil {
+			log.Printf("[http] ERROR: %s", err.Error())
+		}
+	}()
+
+	return nil
+}
+
+//
+// end of file
+//
@@ -0,0 +1,1199 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"github.com/rs/xid"
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+//
+// integration tests: the real workers, deleters and stores, driven through a memorySource standing in
+// for SQS. the sqlite store is always tested; postgres is tested against a throwaway embedded server,
+// or an existing server named by VIRGO4_SOURCE_CACHE_TEST_POSTGRES_HOST (and _PORT, _USER, _PASS, _SSLMODE),
+// in which a scratch database is created with the embedded schema migrations.  set
+// VIRGO4_SOURCE_CACHE_TEST_POSTGRES=skip (or use -short) to test sqlite only
+//
+
+// the postgres configuration under test, nil if postgres is unavailable
+var testPostgres *ServiceConfig
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+
+	if testing.Verbose() == false {
+		log.SetOutput(io.Discard)
+	}
+
+	stop, err := startTestPostgres()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: postgres unavailable, testing sqlite only: %s\n", err.Error())
+	}
+
+	code := m.Run()
+
+	if stop != nil {
+		stop()
+	}
+
+	os.Exit(code)
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// startTestPostgres sets testPostgres to a scratch database and returns a function that tears it down
+func startTestPostgres() (func(), error) {
+	if testing.Short() == true || os.Getenv("VIRGO4_SOURCE_CACHE_TEST_POSTGRES") == "skip" {
+		return nil, fmt.Errorf("disabled")
+	}
+
+	admin := ServiceConfig{
+		CacheStore:       storePostgres,
+		PostgresHost:     os.Getenv("VIRGO4_SOURCE_CACHE_TEST_POSTGRES_HOST"),
+		PostgresUser:     envWithDefault("VIRGO4_SOURCE_CACHE_TEST_POSTGRES_USER", "postgres"),
+		PostgresPass:     envWithDefault("VIRGO4_SOURCE_CACHE_TEST_POSTGRES_PASS", "postgres"),
+		PostgresDatabase: "postgres",
+		PostgresSSLMode:  envWithDefault("VIRGO4_SOURCE_CACHE_TEST_POSTGRES_SSLMODE", "disable"),
+		PostgresTimeout:  30,
+		PostgresTable:    "source_cache",
+		PayloadCodec:     codecNone,
+	}
+
+	var stopServer func()
+
+	if admin.PostgresHost != "" {
+		port, err := strconv.Atoi(envWithDefault("VIRGO4_SOURCE_CACHE_TEST_POSTGRES_PORT", "5432"))
+		if err != nil {
+			return nil, err
+		}
+		admin.PostgresPort = port
+	} else {
+		port, err := freePort()
+		if err != nil {
+			return nil, err
+		}
+
+		runtime, err := os.MkdirTemp("", "source-cache-postgres")
+		if err != nil {
+			return nil, err
+		}
+
+		server := embeddedpostgres.NewDatabase(embeddedpostgres.DefaultConfig().
+			Port(uint32(port)).
+			Username(admin.PostgresUser).
+			Password(admin.PostgresPass).
+			RuntimePath(runtime).
+			Logger(io.Discard))
+
+		if err = server.Start(); err != nil {
+			os.RemoveAll(runtime)
+			return nil, err
+		}
+
+		admin.PostgresHost = "localhost"
+		admin.PostgresPort = port
+
+		stopServer = func() {
+			server.Stop()
+			os.RemoveAll(runtime)
+		}
+	}
+
+	// create the scratch database and apply the migrations to it
+	scratch := admin
+	scratch.PostgresDatabase = "source_cache_test_" + xid.New().String()
+
+	adminStore, err := newPostgresStore(admin, nil)
+	if err == nil {
+		_, err = adminStore.handle.NewQuery("CREATE DATABASE " + scratch.PostgresDatabase).Execute()
+	}
+
+	if err == nil {
+		err = applyTestMigrations(scratch)
+	}
+
+	stop := func() {
+		if adminStore != nil {
+			adminStore.handle.NewQuery("DROP DATABASE IF EXISTS " + scratch.PostgresDatabase).Execute()
+			adminStore.Close()
+		}
+		if stopServer != nil {
+			stopServer()
+		}
+	}
+
+	if err != nil {
+		stop()
+		return nil, err
+	}
+
+	testPostgres = &scratch
+
+	return stop, nil
+}
+
+func applyTestMigrations(cfg ServiceConfig) error {
+	s, err := newPostgresStore(cfg, nil)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	m, err := newMigrator(s.handle)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.Up(0)
+
+	return err
+}
+
+// testConfig returns a small pipeline configuration for the given store
+func testConfig(store ServiceConfig) ServiceConfig {
+	cfg := store
+
+	cfg.PollTimeOut = 1
+	cfg.Workers = 2
+	cfg.WorkerQueueSize = 100
+	cfg.WorkerFlushTime = 1
+	cfg.Deleters = 1
+	cfg.DeleteQueueSize = 10
+	cfg.FlowHighWater = 80
+	cfg.FlowLowWater = 50
+	cfg.PostgresBatchSize = 10
+
+	return cfg
+}
+
+// forEachStore runs the test against each available store, each starting with an empty cache
+func forEachStore(t *testing.T, test func(t *testing.T, cfg ServiceConfig)) {
+	t.Run(storeSqlite, func(t *testing.T) {
+		test(t, testConfig(ServiceConfig{
+			CacheStore:    storeSqlite,
+			SqlitePath:    filepath.Join(t.TempDir(), "cache.db"),
+			PostgresTable: "source_cache",
+			PayloadCodec:  codecNone,
+		}))
+	})
+
+	t.Run(storePostgres, func(t *testing.T) {
+		if testPostgres == nil {
+			t.Skip("postgres unavailable")
+		}
+
+		s, err := newPostgresStore(*testPostgres, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = s.handle.NewQuery("TRUNCATE " + testPostgres.PostgresTable).Execute()
+		s.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		test(t, testConfig(*testPostgres))
+	})
+}
+
+func testMessage(id string, operation string, payload string) awssqs.Message {
+	return awssqs.Message{
+		Attribs: awssqs.Attributes{
+			{Name: awssqs.AttributeKeyRecordId, Value: id},
+			{Name: awssqs.AttributeKeyRecordType, Value: awssqs.AttributeValueRecordTypeXml},
+			{Name: awssqs.AttributeKeyRecordSource, Value: "test"},
+			{Name: awssqs.AttributeKeyRecordOperation, Value: operation},
+		},
+		Payload: []byte(payload),
+	}
+}
+
+// testPipeline is a running pipeline fed by a memorySource
+type testPipeline struct {
+	source *memorySource
+	cache  *cacheService
+	done   chan struct{}
+}
+
+func startTestPipeline(t *testing.T, cfg ServiceConfig) *testPipeline {
+	tp := testPipeline{
+		source: newMemorySource(1000),
+		cache:  NewDbCache(1, cfg, nil),
+		done:   make(chan struct{}),
+	}
+
+	p := startPipeline(cfg, tp.source, tp.cache)
+
+	go func() {
+		p.pollMessages()
+		p.shutdown()
+		close(tp.done)
+	}()
+
+	t.Cleanup(func() { tp.cache.store.Close() })
+
+	return &tp
+}
+
+// finish closes the source and waits for the pipeline to drain
+func (tp *testPipeline) finish(t *testing.T) {
+	tp.source.Close()
+
+	select {
+	case <-tp.done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("timeout waiting for pipeline shutdown")
+	}
+}
+
+// waitForDeletes waits for at least count messages to have been deleted from the source
+func (tp *testPipeline) waitForDeletes(t *testing.T, count int, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+
+	for len(tp.source.Deleted()) < count {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for deletes: expected %d, got %d", count, len(tp.source.Deleted()))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func expectPayload(t *testing.T, store CacheStore, id string, payload string) *cacheRecord {
+	t.Helper()
+
+	rec, err := store.Get(id)
+	if err != nil {
+		t.Fatalf("get %s: %s", id, err.Error())
+	}
+
+	if string(rec.Payload) != payload {
+		t.Fatalf("get %s: expected payload [%s], got [%s]", id, payload, string(rec.Payload))
+	}
+
+	return rec
+}
+
+func expectMissing(t *testing.T, store CacheStore, id string) {
+	t.Helper()
+
+	if _, err := store.Get(id); err != errRecordNotFound {
+		t.Fatalf("get %s: expected errRecordNotFound, got %v", id, err)
+	}
+}
+
+func TestUpsertAndDelete(t *testing.T) {
+	forEachStore(t, func(t *testing.T, cfg ServiceConfig) {
+		tp := startTestPipeline(t, cfg)
+
+		for i := 0; i < 25; i++ {
+			tp.source.Put(testMessage(fmt.Sprintf("id%02d", i), awssqs.AttributeValueRecordOperationUpdate, fmt.Sprintf("<r>%d</r>", i)))
+		}
+
+		tp.waitForDeletes(t, 25, 10*time.Second)
+
+		first := expectPayload(t, tp.cache.store, "id00", "<r>0</r>")
+
+		tp.source.Put(testMessage("id00", awssqs.AttributeValueRecordOperationUpdate, "<r>updated</r>"))
+		tp.source.Put(testMessage("id01", awssqs.AttributeValueRecordOperationDelete, ""))
+
+		tp.finish(t)
+
+		updated := expectPayload(t, tp.cache.store, "id00", "<r>updated</r>")
+		if updated.CreatedAt.Equal(first.CreatedAt) == false {
+			t.Fatalf("created_at changed on update: %s -> %s", first.CreatedAt, updated.CreatedAt)
+		}
+		if updated.UpdatedAt.Before(first.UpdatedAt) {
+			t.Fatalf("updated_at went backwards: %s -> %s", first.UpdatedAt, updated.UpdatedAt)
+		}
+
+		expectMissing(t, tp.cache.store, "id01")
+
+		count := 0
+		err := tp.cache.store.Iterate(cacheFilter{Source: "test"}, func(cacheRecord) error {
+			count++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 24 {
+			t.Fatalf("expected 24 records, got %d", count)
+		}
+	})
+}
+
+func TestOrdering(t *testing.T) {
+	forEachStore(t, func(t *testing.T, cfg ServiceConfig) {
+		// a single worker and a long flush time so that everything lands in one batch
+		cfg.Workers = 1
+		cfg.WorkerFlushTime = 60
+		cfg.PostgresBatchSize = 100
+
+		tp := startTestPipeline(t, cfg)
+
+		tp.source.Put(testMessage("b", awssqs.AttributeValueRecordOperationUpdate, "b1"))
+		tp.source.Put(testMessage("a", awssqs.AttributeValueRecordOperationUpdate, "a1"))
+		tp.source.Put(testMessage("c", awssqs.AttributeValueRecordOperationDelete, ""))
+		tp.source.Put(testMessage("a", awssqs.AttributeValueRecordOperationUpdate, "a2"))
+		tp.source.Put(testMessage("b", awssqs.AttributeValueRecordOperationDelete, ""))
+		tp.source.Put(testMessage("c", awssqs.AttributeValueRecordOperationUpdate, "c1"))
+
+		tp.finish(t)
+
+		// operations on the same id are applied in the order received
+		expectPayload(t, tp.cache.store, "a", "a2")
+		expectMissing(t, tp.cache.store, "b")
+		expectPayload(t, tp.cache.store, "c", "c1")
+
+		if n := len(tp.source.Deleted()); n != 6 {
+			t.Fatalf("expected 6 deletes, got %d", n)
+		}
+	})
+}
+
+func TestBatchSizeFlush(t *testing.T) {
+	forEachStore(t, func(t *testing.T, cfg ServiceConfig) {
+		cfg.Workers = 1
+		cfg.WorkerFlushTime = 60
+		cfg.PostgresBatchSize = 5
+
+		tp := startTestPipeline(t, cfg)
+
+		for i := 0; i < 10; i++ {
+			tp.source.Put(testMessage(fmt.Sprintf("id%02d", i), awssqs.AttributeValueRecordOperationUpdate, "x"))
+		}
+
+		// full batches are written without waiting for the flush timer or shutdown
+		tp.waitForDeletes(t, 10, 10*time.Second)
+		expectPayload(t, tp.cache.store, "id09", "x")
+
+		tp.finish(t)
+	})
+}
+
+func TestFlushTimer(t *testing.T) {
+	forEachStore(t, func(t *testing.T, cfg ServiceConfig) {
+		cfg.WorkerFlushTime = 1
+		cfg.PostgresBatchSize = 100
+
+		tp := startTestPipeline(t, cfg)
+
+		for i := 0; i < 3; i++ {
+			tp.source.Put(testMessage(fmt.Sprintf("id%02d", i), awssqs.AttributeValueRecordOperationUpdate, "x"))
+		}
+
+		// a partial batch is written once the workers have been idle for the flush time
+		start := time.Now()
+		tp.waitForDeletes(t, 3, 10*time.Second)
+
+		if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+			t.Fatalf("partial batch flushed after %s; expected the flush timer to apply", elapsed)
+		}
+
+		expectPayload(t, tp.cache.store, "id02", "x")
+
+		tp.finish(t)
+	})
+}
+
+func TestShutdown(t *testing.T) {
+	forEachStore(t, func(t *testing.T, cfg ServiceConfig) {
+		cfg.WorkerFlushTime = 60
+		cfg.PostgresBatchSize = 100
+
+		tp := startTestPipeline(t, cfg)
+
+		for i := 0; i < 7; i++ {
+			tp.source.Put(testMessage(fmt.Sprintf("id%02d", i), awssqs.AttributeValueRecordOperationUpdate, "x"))
+		}
+
+		// pending writes are flushed and deleted on shutdown rather than waiting for the flush timer
+		tp.finish(t)
+
+		if n := len(tp.source.Deleted()); n != 7 {
+			t.Fatalf("expected 7 deletes, got %d", n)
+		}
+
+		if n := tp.source.Inflight(); n != 0 {
+			t.Fatalf("expected no inflight messages, got %d", n)
+		}
+
+		for i := 0; i < 7; i++ {
+			expectPayload(t, tp.cache.store, fmt.Sprintf("id%02d", i), "x")
+		}
+	})
+}
+
+// countRows counts the rows in one of the store tables
+func countRows(t *testing.T, store CacheStore, table string) int {
+	t.Helper()
+
+	var count int
+	if err := storeHandle(store).NewQuery("SELECT COUNT(*) FROM " + table).Row(&count); err != nil {
+		t.Fatal(err)
+	}
+
+	return count
+}
+
+func TestRouting(t *testing.T) {
+	forEachStore(t, func(t *testing.T, cfg ServiceConfig) {
+		cfg.PostgresRoutes = "marc=source_cache_test_marc, */json=source_cache_test_json"
+		cfg.PostgresCreateTables = true
+
+		tp := startTestPipeline(t, cfg)
+
+		routed := func(id string, source string, recordType string, operation string) awssqs.Message {
+			return awssqs.Message{
+				Attribs: awssqs.Attributes{
+					{Name: awssqs.AttributeKeyRecordId, Value: id},
+					{Name: awssqs.AttributeKeyRecordType, Value: recordType},
+					{Name: awssqs.AttributeKeyRecordSource, Value: source},
+					{Name: awssqs.AttributeKeyRecordOperation, Value: operation},
+				},
+				Payload: []byte("<r/>"),
+			}
+		}
+
+		update := awssqs.AttributeValueRecordOperationUpdate
+
+		tp.source.Put(routed("m1", "marc", "xml", update))
+		tp.source.Put(routed("m2", "marc", "json", update))
+		tp.source.Put(routed("j1", "other", "json", update))
+		tp.source.Put(routed("d1", "other", "xml", update))
+		tp.source.Put(routed("d2", "other", "xml", update))
+
+		tp.waitForDeletes(t, 5, 10*time.Second)
+
+		// deletes find the record whichever table it is in
+		tp.source.Put(testMessage("m1", awssqs.AttributeValueRecordOperationDelete, ""))
+
+		// and a record whose source changed leaves its old table
+		tp.source.Put(routed("m2", "other", "json", update))
+		tp.source.Put(routed("j2", "marc", "json", update))
+		tp.source.Put(routed("j2", "other", "xml", update))
+
+		tp.finish(t)
+
+		for table, expected := range map[string]int{"source_cache": 3, "source_cache_test_marc": 0, "source_cache_test_json": 2} {
+			if n := countRows(t, tp.cache.store, table); n != expected {
+				t.Errorf("%s: expected %d rows, got %d", table, expected, n)
+			}
+		}
+
+		expectMissing(t, tp.cache.store, "m1")
+		expectPayload(t, tp.cache.store, "m2", "<r/>")
+		expectPayload(t, tp.cache.store, "j1", "<r/>")
+
+		count := 0
+		tp.cache.store.Iterate(cacheFilter{}, func(cacheRecord) error {
+			count++
+			return nil
+		})
+		if count != 5 {
+			t.Errorf("expected to iterate 5 records, got %d", count)
+		}
+	})
+}
+
+func TestMigrateTables(t *testing.T) {
+	if testPostgres == nil {
+		t.Skip("postgres unavailable")
+	}
+
+	cfg := *testPostgres
+	cfg.PostgresTable = "source_cache_migrate_test"
+	cfg.PostgresRoutes = "marc=source_cache_migrate_test_marc"
+
+	admin, err := newPostgresStore(*testPostgres, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+
+	// tables from before the payload and expiry columns
+	var setup []string
+	for _, table := range []string{cfg.PostgresTable, "source_cache_migrate_test_marc"} {
+		setup = append(setup,
+			"DROP TABLE IF EXISTS "+table+" CASCADE",
+			"CREATE TABLE "+table+" (LIKE source_cache INCLUDING ALL)",
+			"ALTER TABLE "+table+" DROP COLUMN payload_data, DROP COLUMN payload_codec, DROP COLUMN payload_ref, DROP COLUMN expires_at")
+	}
+	setup = append(setup, "DROP TABLE IF EXISTS "+cfg.PostgresTable+quarantineSuffix+", "+cfg.PostgresTable+historySuffix)
+
+	if err = execute(admin.handle, setup...); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := newPostgresStore(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// the service refuses to start on them, unless it migrates them
+	if err = prepareSchema(cfg, s); err == nil {
+		t.Fatal("expected outdated tables to be refused")
+	}
+
+	cfg.PostgresMigrate = true
+	if err = prepareSchema(cfg, s); err != nil {
+		t.Fatalf("expected the tables to be migrated: %s", err.Error())
+	}
+
+	execute(admin.handle,
+		"DROP TABLE IF EXISTS "+cfg.PostgresTable+", source_cache_migrate_test_marc, "+cfg.PostgresTable+quarantineSuffix+", "+cfg.PostgresTable+historySuffix)
+}
+
+func TestPartitioning(t *testing.T) {
+	if testPostgres == nil {
+		t.Skip("postgres unavailable")
+	}
+
+	cfg := testConfig(*testPostgres)
+	cfg.PostgresTable = "source_cache_partition_test"
+
+	admin, err := newPostgresStore(*testPostgres, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+
+	err = execute(admin.handle,
+		"DELETE FROM schema_conversions",
+		"DROP TABLE IF EXISTS "+cfg.PostgresTable+" CASCADE",
+		"CREATE TABLE "+cfg.PostgresTable+" (LIKE source_cache INCLUDING ALL)",
+		"ALTER TABLE "+cfg.PostgresTable+" SET (autovacuum_vacuum_threshold = 10000)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := func(id string, source string, payload string) awssqs.Message {
+		m := testMessage(id, awssqs.AttributeValueRecordOperationUpdate, payload)
+		for ix := range m.Attribs {
+			if m.Attribs[ix].Name == awssqs.AttributeKeyRecordSource {
+				m.Attribs[ix].Value = source
+			}
+		}
+		return m
+	}
+
+	tp := startTestPipeline(t, cfg)
+	tp.source.Put(message("a1", "alpha", "1"))
+	tp.source.Put(message("b1", "beta", "1"))
+	tp.finish(t)
+
+	// a store opened before the conversion carries on writing after it
+	running, err := newPostgresStore(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer running.Close()
+
+	if err = convertToPartitioned(admin.handle, cfg.PostgresTable, 1, true); err != nil {
+		t.Fatal(err)
+	}
+
+	upsert := cacheOperation{operation: cacheOperationUpsert, record: cacheRecord{ID: "b1", Type: "xml", Source: "alpha", Payload: []byte("moved")}}
+	if err = running.WriteBatch([]cacheOperation{upsert}); err != nil {
+		t.Fatalf("expected the running store to pick up the partitioned key: %s", err.Error())
+	}
+	expectPayload(t, running, "b1", "moved")
+
+	// the store now upserts on (id, source), and unknown sources land in the default partition
+	tp = startTestPipeline(t, cfg)
+	tp.source.Put(message("a1", "alpha", "2"))
+	tp.source.Put(message("g1", "gamma", "1"))
+	tp.source.Put(message("b1", "beta", "delete me"))
+	tp.source.Put(testMessage("b1", awssqs.AttributeValueRecordOperationDelete, ""))
+	tp.source.Put(message("m1", "alpha", "1"))
+	tp.source.Put(message("m1", "beta", "2"))
+	tp.finish(t)
+
+	expectPayload(t, tp.cache.store, "a1", "2")
+	expectPayload(t, tp.cache.store, "g1", "1")
+	expectMissing(t, tp.cache.store, "b1")
+
+	// an id is only ever cached for one source
+	expectPayload(t, tp.cache.store, "m1", "2")
+	var copies int
+	if err = admin.handle.NewQuery("SELECT COUNT(*) FROM " + cfg.PostgresTable + " WHERE id = 'm1'").Row(&copies); err != nil || copies != 1 {
+		t.Fatalf("expected 1 copy of m1, got %d (%v)", copies, err)
+	}
+
+	if n := countRows(t, tp.cache.store, cfg.PostgresTable+partitionDefaultSuffix); n != 1 {
+		t.Fatalf("expected 1 row in the default partition, got %d", n)
+	}
+
+	// a new source's partition takes its records from the default partition
+	gamma, _ := partitionName(cfg.PostgresTable, "gamma")
+	if err = createPartition(admin.handle, cfg.PostgresTable, "gamma", gamma); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := countRows(t, tp.cache.store, gamma); n != 1 {
+		t.Fatalf("expected 1 row in %s, got %d", gamma, n)
+	}
+
+	partitions, err := listPartitions(admin.handle, cfg.PostgresTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(partitions) != 4 {
+		t.Fatalf("expected 4 partitions, got %v", partitions)
+	}
+
+	// retiring a source detaches its records with its partition
+	alpha, _ := partitionName(cfg.PostgresTable, "alpha")
+	if err = execute(admin.handle, "ALTER TABLE "+cfg.PostgresTable+" DETACH PARTITION "+alpha, "DROP TABLE "+alpha); err != nil {
+		t.Fatal(err)
+	}
+
+	expectMissing(t, tp.cache.store, "a1")
+	expectPayload(t, tp.cache.store, "g1", "1")
+
+	execute(admin.handle, "DROP TABLE IF EXISTS "+cfg.PostgresTable+" CASCADE", "DELETE FROM schema_conversions")
+}
+
+func TestCompression(t *testing.T) {
+	forEachStore(t, func(t *testing.T, cfg ServiceConfig) {
+		payload := strings.Repeat("<record><field>compressible</field></record>", 100)
+
+		cfg.PayloadCodec = codecGzip
+		cfg.PayloadCompressMin = 100
+
+		tp := startTestPipeline(t, cfg)
+		tp.source.Put(testMessage("big", awssqs.AttributeValueRecordOperationUpdate, payload))
+		tp.source.Put(testMessage("small", awssqs.AttributeValueRecordOperationUpdate, "<r/>"))
+		tp.finish(t)
+
+		handle := storeHandle(tp.cache.store)
+
+		codecOf := func(id string) string {
+			var codec string
+			if err := handle.NewQuery("SELECT payload_codec FROM source_cache WHERE id = {:id}").Bind(dbx.Params{"id": id}).Row(&codec); err != nil {
+				t.Fatal(err)
+			}
+			return codec
+		}
+
+		if codec := codecOf("big"); codec != codecGzip {
+			t.Fatalf("expected the large payload to be stored with %s, got [%s]", codecGzip, codec)
+		}
+		if codec := codecOf("small"); codec != "" {
+			t.Fatalf("expected the small payload to be stored uncompressed, got [%s]", codec)
+		}
+
+		expectPayload(t, tp.cache.store, "big", payload)
+		expectPayload(t, tp.cache.store, "small", "<r/>")
+
+		// recompress to another codec, then back to none
+		for _, target := range []string{codecZstd, codecNone} {
+			cfg.PayloadCodec = target
+			payloads, _ := newPayloadStorage(cfg)
+
+			result, err := recompressTable(handle, "source_cache", payloads, 1, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the small payload is left alone
+			if result.rewritten != 1 || result.skipped != 0 {
+				t.Fatalf("%s: expected 1 row rewritten, got %+v", target, result)
+			}
+
+			expectPayload(t, tp.cache.store, "big", payload)
+		}
+
+		if codec := codecOf("big"); codec != "" {
+			t.Fatalf("expected the large payload to be uncompressed, got [%s]", codec)
+		}
+	})
+}
+
+func TestOffload(t *testing.T) {
+	forEachStore(t, func(t *testing.T, cfg ServiceConfig) {
+		objects := t.TempDir()
+
+		cfg.OffloadThreshold = 100
+		cfg.OffloadLocation = "file://" + objects
+
+		countObjects := func() int {
+			count := 0
+			filepath.WalkDir(objects, func(path string, d os.DirEntry, err error) error {
+				if err == nil && d.IsDir() == false {
+					count++
+				}
+				return nil
+			})
+			return count
+		}
+
+		large := strings.Repeat("x", 200)
+		update := awssqs.AttributeValueRecordOperationUpdate
+
+		tp := startTestPipeline(t, cfg)
+		tp.source.Put(testMessage("big", update, large))
+		tp.source.Put(testMessage("small", update, "<r/>"))
+		tp.source.Put(testMessage("gone", update, large))
+		tp.waitForDeletes(t, 3, 10*time.Second)
+
+		if n := countObjects(); n != 2 {
+			t.Fatalf("expected 2 offloaded payloads, got %d", n)
+		}
+
+		expectPayload(t, tp.cache.store, "big", large)
+		expectPayload(t, tp.cache.store, "small", "<r/>")
+
+		// a batch read leaves offloaded payloads where they are
+		recs, err := tp.cache.store.GetBatch([]string{"big", "small", "missing"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(recs) != 2 || recs["big"].PayloadRef == "" || string(recs["small"].Payload) != "<r/>" {
+			t.Fatalf("expected big by reference and small with its payload, got %d records", len(recs))
+		}
+
+		// replaced and deleted payloads are cleaned up
+		tp.source.Put(testMessage("big", update, large+"y"))
+		tp.source.Put(testMessage("gone", awssqs.AttributeValueRecordOperationDelete, ""))
+		tp.finish(t)
+
+		if n := countObjects(); n != 1 {
+			t.Fatalf("expected 1 offloaded payload, got %d", n)
+		}
+
+		expectPayload(t, tp.cache.store, "big", large+"y")
+		expectMissing(t, tp.cache.store, "gone")
+	})
+}
+
+func TestValidation(t *testing.T) {
+	forEachStore(t, func(t *testing.T, cfg ServiceConfig) {
+		cfg.ValidateActions = "xml=quarantine"
+
+		update := awssqs.AttributeValueRecordOperationUpdate
+
+		tp := startTestPipeline(t, cfg)
+		tp.source.Put(testMessage("valid", update, "<r>ok</r>"))
+		tp.source.Put(testMessage("truncated", update, "<r><field>"))
+		tp.source.Put(testMessage("empty", update, ""))
+		tp.finish(t)
+
+		// invalid messages are still removed from the queue
+		if n := len(tp.source.Deleted()); n != 3 {
+			t.Fatalf("expected 3 deleted messages, got %d", n)
+		}
+
+		expectPayload(t, tp.cache.store, "valid", "<r>ok</r>")
+		expectMissing(t, tp.cache.store, "truncated")
+		expectMissing(t, tp.cache.store, "empty")
+
+		var reasons []string
+		err := storeHandle(tp.cache.store).NewQuery("SELECT reason FROM source_cache_quarantine WHERE id IN ('truncated', 'empty', 'valid') ORDER BY id").Column(&reasons)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(reasons) != 2 || reasons[0] != "empty payload" {
+			t.Fatalf("expected the two invalid records in quarantine, got %v", reasons)
+		}
+	})
+}
+
+func TestInvalidAttributes(t *testing.T) {
+	forEachStore(t, func(t *testing.T, cfg ServiceConfig) {
+		update := awssqs.AttributeValueRecordOperationUpdate
+
+		tp := startTestPipeline(t, cfg)
+		tp.source.Put(testMessage("good", update, "<r/>"))
+
+		long := testMessage("long", update, "<r/>")
+		long.Attribs[2].Value = strings.Repeat("s", maxRecordSourceLength+1)
+		tp.source.Put(long)
+
+		tp.source.Put(testMessage("", update, "<r/>"))
+		tp.finish(t)
+
+		// the invalid messages don't take the batch down with them, and are removed from the queue
+		if n := len(tp.source.Deleted()); n != 3 {
+			t.Fatalf("expected 3 deleted messages, got %d", n)
+		}
+
+		expectPayload(t, tp.cache.store, "good", "<r/>")
+		expectMissing(t, tp.cache.store, "long")
+	})
+}
+
+// recordingNotifier remembers the records it is told about, or fails
+type recordingNotifier struct {
+	records []cacheRecord
+	fail    bool
+}
+
+func (n *recordingNotifier) notify(records []cacheRecord) error {
+	if n.fail == true {
+		return fmt.Errorf("queue unavailable")
+	}
+	n.records = append(n.records, records...)
+	return nil
+}
+
+func TestPurge(t *testing.T) {
+	forEachStore(t, func(t *testing.T, cfg ServiceConfig) {
+		update := awssqs.AttributeValueRecordOperationUpdate
+
+		cfg.HistoryVersions = 2
+
+		message := func(id string) awssqs.Message {
+			msg := testMessage(id, update, "<r/>")
+			if strings.HasPrefix(id, "r") == true {
+				msg.Attribs[2].Value = "retired"
+			}
+			return msg
+		}
+
+		tp := startTestPipeline(t, cfg)
+		for _, id := range []string{"r1", "r2", "r3", "k1", "k2"} {
+			tp.source.Put(message(id))
+		}
+		tp.waitForDeletes(t, 5, 10*time.Second)
+
+		// with an earlier version of each
+		tp.source.Put(message("r1"))
+		tp.source.Put(message("k1"))
+		tp.finish(t)
+
+		handle := storeHandle(tp.cache.store)
+		payloads, _ := newPayloadStorage(cfg)
+
+		// nothing was updated before an hour ago
+		old := purgeFilter{source: "retired", before: time.Now().Add(-time.Hour)}
+		if count, err := countPurge(handle, "source_cache", old); err != nil || count != 0 {
+			t.Fatalf("expected no old records, got %d (%v)", count, err)
+		}
+
+		filter := purgeFilter{source: "retired", after: time.Now().Add(-time.Hour)}
+		if count, err := countPurge(handle, "source_cache", filter); err != nil || count != 3 {
+			t.Fatalf("expected 3 records to purge, got %d (%v)", count, err)
+		}
+
+		// nothing is deleted that downstream hasn't been told about
+		if _, err := purgeTable(handle, "source_cache", "source_cache_history", payloads, filter, 2, 0, &recordingNotifier{fail: true}); err == nil {
+			t.Fatalf("expected the failed notification to fail the purge")
+		}
+
+		if n := countRows(t, tp.cache.store, "source_cache"); n != 5 {
+			t.Fatalf("expected all 5 rows after the failed purge, got %d", n)
+		}
+
+		notifier := &recordingNotifier{}
+		result, err := purgeTable(handle, "source_cache", "source_cache_history", payloads, filter, 2, 0, notifier)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result.deleted != 3 || result.skipped != 0 || len(notifier.records) != 3 {
+			t.Fatalf("expected 3 rows deleted and notified, got %+v and %d notifications", result, len(notifier.records))
+		}
+
+		expectMissing(t, tp.cache.store, "r2")
+		expectPayload(t, tp.cache.store, "k1", "<r/>")
+
+		if n := countRows(t, tp.cache.store, "source_cache"); n != 2 {
+			t.Fatalf("expected 2 rows left, got %d", n)
+		}
+
+		// the earlier versions of the purged records went with them
+		if versions, err := tp.cache.store.History("r1"); err != nil || len(versions) != 0 {
+			t.Fatalf("expected no versions of r1 left, got %d (%v)", len(versions), err)
+		}
+		if versions, err := tp.cache.store.History("k1"); err != nil || len(versions) != 1 {
+			t.Fatalf("expected the version of k1 to be kept, got %d (%v)", len(versions), err)
+		}
+	})
+}
+
+func TestExpiry(t *testing.T) {
+	forEachStore(t, func(t *testing.T, cfg ServiceConfig) {
+		update := awssqs.AttributeValueRecordOperationUpdate
+
+		cfg.RecordTTLs = "temp=1h"
+		cfg.ExpiryAttributes = true
+		cfg.ReapInterval = 3600
+
+		tp := startTestPipeline(t, cfg)
+
+		temporary := testMessage("t1", update, "<r/>")
+		temporary.Attribs[2].Value = "temp"
+		tp.source.Put(temporary)
+
+		expired := testMessage("e1", update, "<r/>")
+		expired.Attribs = append(expired.Attribs, awssqs.Attribute{Name: attributeKeyRecordExpires, Value: time.Now().Add(-time.Minute).Format(time.RFC3339)})
+		tp.source.Put(expired)
+
+		tp.source.Put(testMessage("k1", update, "<r/>"))
+		tp.finish(t)
+
+		// without ttls or expiry attributes nothing expires, so there is nothing to reap
+		if r, err := newReaper(ServiceConfig{ReapInterval: 300}, tp.cache.store); err != nil || r != nil {
+			t.Fatalf("expected no reaper, got %v (%v)", r, err)
+		}
+
+		r, err := newReaper(cfg, tp.cache.store)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// an expired record is no longer found, even before it is reaped
+		expectMissing(t, tp.cache.store, "e1")
+		if n := countRows(t, tp.cache.store, "source_cache"); n != 3 {
+			t.Fatalf("expected 3 rows before reaping, got %d", n)
+		}
+
+		// the message's own expiry time has passed...
+		if reaped, err := r.reap(time.Now()); err != nil || reaped != 1 {
+			t.Fatalf("expected 1 record reaped, got %d (%v)", reaped, err)
+		}
+
+		// ...and the ttl of the temporary source will have
+		if reaped, err := r.reap(time.Now().Add(2 * time.Hour)); err != nil || reaped != 1 {
+			t.Fatalf("expected 1 record reaped, got %d (%v)", reaped, err)
+		}
+		expectMissing(t, tp.cache.store, "t1")
+
+		rec := expectPayload(t, tp.cache.store, "k1", "<r/>")
+		if rec.ExpiresAt != nil {
+			t.Fatalf("expected k1 not to expire, got %s", rec.ExpiresAt)
+		}
+	})
+}
+
+func TestStats(t *testing.T) {
+	forEachStore(t, func(t *testing.T, cfg ServiceConfig) {
+		update := awssqs.AttributeValueRecordOperationUpdate
+
+		tp := startTestPipeline(t, cfg)
+		tp.source.Put(testMessage("s1", update, "<r/>"))
+		tp.source.Put(testMessage("s2", update, "<rr/>"))
+
+		other := testMessage("o1", update, "<record/>")
+		other.Attribs[2].Value = "other"
+		tp.source.Put(other)
+		tp.finish(t)
+
+		all, err := computeStats(storeHandle(tp.cache.store), []string{"source_cache"}, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stats := all[0]
+		if stats.Rows != 3 || stats.PayloadBytes != 18 || stats.CreatedDay != 3 || len(stats.Groups) != 2 {
+			t.Fatalf("expected 3 rows of 18 bytes in 2 groups, all created today, got %+v", stats)
+		}
+
+		if g := stats.Groups[1]; g.Source != "test" || g.Rows != 2 || g.PayloadBytes != 9 {
+			t.Fatalf("expected 2 rows of 9 bytes from test, got %+v", g)
+		}
+
+		if stats.OldestUpdate == nil || stats.NewestUpdate == nil || stats.NewestUpdate.Before(*stats.OldestUpdate) == true {
+			t.Fatalf("expected an update range, got %v to %v", stats.OldestUpdate, stats.NewestUpdate)
+		}
+
+		// and the same over http
+		server := httptest.NewServer(newStatsHandler(tp.cache.store, []string{"source_cache"}, newDeliveryTracker()))
+		defer server.Close()
+
+		res, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		var served serviceStats
+		if err = json.NewDecoder(res.Body).Decode(&served); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(served.Tables) != 1 || served.Tables[0].Rows != 3 || served.Deliveries == nil {
+			t.Fatalf("expected the statistics to be served, got %+v", served)
+		}
+	})
+}
+
+func TestDiff(t *testing.T) {
+	forEachStore(t, func(t *testing.T, cfg ServiceConfig) {
+		update := awssqs.AttributeValueRecordOperationUpdate
+
+		// the updates are compared as they are written
+		cfg.LogDiffs = true
+
+		tp := startTestPipeline(t, cfg)
+		tp.source.Put(testMessage("d1", update, "<r><a>1</a></r>"))
+		tp.waitForDeletes(t, 1, 10*time.Second)
+		tp.source.Put(testMessage("d1", update, "<r><a>2</a></r>"))
+		tp.finish(t)
+
+		server := httptest.NewServer(requireToken("secret", newDiffHandler(tp.cache.store, false)))
+		defer server.Close()
+
+		request := func(token string, body string) *http.Response {
+			t.Helper()
+
+			req, _ := http.NewRequest(http.MethodPost, server.URL, strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer "+token)
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return res
+		}
+
+		post := func(body string) recordDiff {
+			t.Helper()
+
+			res := request("secret", body)
+			defer res.Body.Close()
+
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("expected the diff, got status %d", res.StatusCode)
+			}
+
+			var rd recordDiff
+			if err := json.NewDecoder(res.Body).Decode(&rd); err != nil {
+				t.Fatal(err)
+			}
+
+			return rd
+		}
+
+		rd := post(`{"attributes": {"id": "d1", "type": "xml", "source": "test", "operation": "update"}, "payload": "<r><a>3</a></r>"}`)
+		if rd.New == true || rd.Added != 1 || rd.Removed != 1 || strings.Contains(rd.Diff, "-    2\n+    3\n") == false {
+			t.Fatalf("expected the stored 2 to change to 3, got %+v", rd)
+		}
+
+		rd = post(`{"attributes": {"id": "d2", "type": "xml", "source": "test", "operation": "update"}, "payload": "<r/>"}`)
+		if rd.New == false || rd.Added != 2 {
+			t.Fatalf("expected a new record, got %+v", rd)
+		}
+
+		// without the token, or with too much, nothing is compared
+		if res := request("wrong", `{}`); res.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected a request without the token to be refused, got status %d", res.StatusCode)
+		}
+
+		huge := `{"attributes": {"id": "d1", "type": "xml", "source": "test", "operation": "update"}, "payload": "` + strings.Repeat("x", maxDiffRequestBytes) + `"}`
+		if res := request("secret", huge); res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected an oversized request to be refused, got status %d", res.StatusCode)
+		}
+	})
+}
+
+func TestHistory(t *testing.T) {
+	forEachStore(t, func(t *testing.T, cfg ServiceConfig) {
+		update := awssqs.AttributeValueRecordOperationUpdate
+
+		cfg.HistoryVersions = 2
+
+		tp := startTestPipeline(t, cfg)
+		for ix := 1; ix <= 4; ix++ {
+			tp.source.Put(testMessage("h1", update, fmt.Sprintf("<r><a>%d</a></r>", ix)))
+			tp.waitForDeletes(t, ix, 10*time.Second)
+		}
+
+		// the versions replaced are kept, up to the limit
+		versions, err := tp.cache.store.History("h1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) != 2 || string(versions[0].Payload) != "<r><a>3</a></r>" || string(versions[1].Payload) != "<r><a>2</a></r>" {
+			t.Fatalf("expected versions 3 and 2, got %d versions", len(versions))
+		}
+
+		rd, err := diffVersion(tp.cache.store, "h1", 2)
+		if err != nil || rd.Added != 1 || rd.Removed != 1 || strings.Contains(rd.Diff, "-    2\n+    4\n") == false {
+			t.Fatalf("expected version 2 to change to 4, got %+v (%v)", rd, err)
+		}
+
+		if _, err = diffVersion(tp.cache.store, "h1", 3); err == nil {
+			t.Fatalf("expected no third earlier version")
+		}
+
+		// a delete keeps the last version too
+		tp.source.Put(testMessage("h1", awssqs.AttributeValueRecordOperationDelete, ""))
+		tp.finish(t)
+
+		server := httptest.NewServer(requireToken("secret", newDiffHandler(tp.cache.store, false)))
+		defer server.Close()
+
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"?id=h1&version=1", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		var served recordDiff
+		if err = json.NewDecoder(res.Body).Decode(&served); err != nil {
+			t.Fatal(err)
+		}
+
+		if served.Deleted == false || served.Version != 1 || served.Removed != 5 {
+			t.Fatalf("expected the deleted version 4, got %+v", served)
+		}
+	})
+}
+
+func TestHistoryStaleReference(t *testing.T) {
+	forEachStore(t, func(t *testing.T, cfg ServiceConfig) {
+		update := awssqs.AttributeValueRecordOperationUpdate
+
+		// history without offloading, over a record left referring to an offloaded payload
+		cfg.HistoryVersions = 1
+
+		tp := startTestPipeline(t, cfg)
+		tp.source.Put(testMessage("s1", update, "<r>1</r>"))
+		tp.waitForDeletes(t, 1, 10*time.Second)
+
+		if _, err := storeHandle(tp.cache.store).NewQuery("UPDATE source_cache SET payload_ref = 'stale' WHERE id = 's1'").Execute(); err != nil {
+			t.Fatal(err)
+		}
+
+		// replacing it leaves the reference alone rather than removing it from nowhere
+		tp.source.Put(testMessage("s1", update, "<r>2</r>"))
+		tp.finish(t)
+
+		expectPayload(t, tp.cache.store, "s1", "<r>2</r>")
+	})
+}
+
+//
+// end of file
+//
@@ -3,9 +3,9 @@ package main
 import (
 	"log"
 	"os"
+	"strings"
 	"time"
 
-	"github.com/rs/xid"
 	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
 )
 
@@ -17,126 +17,74 @@ type cacheMessage struct {
 
 // main entry point
 func main() {
+	// with no command (or just flags), we serve
+	command := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 && strings.HasPrefix(args[0], "-") == false {
+		command = args[0]
+		args = args[1:]
+	}
+
+	switch command {
+	case "serve":
+		serve(args)
+	case "bench":
+		bench(args)
+	case "diff":
+		diffCommand(args)
+	case "config":
+		configCommand(args)
+	case "migrate":
+		migrateCommand(args)
+	case "partition":
+		partitionCommand(args)
+	case "purge":
+		purgeCommand(args)
+	case "recompress":
+		recompressCommand(args)
+	case "stats":
+		statsCommand(args)
+	default:
+		log.Fatalf("FATAL: unknown command [%s]; expected one of: serve, bench, config, diff, migrate, partition, purge, recompress, stats", command)
+	}
+}
+
+// serve runs the cache service
+func serve(args []string) {
 
 	log.Printf("===> %s service starting up (version: %s) <===", os.Args[0], Version())
 
 	// Get config params and use them to init service context. Any issues are fatal
-	cfg := LoadConfiguration()
-
-	log.Printf("[main] initializing SQS...")
-	// load our AWS_SQS helper object
-	v4sqs, err := awssqs.NewAwsSqs(awssqs.AwsSqsConfig{MessageBucketName: cfg.MessageBucketName})
-	if err != nil {
-		log.Fatal(err)
-	}
+	cfg := LoadConfiguration(args)
 
-	log.Printf("[main] getting queue handle...")
-	// get the queue handles from the queue name
-	inQueueHandle, err := v4sqs.QueueHandle(cfg.InQueueName)
+	log.Printf("[main] initializing %s message source...", cfg.InputMode)
+	// load our inbound message source
+	source, err := NewMessageSource(*cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	log.Printf("[main] starting deleters...")
-	// create the message deletion channel and start deleters
-	deleteChan := make(chan []cacheMessage, cfg.DeleteQueueSize)
-	for d := 1; d <= cfg.Deleters; d++ {
-		go deleter(d, *cfg, v4sqs, inQueueHandle, deleteChan)
-	}
+	secrets := newConfiguredSecretResolver(*cfg)
 
 	// goroutine specific instances did not change the performance
-	dbCache := NewDbCache(1, *cfg)
+	dbCache := NewDbCache(1, *cfg, secrets)
 
-	log.Printf("[main] starting workers...")
-	// create the message processing channel and start workers
-	processChan := make(chan cacheMessage, cfg.WorkerQueueSize)
-	for w := 1; w <= cfg.Workers; w++ {
-		go worker(w, *cfg, dbCache, processChan, deleteChan)
+	// refuse to run against a schema we don't expect
+	if err = prepareSchema(*cfg, dbCache.store); err != nil {
+		log.Fatalf("FATAL: %s", err.Error())
 	}
 
-	batch := newRate()
-	overall := newRate()
-
-	var batchID string
-
-	showBacklog := false
-
-	pollTimeout := time.Duration(cfg.PollTimeOut) * time.Second
-
-	log.Printf("[main] starting main polling loop...")
-
-	for {
-		if showBacklog == true {
-			processBacklog := len(processChan)
-			deleteBacklog := len(deleteChan)
-			if processBacklog > 0 || deleteBacklog > 0 {
-				log.Printf("[main] backlog: process = %d, delete = %d", len(processChan), len(deleteChan))
-			}
-			showBacklog = false
-		}
-
-		// wait for a batch of messages
-		messages, err := v4sqs.BatchMessageGet(inQueueHandle, awssqs.MAX_SQS_BLOCK_COUNT, pollTimeout)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		received := time.Now()
-
-		// did we receive any?
-		sz := len(messages)
-		if sz > 0 {
-			//log.Printf("[main] received %d messages", sz)
-
-			// tracking a new batch?  (groups of messages received close together)
-			if batch.count == 0 {
-				batch.setStart(received)
-
-				guid := xid.New()
-				batchID = guid.String()
-
-				log.Printf("[main] batch: [%s] tracking new batch", batchID)
-			}
-
-			for _, m := range messages {
-				c := cacheMessage{
-					message:  m,
-					received: received,
-					batchID:  batchID,
-				}
-
-				processChan <- c
-
-				batch.incrementCount()
-				overall.incrementCount()
-
-				// show batch totals periodically, along with overall timings
-				if batch.count%1000 == 0 {
-					log.Printf("[main] batch: [%s] queued %d messages (%0.2f mps)", batchID, batch.count, batch.getCurrentRate())
-				}
-
-				// show overall totals periodically.  timings don't really make sense here
-				if overall.count%1000 == 0 {
-					log.Printf("[main] overall: queued %d messages", overall.count)
-					showBacklog = true
-				}
-			}
-
-			batch.setStopNow()
-		} else {
-			// if the end of a batch, show totals and timing (if we haven't already)
-			if batch.count > 0 {
-				if batch.count%1000 != 0 {
-					log.Printf("[main] batch: [%s] queued %d messages (%0.2f mps)", batchID, batch.count, batch.getRate())
-				}
-				log.Printf("[main] overall: queued %d messages", overall.count)
-			}
-
-			log.Printf("[main] no messages received")
-			batch = newRate()
-			showBacklog = true
-		}
+	p := startPipeline(*cfg, source, dbCache)
+
+	if err = startHTTPServer(*cfg, secrets, dbCache, p.deliveries); err != nil {
+		log.Fatalf("FATAL: %s", err.Error())
 	}
+
+	p.pollMessages()
+
+	p.shutdown()
+
+	log.Printf("[main] terminating normally")
 }
 
 //
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// memorySource is a channel backed MessageSource, for tests and local development.  once closed and
+// drained it is exhausted and returns io.EOF
+type memorySource struct {
+	messages chan awssqs.Message // messages waiting to be received
+
+	sync.Mutex
+	inflight map[awssqs.ReceiptHandle]struct{} // received but not yet deleted
+	deleted  []awssqs.Message                  // successfully deleted messages, in delete order
+}
+
+// used to generate receipt handles, unique across sources like those of SQS
+var memoryHandles atomic.Int64
+
+// newMemorySource - the factory. size is the number of messages that can be waiting
+// before Put blocks
+func newMemorySource(size int) *memorySource {
+	m := memorySource{
+		messages: make(chan awssqs.Message, size),
+		inflight: make(map[awssqs.ReceiptHandle]struct{}),
+	}
+
+	return &m
+}
+
+// Put adds a message to the source, assigning it a receipt handle and (like SQS) a sent time
+func (m *memorySource) Put(msg awssqs.Message) {
+	msg.ReceiptHandle = awssqs.ReceiptHandle(fmt.Sprintf("memory-%d", memoryHandles.Add(1)))
+
+	if msg.FirstSent == 0 {
+		msg.FirstSent = uint64(time.Now().UnixMilli())
+	}
+
+	m.messages <- msg
+}
+
+// Close marks the end of the input; no more messages may be Put
+func (m *memorySource) Close() {
+	close(m.messages)
+}
+
+// Deleted returns a copy of the messages deleted so far
+func (m *memorySource) Deleted() []awssqs.Message {
+	m.Lock()
+	defer m.Unlock()
+
+	return append([]awssqs.Message{}, m.deleted...)
+}
+
+// Inflight returns the number of messages received but not yet deleted
+func (m *memorySource) Inflight() int {
+	m.Lock()
+	defer m.Unlock()
+
+	return len(m.inflight)
+}
+
+func (m *memorySource) ReceiveBatch(maxMessages uint, waitTime time.Duration) ([]awssqs.Message, error) {
+	if maxMessages > awssqs.MAX_SQS_BLOCK_COUNT {
+		return nil, awssqs.ErrBlockCountTooLarge
+	}
+
+	var messages []awssqs.Message
+
+	// wait for the first message; a short poll doesn't wait at all...
+	var first awssqs.Message
+	var ok bool
+
+	select {
+	case first, ok = <-m.messages:
+	default:
+		if waitTime <= 0 {
+			return messages, nil
+		}
+		select {
+		case first, ok = <-m.messages:
+		case <-time.After(waitTime):
+			return messages, nil
+		}
+	}
+
+	if ok == false {
+		return nil, io.EOF
+	}
+	messages = append(messages, first)
+
+	// ...then take whatever else is immediately available
+	for more := true; more == true && uint(len(messages)) < maxMessages; {
+		select {
+		case msg, ok := <-m.messages:
+			if ok == false {
+				more = false
+				break
+			}
+			messages = append(messages, msg)
+		default:
+			more = false
+		}
+	}
+
+	now := uint64(time.Now().UnixMilli())
+
+	m.Lock()
+	for ix := range messages {
+		if messages[ix].FirstReceived == 0 {
+			messages[ix].FirstReceived = now
+		}
+		m.inflight[messages[ix].ReceiptHandle] = struct{}{}
+	}
+	m.Unlock()
+
+	return messages, nil
+}
+
+func (m *memorySource) DeleteBatch(messages []awssqs.Message) ([]awssqs.OpStatus, error) {
+	if uint(len(messages)) > awssqs.MAX_SQS_BLOCK_COUNT {
+		return nil, awssqs.ErrBlockCountTooLarge
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	ops := make([]awssqs.OpStatus, len(messages))
+	var err error
+
+	for ix, msg := range messages {
+		if _, ok := m.inflight[msg.ReceiptHandle]; ok == false {
+			err = awssqs.ErrOneOrMoreOperationsUnsuccessful
+			continue
+		}
+
+		delete(m.inflight, msg.ReceiptHandle)
+		m.deleted = append(m.deleted, msg)
+		ops[ix] = true
+	}
+
+	return ops, err
+}
+
+//
+// end of file
+//
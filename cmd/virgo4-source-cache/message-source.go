@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// the supported message sources
+const (
+	inputSqs  = "sqs"
+	inputFile = "file"
+)
+
+// MessageSource is the narrow view of an inbound queue used by the polling loop and the deleters
+type MessageSource interface {
+
+	// ReceiveBatch gets up to maxMessages messages. Will return on receipt of any messages without
+	// waiting and will wait no longer than the wait time if no messages are available. Sources that
+	// can run dry return io.EOF once there are no more messages.
+	ReceiveBatch(maxMessages uint, waitTime time.Duration) ([]awssqs.Message, error)
+
+	// DeleteBatch deletes a block of previously received messages. In the event of one or more failures,
+	// the operation status array indicates which messages were deleted and which were not, and the
+	// error is awssqs.ErrOneOrMoreOperationsUnsuccessful
+	DeleteBatch(messages []awssqs.Message) ([]awssqs.OpStatus, error)
+}
+
+// VisibilityExtender is implemented by sources whose received messages are redelivered if they are not
+// deleted within a visibility timeout
+type VisibilityExtender interface {
+
+	// VisibilityTimeout returns how long received messages stay invisible
+	VisibilityTimeout() (time.Duration, error)
+
+	// ExtendVisibility keeps a block of previously received messages invisible for the timeout from now.
+	// failures are reported as with DeleteBatch
+	ExtendVisibility(messages []awssqs.Message, timeout time.Duration) ([]awssqs.OpStatus, error)
+}
+
+// NewMessageSource creates the configured inbound message source
+func NewMessageSource(cfg ServiceConfig) (MessageSource, error) {
+	switch cfg.InputMode {
+	case inputSqs:
+		names := parseQueueNames(cfg.InQueueName)
+		if len(names) == 1 {
+			return newSqsSource(cfg, names[0])
+		}
+
+		weights, err := parseQueueWeights(cfg.InQueueWeights, len(names))
+		if err != nil {
+			return nil, err
+		}
+
+		sources := make([]MessageSource, 0, len(names))
+		for _, name := range names {
+			source, err := newSqsSource(cfg, name)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			sources = append(sources, source)
+		}
+
+		return newQueueSet(names, sources, weights), nil
+	case inputFile:
+		return newFileSource(cfg)
+	}
+
+	return nil, fmt.Errorf("unsupported input mode: [%s]", cfg.InputMode)
+}
+
+// sqsSource is the MessageSource backed by an SQS queue
+type sqsSource struct {
+	aws   awssqs.AWS_SQS     // the SQS helper object
+	queue awssqs.QueueHandle // the inbound queue handle
+	svc   *sqs.SQS           // for what the helper doesn't do
+}
+
+// newSqsSource - the factory
+func newSqsSource(cfg ServiceConfig, queueName string) (*sqsSource, error) {
+	// load our AWS_SQS helper object
+	aws, err := awssqs.NewAwsSqs(awssqs.AwsSqsConfig{MessageBucketName: cfg.MessageBucketName})
+	if err != nil {
+		return nil, err
+	}
+
+	// get the queue handle from the queue name
+	queue, err := aws.QueueHandle(queueName)
+	if err != nil {
+		return nil, err
+	}
+
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	s := sqsSource{
+		aws:   aws,
+		queue: queue,
+		svc:   sqs.New(sess),
+	}
+
+	return &s, nil
+}
+
+func (s *sqsSource) ReceiveBatch(maxMessages uint, waitTime time.Duration) ([]awssqs.Message, error) {
+	return s.aws.BatchMessageGet(s.queue, maxMessages, waitTime)
+}
+
+func (s *sqsSource) DeleteBatch(messages []awssqs.Message) ([]awssqs.OpStatus, error) {
+	return s.aws.BatchMessageDelete(s.queue, messages)
+}
+
+func (s *sqsSource) VisibilityTimeout() (time.Duration, error) {
+	res, err := s.svc.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(string(s.queue)),
+		AttributeNames: []*string{aws.String(sqs.QueueAttributeNameVisibilityTimeout)},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	seconds, err := strconv.Atoi(aws.StringValue(res.Attributes[sqs.QueueAttributeNameVisibilityTimeout]))
+	if err != nil {
+		return 0, fmt.Errorf("queue visibility timeout: %w", err)
+	}
+
+	return time.Duration(seconds) * time.Second, nil
+}
+
+func (s *sqsSource) ExtendVisibility(messages []awssqs.Message, timeout time.Duration) ([]awssqs.OpStatus, error) {
+	if uint(len(messages)) > awssqs.MAX_SQS_BLOCK_COUNT {
+		return nil, awssqs.ErrBlockCountTooLarge
+	}
+
+	entries := make([]*sqs.ChangeMessageVisibilityBatchRequestEntry, 0, len(messages))
+	for ix := range messages {
+		entries = append(entries, &sqs.ChangeMessageVisibilityBatchRequestEntry{
+			Id:                aws.String(strconv.Itoa(ix)),
+			ReceiptHandle:     aws.String(string(messages[ix].GetReceiptHandle())),
+			VisibilityTimeout: aws.Int64(int64(timeout.Seconds())),
+		})
+	}
+
+	res, err := s.svc.ChangeMessageVisibilityBatch(&sqs.ChangeMessageVisibilityBatchInput{
+		QueueUrl: aws.String(string(s.queue)),
+		Entries:  entries,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ops := make([]awssqs.OpStatus, len(messages))
+	for _, ok := range res.Successful {
+		if ix, err := strconv.Atoi(aws.StringValue(ok.Id)); err == nil && ix < len(ops) {
+			ops[ix] = true
+		}
+	}
+
+	if len(res.Failed) > 0 {
+		return ops, awssqs.ErrOneOrMoreOperationsUnsuccessful
+	}
+
+	return ops, nil
+}
+
+//
+// end of file
+//
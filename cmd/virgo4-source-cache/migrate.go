@@ -0,0 +1,597 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"github.com/uvalib/virgo4-source-cache/db/migrations"
+)
+
+//
+// the postgres schema is managed by the migrations embedded from db/migrations. the version is recorded
+// in the same schema_migrations table as the golang-migrate tool previously used, so existing databases
+// carry on from where they are. the migrations are written for source_cache; the columns added since
+// are also added to the other cache tables (a different PostgresTable, routed tables), which can come
+// and go with the configuration
+//
+
+// the table recording the schema version
+const schemaTable = "schema_migrations"
+
+// every migration step takes this lock, so concurrent migrators can't interleave
+const schemaLockID = 7410461305716023297
+
+var migrationName = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// the columns added to source_cache by migrations 000005 on, which every cache table needs
+var migratedColumns = []struct{ name, definition string }{
+	{"payload_data", "BYTEA"},
+	{"payload_codec", "VARCHAR(16) NOT NULL DEFAULT ''"},
+	{"payload_ref", "VARCHAR(1024) NOT NULL DEFAULT ''"},
+	{"expires_at", "timestamptz"},
+}
+
+// the indexes added to source_cache by migrations 000008 and 000011
+var migratedIndexQueries = []string{`
+CREATE INDEX IF NOT EXISTS {:table}_expires_idx ON {:table}(expires_at) WHERE expires_at IS NOT NULL
+`, `
+CREATE INDEX IF NOT EXISTS {:table}_updated_idx ON {:table}(updated_at)
+`}
+
+// as for source_cache_quarantine in 000007
+var migrateQuarantineQueries = []string{`
+CREATE TABLE IF NOT EXISTS {:table} (
+	seq         BIGSERIAL PRIMARY KEY,
+	id          VARCHAR(256) NOT NULL,
+	type        VARCHAR(32) NOT NULL,
+	source      VARCHAR(32) NOT NULL,
+	payload     BYTEA NOT NULL,
+	reason      TEXT NOT NULL,
+	received_at timestamptz NOT NULL DEFAULT NOW()
+)`, `
+CREATE INDEX IF NOT EXISTS {:table}_id_idx ON {:table}(id)
+`}
+
+// as for source_cache_history in 000010
+var migrateHistoryQueries = []string{`
+CREATE TABLE IF NOT EXISTS {:table} (
+	seq           BIGSERIAL PRIMARY KEY,
+	id            VARCHAR(256) NOT NULL,
+	type          VARCHAR(32) NOT NULL,
+	source        VARCHAR(32) NOT NULL,
+	payload       TEXT NOT NULL,
+	payload_data  BYTEA,
+	payload_codec VARCHAR(16) NOT NULL DEFAULT '',
+	updated_at    timestamptz NOT NULL,
+	replaced_at   timestamptz NOT NULL DEFAULT NOW()
+)`, `
+CREATE INDEX IF NOT EXISTS {:table}_id_idx ON {:table}(id, seq)
+`}
+
+const tableColumnsQuery = `
+SELECT
+	column_name
+FROM
+	information_schema.columns
+WHERE
+	table_schema = current_schema() AND table_name = {:table}
+`
+
+// migration is a single schema version
+type migration struct {
+	version uint64
+	title   string
+	up      string
+	down    string
+}
+
+// migrator applies the schema migrations to a postgres database
+type migrator struct {
+	handle     *dbx.DB
+	migrations []migration // in version order
+}
+
+// schemaVersion is the recorded state of the schema; version 0 means nothing is applied
+type schemaVersion struct {
+	Version uint64 `db:"version"`
+	Dirty   bool   `db:"dirty"`
+}
+
+// loadMigrations reads the up and down migrations from the file system
+func loadMigrations(fsys fs.FS) ([]migration, error) {
+	files, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[uint64]*migration)
+	fileCount := make(map[uint64]int)
+
+	for _, f := range files {
+		parts := migrationName.FindStringSubmatch(f)
+		if parts == nil {
+			return nil, fmt.Errorf("badly named migration: %s", f)
+		}
+
+		version, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil || version == 0 {
+			return nil, fmt.Errorf("bad migration version: %s", f)
+		}
+
+		contents, err := fs.ReadFile(fsys, f)
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{version: version, title: parts[2]}
+			byVersion[version] = m
+		}
+
+		if parts[2] != m.title {
+			return nil, fmt.Errorf("migration %d has more than one title: %s, %s", version, m.title, parts[2])
+		}
+
+		fileCount[version]++
+
+		if parts[3] == "up" {
+			m.up = string(contents)
+		} else {
+			m.down = string(contents)
+		}
+	}
+
+	var list []migration
+	for _, m := range byVersion {
+		// either may be empty, but both must be there
+		if fileCount[m.version] != 2 {
+			return nil, fmt.Errorf("migration %d must have both up and down files", m.version)
+		}
+		list = append(list, *m)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].version < list[j].version })
+
+	return list, nil
+}
+
+// newMigrator - the factory
+func newMigrator(handle *dbx.DB) (*migrator, error) {
+	list, err := loadMigrations(migrations.Files)
+	if err != nil {
+		return nil, err
+	}
+
+	m := migrator{handle: handle, migrations: list}
+
+	_, err = handle.NewQuery("CREATE TABLE IF NOT EXISTS " + schemaTable + " (version bigint NOT NULL PRIMARY KEY, dirty boolean NOT NULL)").Execute()
+	if err != nil {
+		return nil, fmt.Errorf("creating %s: %w", schemaTable, err)
+	}
+
+	return &m, nil
+}
+
+// latest is the schema version this build expects
+func (m *migrator) latest() uint64 {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+
+	return m.migrations[len(m.migrations)-1].version
+}
+
+// index returns the position of a version in the migrations, or -1 if it is unknown
+func (m *migrator) index(version uint64) int {
+	for ix, mg := range m.migrations {
+		if mg.version == version {
+			return ix
+		}
+	}
+
+	return -1
+}
+
+// Version returns the current schema version
+func (m *migrator) Version() (schemaVersion, error) {
+	return readSchemaVersion(m.handle)
+}
+
+func readSchemaVersion(b dbx.Builder) (schemaVersion, error) {
+	var v schemaVersion
+
+	err := b.NewQuery("SELECT version, dirty FROM " + schemaTable + " LIMIT 1").One(&v)
+	if errors.Is(err, sql.ErrNoRows) {
+		return schemaVersion{}, nil
+	}
+
+	return v, err
+}
+
+func writeSchemaVersion(b dbx.Builder, version uint64) error {
+	if _, err := b.NewQuery("DELETE FROM " + schemaTable).Execute(); err != nil {
+		return err
+	}
+
+	if version == 0 {
+		return nil
+	}
+
+	_, err := b.NewQuery("INSERT INTO " + schemaTable + " (version, dirty) VALUES ({:version}, false)").
+		Bind(dbx.Params{"version": version}).Execute()
+
+	return err
+}
+
+// step applies a single migration up or down in a transaction, so a failure leaves the schema as it was
+func (m *migrator) step(up bool) (bool, error) {
+	done := false
+
+	err := m.handle.Transactional(func(tx *dbx.Tx) error {
+		if _, err := tx.NewQuery(fmt.Sprintf("SELECT pg_advisory_xact_lock(%d)", int64(schemaLockID))).Execute(); err != nil {
+			return err
+		}
+
+		// read the version under the lock, another migrator may have moved it on
+		current, err := readSchemaVersion(tx)
+		if err != nil {
+			return err
+		}
+
+		if current.Dirty == true {
+			return fmt.Errorf("schema version %d is dirty; repair it by hand then use migrate force", current.Version)
+		}
+
+		ix := -1
+		if current.Version != 0 {
+			if ix = m.index(current.Version); ix < 0 {
+				return fmt.Errorf("schema version %d is unknown to this build", current.Version)
+			}
+		}
+
+		var query string
+		var target uint64
+
+		if up == true {
+			if ix+1 >= len(m.migrations) {
+				return nil
+			}
+
+			mg := m.migrations[ix+1]
+			query, target = mg.up, mg.version
+			log.Printf("[migrate] applying %d_%s", mg.version, mg.title)
+		} else {
+			if ix < 0 {
+				return nil
+			}
+
+			mg := m.migrations[ix]
+			query = mg.down
+			if ix > 0 {
+				target = m.migrations[ix-1].version
+			}
+			log.Printf("[migrate] reverting %d_%s", mg.version, mg.title)
+		}
+
+		if strings.TrimSpace(query) != "" {
+			if _, err = tx.NewQuery(query).Execute(); err != nil {
+				return err
+			}
+		}
+
+		if err = writeSchemaVersion(tx, target); err != nil {
+			return err
+		}
+
+		done = true
+		return nil
+	})
+
+	return done, err
+}
+
+// Up applies up to limit pending migrations (all of them if limit is 0), returning how many were applied
+func (m *migrator) Up(limit int) (int, error) {
+	count := 0
+
+	for limit == 0 || count < limit {
+		done, err := m.step(true)
+		if err != nil || done == false {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// Down reverts up to limit migrations, returning how many were reverted
+func (m *migrator) Down(limit int) (int, error) {
+	count := 0
+
+	for count < limit {
+		done, err := m.step(false)
+		if err != nil || done == false {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// Force records the schema version without running anything, clearing the dirty flag
+func (m *migrator) Force(version uint64) error {
+	if version != 0 && m.index(version) < 0 {
+		return fmt.Errorf("unknown schema version %d", version)
+	}
+
+	return m.handle.Transactional(func(tx *dbx.Tx) error {
+		return writeSchemaVersion(tx, version)
+	})
+}
+
+// Check reports an error unless the schema is at the version this build expects
+func (m *migrator) Check() error {
+	current, err := m.Version()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case current.Dirty == true:
+		return fmt.Errorf("schema version %d is dirty", current.Version)
+	case current.Version < m.latest():
+		return fmt.Errorf("schema version %d is behind the expected version %d; run migrate up", current.Version, m.latest())
+	case current.Version > m.latest():
+		return fmt.Errorf("schema version %d is newer than the expected version %d; this build is too old", current.Version, m.latest())
+	}
+
+	return nil
+}
+
+// UpTables adds the migrated columns and indexes (and the quarantine and history tables) to cache tables without them
+func (m *migrator) UpTables(router *cacheRouter) error {
+	return m.handle.Transactional(func(tx *dbx.Tx) error {
+		if _, err := tx.NewQuery(fmt.Sprintf("SELECT pg_advisory_xact_lock(%d)", int64(schemaLockID))).Execute(); err != nil {
+			return err
+		}
+
+		for _, table := range router.tables() {
+			for _, column := range migratedColumns {
+				query := fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s", table, column.name, column.definition)
+				if _, err := tx.NewQuery(query).Execute(); err != nil {
+					return fmt.Errorf("%s: %w", table, err)
+				}
+			}
+
+			for _, query := range migratedIndexQueries {
+				if _, err := tx.NewQuery(cleanQuery(query, table)).Execute(); err != nil {
+					return fmt.Errorf("%s: %w", table, err)
+				}
+			}
+		}
+
+		// records are quarantined, and their history kept, beside the default table
+		for _, side := range []struct {
+			table   string
+			queries []string
+		}{
+			{router.defaultTable + quarantineSuffix, migrateQuarantineQueries},
+			{router.defaultTable + historySuffix, migrateHistoryQueries},
+		} {
+			for _, query := range side.queries {
+				if _, err := tx.NewQuery(cleanQuery(query, side.table)).Execute(); err != nil {
+					return fmt.Errorf("%s: %w", side.table, err)
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// CheckTables reports an error unless every cache table (and the quarantine and history tables) is up to date
+func (m *migrator) CheckTables(router *cacheRouter) error {
+	tables := append(router.tables(), router.defaultTable+quarantineSuffix, router.defaultTable+historySuffix)
+
+	for _, table := range tables {
+		var columns []string
+		if err := m.handle.NewQuery(tableColumnsQuery).Bind(dbx.Params{"table": table}).Column(&columns); err != nil {
+			return err
+		}
+
+		if len(columns) == 0 {
+			return fmt.Errorf("table %s does not exist; run migrate up", table)
+		}
+
+		if table == router.defaultTable+quarantineSuffix || table == router.defaultTable+historySuffix {
+			continue
+		}
+
+		var missing []string
+		for _, column := range migratedColumns {
+			if slices.Contains(columns, column.name) == false {
+				missing = append(missing, column.name)
+			}
+		}
+
+		if len(missing) > 0 {
+			return fmt.Errorf("table %s is missing column(s) %s; run migrate up", table, strings.Join(missing, ", "))
+		}
+	}
+
+	return nil
+}
+
+// prepareSchema makes sure the cache schema is what this build expects before serving, applying
+// pending migrations first if configured to. The sqlite store manages its own schema
+func prepareSchema(cfg ServiceConfig, store CacheStore) error {
+	s, ok := store.(*postgresStore)
+	if ok == false {
+		return nil
+	}
+
+	m, err := newMigrator(s.handle)
+	if err != nil {
+		return err
+	}
+
+	if cfg.PostgresMigrate == true {
+		count, err := m.Up(0)
+		if err != nil {
+			return fmt.Errorf("applying migrations: %w", err)
+		}
+		log.Printf("[migrate] applied %d migration(s)", count)
+
+		if err = m.UpTables(s.router); err != nil {
+			return fmt.Errorf("migrating tables: %w", err)
+		}
+	}
+
+	if err = m.Check(); err != nil {
+		return err
+	}
+
+	if err = m.CheckTables(s.router); err != nil {
+		return err
+	}
+
+	log.Printf("[migrate] schema version %d", m.latest())
+
+	return nil
+}
+
+// migrateCommand implements the migrate subcommand
+func migrateCommand(args []string) {
+	usage := "FATAL: usage: migrate up [n] | down [n] | status | force <version> [flags]"
+
+	if len(args) == 0 {
+		log.Fatal(usage)
+	}
+
+	action := args[0]
+	args = args[1:]
+
+	// the optional count or version precedes the flags
+	count := -1
+	if len(args) > 0 && strings.HasPrefix(args[0], "-") == false {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			log.Fatal(usage)
+		}
+		count = n
+		args = args[1:]
+	}
+
+	cfg := loadStoreCommandConfiguration("migrate "+action, args)
+	if cfg.CacheStore != storePostgres {
+		log.Fatalf("FATAL: migrations only apply to the %s store; the %s store creates its own schema", storePostgres, cfg.CacheStore)
+	}
+
+	store, err := newPostgresStore(*cfg, newConfiguredSecretResolver(*cfg))
+	if err != nil {
+		log.Fatalf("FATAL: %s", err.Error())
+	}
+	defer store.Close()
+
+	m, err := newMigrator(store.handle)
+	if err != nil {
+		log.Fatalf("FATAL: %s", err.Error())
+	}
+
+	switch action {
+	case "up":
+		if count < 0 {
+			count = 0
+		}
+		var applied int
+		applied, err = m.Up(count)
+		log.Printf("[migrate] applied %d migration(s)", applied)
+
+		// the tables only once the schema is fully up to date
+		if err == nil && m.Check() == nil {
+			err = m.UpTables(store.router)
+		}
+
+	case "down":
+		if count < 0 {
+			count = 1
+		}
+		var reverted int
+		reverted, err = m.Down(count)
+		log.Printf("[migrate] reverted %d migration(s)", reverted)
+
+	case "force":
+		if count < 0 {
+			log.Fatal(usage)
+		}
+		err = m.Force(uint64(count))
+
+	case "status":
+		if count >= 0 {
+			log.Fatal(usage)
+		}
+		err = migrateStatus(m)
+
+	default:
+		log.Fatal(usage)
+	}
+
+	if err != nil {
+		log.Fatalf("FATAL: %s", err.Error())
+	}
+}
+
+func migrateStatus(m *migrator) error {
+	current, err := m.Version()
+	if err != nil {
+		return err
+	}
+
+	dirty := ""
+	if current.Dirty == true {
+		dirty = " (dirty)"
+	}
+
+	fmt.Printf("schema version: %d%s, expected: %d\n", current.Version, dirty, m.latest())
+
+	for _, mg := range m.migrations {
+		state := "pending"
+		if mg.version <= current.Version {
+			state = "applied"
+		}
+		fmt.Printf("  %06d_%-24s %s\n", mg.version, mg.title, state)
+	}
+
+	// tables converted since (see partition convert), once there is somewhere to record them
+	var recorded bool
+	if err = m.handle.NewQuery("SELECT to_regclass('schema_conversions') IS NOT NULL").Row(&recorded); err != nil || recorded == false {
+		return err
+	}
+
+	var conversions []tableConversion
+	if err = m.handle.NewQuery("SELECT table_name, conversion, schema_version, state, copied_after FROM schema_conversions ORDER BY table_name").All(&conversions); err != nil {
+		return err
+	}
+
+	for _, c := range conversions {
+		fmt.Printf("  %-31s %s at version %d: %s\n", c.Table, c.Conversion, c.SchemaVersion, c.State)
+	}
+
+	return nil
+}
+
+//
+// end of file
+//
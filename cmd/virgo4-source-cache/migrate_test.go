@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/uvalib/virgo4-source-cache/db/migrations"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	list, err := loadMigrations(migrations.Files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list) == 0 {
+		t.Fatal("no migrations embedded")
+	}
+
+	for ix, m := range list {
+		if m.version != uint64(ix+1) {
+			t.Errorf("expected version %d, got %d (%s)", ix+1, m.version, m.title)
+		}
+	}
+}
+
+func TestBadMigrations(t *testing.T) {
+	for name, fsys := range map[string]fstest.MapFS{
+		"missing down": {
+			"000001_one.up.sql": {Data: []byte("SELECT 1")},
+		},
+		"bad name": {
+			"one.up.sql":   {Data: []byte("SELECT 1")},
+			"one.down.sql": {Data: []byte("SELECT 1")},
+		},
+		"mismatched titles": {
+			"000001_one.up.sql":   {Data: []byte("SELECT 1")},
+			"000001_two.down.sql": {Data: []byte("SELECT 1")},
+		},
+	} {
+		if _, err := loadMigrations(fsys); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/rs/xid"
+)
+
+//
+// payloads larger than OffloadThreshold are written to an object store instead of the cache table,
+// and the row records a reference to the object (payload_ref). objects are never overwritten; each
+// write gets a new key and the object it replaces is removed once the transaction has committed
+//
+
+// ObjectStore holds offloaded payloads
+type ObjectStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+}
+
+// NewObjectStore creates the object store for the location: s3://bucket/prefix or file:///directory
+func NewObjectStore(location string) (ObjectStore, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("missing bucket in [%s]", location)
+		}
+		return newS3ObjectStore(u.Host, strings.Trim(u.Path, "/"))
+
+	case "file":
+		if u.Path == "" {
+			return nil, fmt.Errorf("missing directory in [%s]", location)
+		}
+		return newFileObjectStore(u.Path), nil
+	}
+
+	return nil, fmt.Errorf("offload location must be s3://bucket/prefix or file:///directory (is [%s])", location)
+}
+
+// objectKey returns a new key for a payload of the record
+func objectKey(table string, id string) string {
+	return table + "/" + url.PathEscape(id) + "/" + xid.New().String()
+}
+
+// s3ObjectStore keeps objects in an S3 bucket
+type s3ObjectStore struct {
+	svc    *s3.S3
+	bucket string
+	prefix string
+}
+
+// newS3ObjectStore - the factory
+func newS3ObjectStore(bucket string, prefix string) (*s3ObjectStore, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	return &s3ObjectStore{svc: s3.New(sess), bucket: bucket, prefix: prefix}, nil
+}
+
+func (s *s3ObjectStore) Put(key string, data []byte) error {
+	_, err := s.svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.prefix + key),
+		Body:   bytes.NewReader(data),
+	})
+
+	return err
+}
+
+func (s *s3ObjectStore) Get(key string) ([]byte, error) {
+	out, err := s.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.prefix + key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+
+	return io.ReadAll(out.Body)
+}
+
+func (s *s3ObjectStore) Delete(key string) error {
+	// deleting a missing object is not an error in S3
+	_, err := s.svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.prefix + key),
+	})
+
+	return err
+}
+
+// fileObjectStore keeps objects in a local directory; a stand-in for S3 in development and testing
+type fileObjectStore struct {
+	root string
+}
+
+// newFileObjectStore - the factory
+func newFileObjectStore(root string) *fileObjectStore {
+	return &fileObjectStore{root: root}
+}
+
+func (s *fileObjectStore) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+func (s *fileObjectStore) Put(key string, data []byte) error {
+	path := s.path(key)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// readers never see a partial object
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func (s *fileObjectStore) Get(key string) ([]byte, error) {
+	return os.ReadFile(s.path(key))
+}
+
+func (s *fileObjectStore) Delete(key string) error {
+	path := s.path(key)
+
+	err := os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	// tidy up the record directory once it is empty; failure just means it isn't
+	os.Remove(filepath.Dir(path))
+
+	return err
+}
+
+//
+// end of file
+//
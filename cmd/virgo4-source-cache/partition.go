@@ -0,0 +1,591 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"github.com/lib/pq"
+)
+
+//
+// as an alternative to routing sources to their own tables, the postgres cache table can be list
+// partitioned by source: a partition per source plus a default partition for the rest. the partition
+// key has to be part of the primary key, which becomes (id, source); the store notices this and
+// upserts on that key instead, first removing the id from any other source so that ids stay unique.
+// retiring a source is then a detach (and drop) of its partition rather than a mass delete
+//
+
+// the suffix for the default partition, and for the original table once converted
+const (
+	partitionDefaultSuffix     = "_default"
+	partitionUnconvertedSuffix = "_unpartitioned"
+)
+
+// characters that can't appear in a partition name
+var partitionNameInvalid = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// postgres truncates longer identifiers
+const maxIdentifierLength = 63
+
+// partitionInfo describes a partition of the cache table
+type partitionInfo struct {
+	Name  string `db:"name"`
+	Bound string `db:"bound"`
+	Rows  int64  `db:"rows"`
+}
+
+const partitionListQuery = `
+SELECT
+	c.relname AS name, pg_get_expr(c.relpartbound, c.oid) AS bound, c.reltuples::bigint AS rows
+FROM
+	pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid
+WHERE
+	i.inhparent = to_regclass({:relation})
+ORDER BY
+	c.relname
+`
+
+// the columns of the table's primary key
+const primaryKeyQuery = `
+SELECT
+	a.attname
+FROM
+	pg_index i JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+WHERE
+	i.indrelid = to_regclass({:relation}) AND i.indisprimary
+`
+
+// the table storage settings (autovacuum, etc), as a comma separated list
+const tableOptionsQuery = `
+SELECT
+	COALESCE(array_to_string(reloptions, ', '), '')
+FROM
+	pg_class
+WHERE
+	oid = to_regclass({:relation})
+`
+
+// partitionName returns the name of the partition for a source
+func partitionName(table string, source string) (string, error) {
+	name := table + "_" + strings.Trim(partitionNameInvalid.ReplaceAllString(strings.ToLower(source), "_"), "_")
+
+	if len(name) > maxIdentifierLength || strings.HasSuffix(name, "_") {
+		return "", fmt.Errorf("cannot make a partition name for source [%s]; use -name", source)
+	}
+
+	return name, nil
+}
+
+// keyIncludesSource reports whether the primary key of the table includes the source, as it must
+// when the table is partitioned by source
+func keyIncludesSource(b dbx.Builder, table string) (bool, error) {
+	var columns []string
+
+	if err := b.NewQuery(primaryKeyQuery).Bind(dbx.Params{"relation": table}).Column(&columns); err != nil {
+		return false, err
+	}
+
+	for _, c := range columns {
+		if c == "source" {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// tableOptions returns the storage settings of a table, for copying to its partitions
+func tableOptions(b dbx.Builder, table string) (string, error) {
+	var options string
+
+	err := b.NewQuery(tableOptionsQuery).Bind(dbx.Params{"relation": table}).Row(&options)
+
+	return options, err
+}
+
+func execute(b dbx.Builder, queries ...string) error {
+	for _, q := range queries {
+		if _, err := b.NewQuery(q).Execute(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// listPartitions returns the partitions of the table
+func listPartitions(b dbx.Builder, table string) ([]partitionInfo, error) {
+	var partitions []partitionInfo
+
+	err := b.NewQuery(partitionListQuery).Bind(dbx.Params{"relation": table}).All(&partitions)
+
+	return partitions, err
+}
+
+// the conversion recorded in schema_conversions
+const conversionPartitionBySource = "partition_by_source"
+
+// the states of a conversion
+const (
+	conversionCopying = "copying"
+	conversionDone    = "done"
+)
+
+// the ids changed while the table is copied are logged by a trigger, then copied again
+var convertLogQueries = []string{`
+CREATE TABLE {:log} (id VARCHAR(256) PRIMARY KEY)
+`, `
+CREATE FUNCTION {:log}() RETURNS trigger AS $$
+BEGIN
+	INSERT INTO {:log} (id) VALUES (CASE WHEN TG_OP = 'DELETE' THEN OLD.id ELSE NEW.id END) ON CONFLICT DO NOTHING;
+	RETURN NULL;
+END
+$$ LANGUAGE plpgsql
+`, `
+CREATE TRIGGER {:log} AFTER INSERT OR UPDATE OR DELETE ON {:table} FOR EACH ROW EXECUTE FUNCTION {:log}()
+`}
+
+// the last id of the next chunk to copy
+const convertChunkQuery = `
+SELECT
+	MAX(id)
+FROM
+	(SELECT id FROM {:table} WHERE id > {:after} ORDER BY id LIMIT {:limit}) chunk
+`
+
+const convertCopyQuery = `
+INSERT INTO {:next} SELECT * FROM {:table} WHERE id > {:after} AND id <= {:last}
+`
+
+// takes (some of) the logged ids
+const convertTakeLogQuery = `
+DELETE FROM {:log} WHERE id IN (SELECT id FROM {:log} ORDER BY id{:limit}) RETURNING id
+`
+
+const conversionQuery = `
+SELECT
+	table_name, conversion, schema_version, state, copied_after
+FROM
+	schema_conversions
+WHERE
+	table_name = {:table}
+`
+
+const conversionStartQuery = `
+INSERT INTO schema_conversions (table_name, conversion, schema_version, state) VALUES ({:table}, {:conversion}, {:version}, {:state})
+`
+
+const conversionProgressQuery = `
+UPDATE schema_conversions SET copied_after = {:after} WHERE table_name = {:table}
+`
+
+const conversionDoneQuery = `
+UPDATE schema_conversions SET state = {:state}, finished_at = NOW() WHERE table_name = {:table}
+`
+
+// tableConversion is the progress of a conversion, as recorded in schema_conversions
+type tableConversion struct {
+	Table         string `db:"table_name"`
+	Conversion    string `db:"conversion"`
+	SchemaVersion uint64 `db:"schema_version"`
+	State         string `db:"state"`
+	CopiedAfter   string `db:"copied_after"`
+}
+
+// partitionConverter replaces a table with a copy partitioned by source, without stopping the service.
+// the rows are copied a chunk at a time while a trigger logs the ids changed in the meantime; those are
+// copied again until few are left, and the last of them under a brief lock while the tables are swapped.
+// progress is recorded in schema_conversions, so an interrupted conversion carries on where it stopped.
+// a running service finds out on its first upsert after the swap, which fails on the old key; it then
+// detects the keys again and writes the batch once more
+type partitionConverter struct {
+	db        *dbx.DB
+	table     string
+	next      string // the partitioned copy
+	log       string // the changed ids
+	chunkSize int
+}
+
+// newPartitionConverter - the factory
+func newPartitionConverter(db *dbx.DB, table string, chunkSize int) *partitionConverter {
+	return &partitionConverter{
+		db:        db,
+		table:     table,
+		next:      table + "_partitioned",
+		log:       table + "_convert_log",
+		chunkSize: chunkSize,
+	}
+}
+
+// query fills in the table names of a query
+func (c *partitionConverter) query(query string) string {
+	return strings.NewReplacer("{:next}", c.next, "{:log}", c.log).Replace(cleanQuery(query, c.table))
+}
+
+// convertToPartitioned converts the table, keeping the original (renamed) unless dropOld is set
+func convertToPartitioned(db *dbx.DB, table string, chunkSize int, dropOld bool) error {
+	c := newPartitionConverter(db, table, chunkSize)
+
+	// the conversion is recorded against the schema version, which must be current
+	m, err := newMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	if err = m.Check(); err != nil {
+		return err
+	}
+
+	var conversion tableConversion
+	err = db.NewQuery(conversionQuery).Bind(dbx.Params{"table": table}).One(&conversion)
+
+	switch {
+	case err == sql.ErrNoRows:
+		if err = c.start(m.latest()); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case conversion.Conversion != conversionPartitionBySource || conversion.State == conversionDone:
+		return fmt.Errorf("%s has already been converted (%s, %s)", table, conversion.Conversion, conversion.State)
+	default:
+		log.Printf("[partition] resuming the conversion of %s after id [%s]", table, conversion.CopiedAfter)
+	}
+
+	if err = c.copy(conversion.CopiedAfter); err != nil {
+		return err
+	}
+
+	// catch up with the changes made while copying, until there are few enough to finish under the lock
+	for {
+		var replayed int
+		err = db.Transactional(func(tx *dbx.Tx) error {
+			replayed, err = c.replay(tx, c.chunkSize)
+			return err
+		})
+
+		if err != nil {
+			return err
+		}
+
+		if replayed < c.chunkSize {
+			break
+		}
+	}
+
+	return c.swap(dropOld)
+}
+
+// start creates the partitioned copy of the table and starts logging changes to the table
+func (c *partitionConverter) start(version uint64) error {
+	return c.db.Transactional(func(tx *dbx.Tx) error {
+		partitioned, err := keyIncludesSource(tx, c.table)
+		if err != nil {
+			return err
+		}
+		if partitioned == true {
+			return fmt.Errorf("%s is already partitioned", c.table)
+		}
+
+		options, err := tableOptions(tx, c.table)
+		if err != nil {
+			return err
+		}
+
+		var sources []string
+		if err = tx.NewQuery("SELECT DISTINCT source FROM " + c.table + " ORDER BY source").Column(&sources); err != nil {
+			return err
+		}
+
+		err = execute(tx,
+			"CREATE TABLE "+c.next+" (LIKE "+c.table+" INCLUDING DEFAULTS INCLUDING STORAGE, PRIMARY KEY (id, source)) PARTITION BY LIST (source)",
+			"CREATE INDEX ON "+c.next+" (source)",
+			"CREATE INDEX ON "+c.next+" (expires_at) WHERE expires_at IS NOT NULL",
+			"CREATE TABLE "+c.table+partitionDefaultSuffix+" PARTITION OF "+c.next+" DEFAULT")
+		if err != nil {
+			return err
+		}
+
+		partitions := []string{c.table + partitionDefaultSuffix}
+
+		for _, source := range sources {
+			name, err := partitionName(c.table, source)
+			if err != nil {
+				return err
+			}
+
+			log.Printf("[partition] creating partition %s for source [%s]", name, source)
+
+			if err = execute(tx, "CREATE TABLE "+name+" PARTITION OF "+c.next+" FOR VALUES IN ("+pq.QuoteLiteral(source)+")"); err != nil {
+				return err
+			}
+
+			partitions = append(partitions, name)
+		}
+
+		// the parent has no storage of its own; the settings apply to each partition
+		if options != "" {
+			for _, p := range partitions {
+				if err = execute(tx, "ALTER TABLE "+p+" SET ("+options+")"); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, q := range convertLogQueries {
+			if err = execute(tx, c.query(q)); err != nil {
+				return err
+			}
+		}
+
+		params := dbx.Params{"table": c.table, "conversion": conversionPartitionBySource, "version": version, "state": conversionCopying}
+		_, err = tx.NewQuery(conversionStartQuery).Bind(params).Execute()
+
+		return err
+	})
+}
+
+// copy copies the table a chunk at a time, starting after the id
+func (c *partitionConverter) copy(after string) error {
+	copied := 0
+
+	for {
+		var last sql.NullString
+
+		err := c.db.Transactional(func(tx *dbx.Tx) error {
+			params := dbx.Params{"after": after, "limit": c.chunkSize}
+			if err := tx.NewQuery(c.query(convertChunkQuery)).Bind(params).Row(&last); err != nil || last.Valid == false {
+				return err
+			}
+
+			params["last"] = last.String
+			res, err := tx.NewQuery(c.query(convertCopyQuery)).Bind(params).Execute()
+			if err != nil {
+				return err
+			}
+
+			n, _ := res.RowsAffected()
+			copied += int(n)
+
+			_, err = tx.NewQuery(conversionProgressQuery).Bind(dbx.Params{"after": last.String, "table": c.table}).Execute()
+
+			return err
+		})
+
+		if err != nil {
+			return err
+		}
+
+		if last.Valid == false {
+			log.Printf("[partition] copied %d rows of %s", copied, c.table)
+			return nil
+		}
+
+		after = last.String
+		log.Printf("[partition] copied %d rows of %s (up to id [%s])", copied, c.table, after)
+	}
+}
+
+// replay copies the rows changed since they were copied again, up to limit of them (all if 0), returning
+// how many ids were replayed
+func (c *partitionConverter) replay(tx *dbx.Tx, limit int) (int, error) {
+	limitClause := ""
+	if limit > 0 {
+		limitClause = fmt.Sprintf(" LIMIT %d", limit)
+	}
+
+	var ids []string
+	if err := tx.NewQuery(strings.ReplaceAll(c.query(convertTakeLogQuery), "{:limit}", limitClause)).Column(&ids); err != nil {
+		return 0, err
+	}
+
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	params := dbx.Params{"ids": pq.Array(ids)}
+
+	if _, err := tx.NewQuery("DELETE FROM " + c.next + " WHERE id = ANY({:ids})").Bind(params).Execute(); err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.NewQuery("INSERT INTO " + c.next + " SELECT * FROM " + c.table + " WHERE id = ANY({:ids})").Bind(params).Execute(); err != nil {
+		return 0, err
+	}
+
+	log.Printf("[partition] copied %d changed rows of %s again", len(ids), c.table)
+
+	return len(ids), nil
+}
+
+// swap replaces the table with its partitioned copy, under a lock held only for the last few changes
+func (c *partitionConverter) swap(dropOld bool) error {
+	old := c.table + partitionUnconvertedSuffix
+
+	err := c.db.Transactional(func(tx *dbx.Tx) error {
+		// rather than queue every writer behind us for long, give up; the conversion can be run again
+		if err := execute(tx, "SET LOCAL lock_timeout = '10s'", "LOCK TABLE "+c.table+" IN ACCESS EXCLUSIVE MODE"); err != nil {
+			return fmt.Errorf("locking %s (run the conversion again to carry on): %w", c.table, err)
+		}
+
+		if _, err := c.replay(tx, 0); err != nil {
+			return err
+		}
+
+		err := execute(tx,
+			c.query("DROP TRIGGER {:log} ON {:table}"),
+			c.query("DROP FUNCTION {:log}()"),
+			c.query("DROP TABLE {:log}"),
+			"ALTER TABLE "+c.table+" RENAME TO "+old,
+			"ALTER TABLE "+c.next+" RENAME TO "+c.table)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.NewQuery(conversionDoneQuery).Bind(dbx.Params{"state": conversionDone, "table": c.table}).Execute()
+
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if dropOld == true {
+		return execute(c.db, "DROP TABLE "+old)
+	}
+
+	log.Printf("[partition] the original table is now %s", old)
+
+	return nil
+}
+
+// createPartition creates a partition for a source, moving any of its records out of the default partition
+func createPartition(db *dbx.DB, table string, source string, name string) error {
+	return db.Transactional(func(tx *dbx.Tx) error {
+		options, err := tableOptions(tx, table+partitionDefaultSuffix)
+		if err != nil {
+			return err
+		}
+
+		literal := pq.QuoteLiteral(source)
+
+		err = execute(tx,
+			"CREATE TABLE "+name+" (LIKE "+table+" INCLUDING DEFAULTS INCLUDING STORAGE)",
+			"INSERT INTO "+name+" SELECT * FROM "+table+partitionDefaultSuffix+" WHERE source = "+literal,
+			"DELETE FROM "+table+partitionDefaultSuffix+" WHERE source = "+literal,
+			"ALTER TABLE "+table+" ATTACH PARTITION "+name+" FOR VALUES IN ("+literal+")")
+		if err != nil {
+			return err
+		}
+
+		if options != "" {
+			return execute(tx, "ALTER TABLE "+name+" SET ("+options+")")
+		}
+
+		return nil
+	})
+}
+
+// partitionCommand implements the partition subcommand
+func partitionCommand(args []string) {
+	usage := "FATAL: usage: partition convert [-drop-old] | create|detach|drop <source> [-name <partition>] | list [flags]"
+
+	if len(args) == 0 {
+		log.Fatal(usage)
+	}
+
+	action := args[0]
+	args = args[1:]
+
+	source := ""
+	if action == "create" || action == "detach" || action == "drop" {
+		if len(args) == 0 || strings.HasPrefix(args[0], "-") == true {
+			log.Fatal(usage)
+		}
+		source = args[0]
+		args = args[1:]
+	}
+
+	// our own options precede the configuration flags
+	name := ""
+	dropOld := false
+	for len(args) > 0 {
+		if args[0] == "-drop-old" && action == "convert" {
+			dropOld = true
+			args = args[1:]
+		} else if args[0] == "-name" && source != "" && len(args) > 1 {
+			name = args[1]
+			args = args[2:]
+		} else {
+			break
+		}
+	}
+
+	cfg := loadStoreCommandConfiguration("partition "+action, args)
+	if cfg.CacheStore != storePostgres {
+		log.Fatalf("FATAL: partitioning only applies to the %s store", storePostgres)
+	}
+
+	store, err := newPostgresStore(*cfg, newConfiguredSecretResolver(*cfg))
+	if err != nil {
+		log.Fatalf("FATAL: %s", err.Error())
+	}
+	defer store.Close()
+
+	table := cfg.PostgresTable
+
+	if source != "" && name == "" {
+		if name, err = partitionName(table, source); err != nil {
+			log.Fatalf("FATAL: %s", err.Error())
+		}
+	}
+
+	if name != "" && (validTableName.MatchString(name) == false || len(name) > maxIdentifierLength) {
+		log.Fatalf("FATAL: partition name must be a lower case SQL identifier (is [%s])", name)
+	}
+
+	switch action {
+	case "convert":
+		err = convertToPartitioned(store.handle, table, cfg.PostgresBatchSize, dropOld)
+
+	case "create":
+		log.Printf("[partition] creating partition %s for source [%s]", name, source)
+		err = createPartition(store.handle, table, source, name)
+
+	case "detach", "drop":
+		// detaching is a catalog change; the rows go with the partition
+		log.Printf("[partition] detaching partition %s", name)
+		err = execute(store.handle, "ALTER TABLE "+table+" DETACH PARTITION "+name)
+
+		if err == nil && action == "drop" {
+			log.Printf("[partition] dropping partition %s", name)
+			err = execute(store.handle, "DROP TABLE "+name)
+		}
+
+	case "list":
+		var partitions []partitionInfo
+		partitions, err = listPartitions(store.handle, table)
+		for _, p := range partitions {
+			fmt.Printf("%-40s %-40s ~%d rows\n", p.Name, p.Bound, p.Rows)
+		}
+		if err == nil && len(partitions) == 0 {
+			fmt.Printf("%s is not partitioned\n", table)
+		}
+
+	default:
+		log.Fatal(usage)
+	}
+
+	if err != nil {
+		log.Fatalf("FATAL: %s", err.Error())
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestPartitionName(t *testing.T) {
+	for source, expected := range map[string]string{
+		"marc":         "source_cache_marc",
+		"Hathi-Trust":  "source_cache_hathi_trust",
+		"  sirsi/marc": "source_cache_sirsi_marc",
+	} {
+		name, err := partitionName("source_cache", source)
+		if err != nil {
+			t.Errorf("%s: %s", source, err.Error())
+		} else if name != expected {
+			t.Errorf("%s: expected %s, got %s", source, expected, name)
+		}
+	}
+
+	for _, source := range []string{"", "---", "a_very_long_source_name_that_will_not_fit_in_an_identifier_at_all"} {
+		if _, err := partitionName("source_cache", source); err == nil {
+			t.Errorf("[%s]: expected an error", source)
+		}
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// payloadStorage turns payloads into what is stored in the cache table and back again: compressing
+// them, or offloading the large ones to the object store
+type payloadStorage struct {
+	codec     *payloadCodec
+	objects   ObjectStore // nil when no offload location is configured
+	threshold int         // payloads at least this large are offloaded; 0 to never offload
+}
+
+// newPayloadStorage - the factory
+func newPayloadStorage(cfg ServiceConfig) (*payloadStorage, error) {
+	codec, err := newPayloadCodec(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	p := payloadStorage{codec: codec, threshold: cfg.OffloadThreshold}
+
+	// the object store is needed to read offloaded payloads, even if we aren't offloading any more
+	if cfg.OffloadLocation != "" {
+		if p.objects, err = NewObjectStore(cfg.OffloadLocation); err != nil {
+			return nil, err
+		}
+	}
+
+	return &p, nil
+}
+
+// encode returns the payload of the record as it should be stored in the table
+func (p *payloadStorage) encode(table string, rec cacheRecord) (storedPayload, error) {
+	if p.objects == nil || p.threshold == 0 || len(rec.Payload) < p.threshold {
+		return p.codec.encode(rec.Payload)
+	}
+
+	key := objectKey(table, rec.ID)
+
+	if err := p.objects.Put(key, rec.Payload); err != nil {
+		return storedPayload{}, fmt.Errorf("offloading payload for %s: %w", rec.ID, err)
+	}
+
+	return storedPayload{ref: key}, nil
+}
+
+// decode replaces the stored payload of the record with the original
+func (p *payloadStorage) decode(rec *cacheRecord) error {
+	if rec.PayloadRef != "" {
+		if p.objects == nil {
+			return fmt.Errorf("record %s: payload is offloaded but no offload location is configured", rec.ID)
+		}
+
+		payload, err := p.objects.Get(rec.PayloadRef)
+		if err != nil {
+			return fmt.Errorf("record %s: fetching offloaded payload: %w", rec.ID, err)
+		}
+
+		rec.Payload = payload
+		rec.PayloadRef = ""
+
+		return nil
+	}
+
+	payload, err := decodePayload(rec.Payload, rec.PayloadData, rec.PayloadCodec)
+	if err != nil {
+		return fmt.Errorf("record %s: %w", rec.ID, err)
+	}
+
+	rec.Payload = payload
+	rec.PayloadData = nil
+	rec.PayloadCodec = ""
+
+	return nil
+}
+
+// remove deletes objects no longer referenced by the cache. failures only leave garbage behind,
+// so they are logged rather than returned
+func (p *payloadStorage) remove(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	if p.objects == nil {
+		log.Printf("[store] WARNING: %d offloaded payloads are no longer referenced but no offload location is configured to remove them from", len(keys))
+		return
+	}
+
+	for _, key := range keys {
+		if err := p.objects.Delete(key); err != nil {
+			log.Printf("[store] WARNING: removing offloaded payload %s: %s", key, err.Error())
+		}
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// pipeline is the set of workers and deleters fed by the main polling loop
+type pipeline struct {
+	cfg         ServiceConfig
+	source      MessageSource
+	cache       *cacheService
+	deliveries  *deliveryTracker
+	heartbeat   *visibilityHeartbeat
+	stopBeat    chan struct{}
+	flow        *flowControl
+	processChan chan cacheMessage
+	urgentChan  chan cacheMessage // messages from the highest priority queue; nil with a single queue
+	deleteChan  chan []cacheMessage
+	workers     *workerPool
+	supervisor  sync.WaitGroup
+	stopScale   chan struct{}
+	deleters    sync.WaitGroup
+	releasing   sync.WaitGroup // the rate limited messages being held
+	reaping     sync.WaitGroup
+	stopReap    chan struct{}
+}
+
+// startPipeline creates the processing and deletion channels and starts the deleters and workers
+func startPipeline(cfg ServiceConfig, source MessageSource, cache *cacheService) *pipeline {
+	p := pipeline{
+		cfg:        cfg,
+		source:     source,
+		cache:      cache,
+		deliveries: newDeliveryTracker(),
+		heartbeat:  newVisibilityHeartbeat(cfg, source),
+		stopBeat:   make(chan struct{}),
+		stopScale:  make(chan struct{}),
+		stopReap:   make(chan struct{}),
+	}
+
+	go p.heartbeat.run(p.stopBeat)
+
+	log.Printf("[main] starting deleters...")
+	// create the message deletion channel and start deleters
+	p.deleteChan = make(chan []cacheMessage, cfg.DeleteQueueSize)
+	for d := 1; d <= cfg.Deleters; d++ {
+		p.deleters.Add(1)
+		go func(id int) {
+			defer p.deleters.Done()
+			deleter(id, cfg, source, p.deliveries, p.heartbeat, p.deleteChan)
+		}(d)
+	}
+
+	log.Printf("[main] starting workers...")
+	// create the message processing channel and start workers
+	p.processChan = make(chan cacheMessage, cfg.WorkerQueueSize)
+	if _, ok := source.(PrioritySource); ok == true {
+		p.urgentChan = make(chan cacheMessage, cfg.WorkerQueueSize)
+	}
+
+	p.workers = newWorkerPool(cfg, cache, p.urgentChan, p.processChan, p.deleteChan)
+	for w := 1; w <= cfg.Workers; w++ {
+		p.workers.add()
+	}
+
+	if p.workers.scalable() == true {
+		log.Printf("[main] scaling between %d and %d workers", p.workers.min, p.workers.max)
+		p.supervisor.Add(1)
+		go func() {
+			defer p.supervisor.Done()
+			p.workers.supervise(p.stopScale)
+		}()
+	}
+
+	// sources over their rate limits are held back before the workers
+	cache.limits.release(&p.releasing)
+
+	p.flow = newFlowControl(cfg, p.urgentChan, p.processChan, p.deleteChan, cache.flushTimes)
+
+	// expired records are deleted alongside
+	reaper, err := newReaper(cfg, cache.store)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if reaper != nil {
+		log.Printf("[main] deleting expired records every %s", reaper.interval)
+		p.reaping.Add(1)
+		go func() {
+			defer p.reaping.Done()
+			reaper.run(p.stopReap)
+		}()
+	}
+
+	return &p
+}
+
+// pollMessages is the main polling loop; it feeds the workers until the source is exhausted
+func (p *pipeline) pollMessages() {
+	batch := newRate()
+	overall := newRate()
+
+	var batchID string
+
+	showBacklog := false
+
+	pollTimeout := time.Duration(p.cfg.PollTimeOut) * time.Second
+
+	log.Printf("[main] starting main polling loop...")
+
+	for finished := false; finished == false; {
+		if showBacklog == true {
+			processBacklog := len(p.processChan) + len(p.urgentChan)
+			deleteBacklog := len(p.deleteChan)
+			if processBacklog > 0 || deleteBacklog > 0 {
+				log.Printf("[main] backlog: process = %d, urgent = %d, delete = %d", len(p.processChan), len(p.urgentChan), len(p.deleteChan))
+			}
+			if queues, ok := p.source.(PrioritySource); ok == true {
+				log.Printf("[main] queues: %s", queues.QueueStats())
+			}
+			log.Printf("[main] deliveries: %s", p.deliveries.totals())
+			if limited := p.cache.limits.String(); limited != "" {
+				log.Printf("[main] rate limited: %s", limited)
+			}
+			showBacklog = false
+		}
+
+		// don't take on more than the workers and deleters can handle
+		p.flow.wait()
+
+		// wait for a batch of messages
+		messages, err := p.source.ReceiveBatch(awssqs.MAX_SQS_BLOCK_COUNT, pollTimeout)
+		if err == io.EOF {
+			// the source has run dry; handle as an empty poll and then shut down
+			finished = true
+		} else if err != nil {
+			log.Fatal(err)
+		}
+
+		received := time.Now()
+
+		p.deliveries.received(messages, received)
+		p.heartbeat.hold(messages, received)
+
+		// did we receive any?
+		sz := len(messages)
+		if sz > 0 {
+			//log.Printf("[main] received %d messages", sz)
+
+			// tracking a new batch?  (groups of messages received close together)
+			if batch.count == 0 {
+				batch.setStart(received)
+
+				guid := xid.New()
+				batchID = guid.String()
+
+				log.Printf("[main] batch: [%s] tracking new batch", batchID)
+			}
+
+			for _, m := range messages {
+				c := cacheMessage{
+					message:  m,
+					received: received,
+					batchID:  batchID,
+				}
+
+				target := p.processChan
+				if p.urgent(m) == true {
+					target = p.urgentChan
+				}
+
+				// a source over its rate limit waits its turn
+				if p.cache.limits.hold(c, target) == false {
+					target <- c
+				}
+
+				batch.incrementCount()
+				overall.incrementCount()
+
+				// show batch totals periodically, along with overall timings
+				if batch.count%1000 == 0 {
+					log.Printf("[main] batch: [%s] queued %d messages (%0.2f mps)", batchID, batch.count, batch.getCurrentRate())
+				}
+
+				// show overall totals periodically.  timings don't really make sense here
+				if overall.count%1000 == 0 {
+					log.Printf("[main] overall: queued %d messages", overall.count)
+					showBacklog = true
+				}
+			}
+
+			batch.setStopNow()
+		} else {
+			// if the end of a batch, show totals and timing (if we haven't already)
+			if batch.count > 0 {
+				if batch.count%1000 != 0 {
+					log.Printf("[main] batch: [%s] queued %d messages (%0.2f mps)", batchID, batch.count, batch.getRate())
+				}
+				log.Printf("[main] overall: queued %d messages", overall.count)
+			}
+
+			log.Printf("[main] no messages received")
+			batch = newRate()
+			showBacklog = true
+		}
+	}
+}
+
+// shutdown drains the pipeline: workers flush their pending writes to the deleters, which
+// delete them from the source before exiting
+func (p *pipeline) shutdown() {
+	close(p.stopScale)
+	p.supervisor.Wait()
+
+	close(p.stopReap)
+	p.reaping.Wait()
+
+	p.cache.limits.close()
+	p.releasing.Wait()
+
+	log.Printf("[main] end of input; waiting for workers to finish...")
+	close(p.processChan)
+	if p.urgentChan != nil {
+		close(p.urgentChan)
+	}
+	p.workers.wait()
+
+	log.Printf("[main] waiting for deleters to finish...")
+	close(p.deleteChan)
+	p.deleters.Wait()
+
+	close(p.stopBeat)
+
+	log.Printf("[main] deliveries: %s", p.deliveries.totals())
+
+	if queues, ok := p.source.(PrioritySource); ok == true {
+		log.Printf("[main] queues: %s", queues.QueueStats())
+	}
+}
+
+// urgent reports whether the message should be processed ahead of the rest
+func (p *pipeline) urgent(msg awssqs.Message) bool {
+	queues, ok := p.source.(PrioritySource)
+
+	return ok == true && queues.Urgent(msg) == true
+}
+
+//
+// end of file
+//
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+//
+// purge deletes the records of a source, a type or an updated_at range, a chunk at a time with each
+// chunk committed on its own, so that retiring or reloading a source doesn't lock and bloat the table
+// the way a single DELETE would. rows the service updates in the meantime are left alone. downstream
+// consumers can be told about the deletes with the same delete messages the service receives; they
+// are sent before each chunk commits, so a failed send leaves the chunk in place to purge again.
+// the earlier versions of the records purged go with them
+//
+
+const purgeSelectQuery = `
+SELECT
+	id, type, source, payload_ref, updated_at
+FROM
+	{:table}
+WHERE
+	(id, source) > ({:after_id}, {:after_source}){:filter}
+ORDER BY
+	id, source
+LIMIT
+	{:limit}
+`
+
+const purgeCountQuery = `
+SELECT
+	COUNT(*)
+FROM
+	{:table}
+WHERE
+	1 = 1{:filter}
+`
+
+const purgeDeleteQuery = `
+DELETE
+FROM
+	{:table}
+WHERE
+	id = {:id} AND source = {:source} AND updated_at = {:updated_at}
+`
+
+const purgeHistoryQuery = `
+DELETE
+FROM
+	{:table}
+WHERE
+	id = {:id}
+`
+
+// the time formats accepted for the updated_at range
+var purgeTimeFormats = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"}
+
+// purgeFilter selects the records to purge. empty fields match everything
+type purgeFilter struct {
+	source     string
+	recordType string
+	after      time.Time // updated at or after
+	before     time.Time // updated before
+	expiredBy  time.Time // expired before
+}
+
+// empty reports whether the filter matches every record
+func (f purgeFilter) empty() bool {
+	return f.source == "" && f.recordType == "" && f.after.IsZero() == true && f.before.IsZero() == true && f.expiredBy.IsZero() == true
+}
+
+// where returns the conditions of the filter, to be appended to a WHERE clause, and their parameters
+func (f purgeFilter) where() (string, dbx.Params) {
+	clause := ""
+	params := dbx.Params{}
+
+	if f.source != "" {
+		clause += " AND source = {:source}"
+		params["source"] = f.source
+	}
+
+	if f.recordType != "" {
+		clause += " AND type = {:type}"
+		params["type"] = f.recordType
+	}
+
+	if f.after.IsZero() == false {
+		clause += " AND updated_at >= {:updated_after}"
+		params["updated_after"] = f.after.UTC()
+	}
+
+	if f.before.IsZero() == false {
+		clause += " AND updated_at < {:updated_before}"
+		params["updated_before"] = f.before.UTC()
+	}
+
+	if f.expiredBy.IsZero() == false {
+		clause += " AND expires_at < {:expired_by}"
+		params["expired_by"] = f.expiredBy.UTC()
+	}
+
+	return clause, params
+}
+
+// String describes the filter
+func (f purgeFilter) String() string {
+	var s []string
+
+	if f.source != "" {
+		s = append(s, fmt.Sprintf("source [%s]", f.source))
+	}
+	if f.recordType != "" {
+		s = append(s, fmt.Sprintf("type [%s]", f.recordType))
+	}
+	if f.after.IsZero() == false {
+		s = append(s, fmt.Sprintf("updated at or after %s", f.after.Format(time.RFC3339)))
+	}
+	if f.before.IsZero() == false {
+		s = append(s, fmt.Sprintf("updated before %s", f.before.Format(time.RFC3339)))
+	}
+	if f.expiredBy.IsZero() == false {
+		s = append(s, fmt.Sprintf("expired before %s", f.expiredBy.Format(time.RFC3339)))
+	}
+
+	return strings.Join(s, ", ")
+}
+
+// parsePurgeTime parses one end of the updated_at range
+func parsePurgeTime(value string) (time.Time, error) {
+	for _, format := range purgeTimeFormats {
+		if t, err := time.Parse(format, value); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("expected a date or RFC 3339 time (is [%s])", value)
+}
+
+// purgeNotifier tells downstream consumers about purged records
+type purgeNotifier interface {
+	notify(records []cacheRecord) error
+}
+
+// sqsNotifier sends a delete message for each purged record to an outbound queue
+type sqsNotifier struct {
+	aws   awssqs.AWS_SQS
+	queue awssqs.QueueHandle
+}
+
+// newSqsNotifier - the factory
+func newSqsNotifier(cfg ServiceConfig, queueName string) (*sqsNotifier, error) {
+	aws, err := awssqs.NewAwsSqs(awssqs.AwsSqsConfig{MessageBucketName: cfg.MessageBucketName})
+	if err != nil {
+		return nil, err
+	}
+
+	queue, err := aws.QueueHandle(queueName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqsNotifier{aws: aws, queue: queue}, nil
+}
+
+func (n *sqsNotifier) notify(records []cacheRecord) error {
+	for start := 0; start < len(records); start += int(awssqs.MAX_SQS_BLOCK_COUNT) {
+		end := min(start+int(awssqs.MAX_SQS_BLOCK_COUNT), len(records))
+
+		block := make([]awssqs.Message, 0, end-start)
+		for _, rec := range records[start:end] {
+			block = append(block, awssqs.Message{
+				Attribs: awssqs.Attributes{
+					{Name: awssqs.AttributeKeyRecordId, Value: rec.ID},
+					{Name: awssqs.AttributeKeyRecordType, Value: rec.Type},
+					{Name: awssqs.AttributeKeyRecordSource, Value: rec.Source},
+					{Name: awssqs.AttributeKeyRecordOperation, Value: awssqs.AttributeValueRecordOperationDelete},
+				},
+			})
+		}
+
+		opStatus, err := n.aws.BatchMessagePut(n.queue, block)
+		if err == awssqs.ErrOneOrMoreOperationsUnsuccessful {
+			err = n.aws.MessagePutRetry(n.queue, block, opStatus, 1)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// purgeResult counts the rows visited by purge
+type purgeResult struct {
+	examined int
+	deleted  int
+	skipped  int // changed by someone else while we were working
+}
+
+// countPurge counts the rows in a table a purge would delete
+func countPurge(handle *dbx.DB, table string, filter purgeFilter) (int64, error) {
+	clause, params := filter.where()
+
+	var count int64
+	err := handle.NewQuery(strings.ReplaceAll(cleanQuery(purgeCountQuery, table), "{:filter}", clause)).Bind(params).Row(&count)
+
+	return count, err
+}
+
+// purgeTable deletes the rows in a table matching the filter, along with their versions in the
+// history table, notifying the notifier (if any) of the rows each chunk deleted before committing it
+func purgeTable(handle *dbx.DB, table string, history string, payloads *payloadStorage, filter purgeFilter, chunkSize int, pause time.Duration, notifier purgeNotifier) (purgeResult, error) {
+	var result purgeResult
+
+	clause, params := filter.where()
+
+	selectQuery := strings.ReplaceAll(cleanQuery(purgeSelectQuery, table), "{:filter}", clause)
+	deleteQuery := cleanQuery(purgeDeleteQuery, table)
+	historyQuery := cleanQuery(purgeHistoryQuery, history)
+
+	afterID, afterSource := "", ""
+
+	for {
+		var recs []cacheRecord
+
+		params["after_id"] = afterID
+		params["after_source"] = afterSource
+		params["limit"] = chunkSize
+
+		if err := handle.NewQuery(selectQuery).Bind(params).All(&recs); err != nil {
+			return result, err
+		}
+
+		if len(recs) == 0 {
+			return result, nil
+		}
+
+		var deleted []cacheRecord
+
+		err := handle.Transactional(func(tx *dbx.Tx) error {
+			deleted = nil
+
+			dq := tx.NewQuery(deleteQuery).Prepare()
+			hq := tx.NewQuery(historyQuery).Prepare()
+
+			for _, rec := range recs {
+				res, err := dq.Bind(dbx.Params{"id": rec.ID, "source": rec.Source, "updated_at": rec.UpdatedAt}).Execute()
+				if err != nil {
+					return err
+				}
+
+				if n, _ := res.RowsAffected(); n > 0 {
+					if _, err = hq.Bind(dbx.Params{"id": rec.ID}).Execute(); err != nil {
+						return err
+					}
+
+					deleted = append(deleted, rec)
+				}
+			}
+
+			// the deletes only commit once downstream has been told
+			if notifier != nil && len(deleted) > 0 {
+				if err := notifier.notify(deleted); err != nil {
+					return fmt.Errorf("notifying %d deletes from %s: %w", len(deleted), deleted[0].ID, err)
+				}
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return result, err
+		}
+
+		result.examined += len(recs)
+		result.deleted += len(deleted)
+		result.skipped += len(recs) - len(deleted)
+		afterID, afterSource = recs[len(recs)-1].ID, recs[len(recs)-1].Source
+
+		var refs []string
+		for _, rec := range deleted {
+			if rec.PayloadRef != "" {
+				refs = append(refs, rec.PayloadRef)
+			}
+		}
+
+		if len(refs) > 0 {
+			payloads.remove(refs)
+		}
+
+		log.Printf("[purge] %s: %d rows examined, %d deleted, %d skipped", table, result.examined, result.deleted, result.skipped)
+
+		time.Sleep(pause)
+	}
+}
+
+// purgeCommand implements the purge subcommand
+func purgeCommand(args []string) {
+	usage := "FATAL: usage: purge [-source <source>] [-type <type>] [-updated-after <time>] [-updated-before <time>] [-dry-run] [-pause <milliseconds>] [-notify <queue>] [flags]"
+
+	var filter purgeFilter
+	dryRun := false
+	pause := time.Duration(0)
+	notify := ""
+
+	// our own options precede the configuration flags
+	for len(args) > 0 {
+		if args[0] == "-dry-run" {
+			dryRun = true
+			args = args[1:]
+			continue
+		}
+
+		if len(args) < 2 {
+			break
+		}
+
+		option, value := args[0], args[1]
+		var err error
+
+		switch option {
+		case "-source":
+			filter.source = value
+		case "-type":
+			filter.recordType = value
+		case "-updated-after":
+			filter.after, err = parsePurgeTime(value)
+		case "-updated-before":
+			filter.before, err = parsePurgeTime(value)
+		case "-notify":
+			notify = value
+		case "-pause":
+			var ms int
+			ms, err = strconv.Atoi(value)
+			if err == nil && ms < 0 {
+				err = fmt.Errorf("pause must not be negative")
+			}
+			pause = time.Duration(ms) * time.Millisecond
+		default:
+			option = ""
+		}
+
+		if option == "" {
+			break
+		}
+
+		if err != nil {
+			log.Fatalf("FATAL: %s: %s", option, err.Error())
+		}
+
+		args = args[2:]
+	}
+
+	// a purge of everything is too easy to do by mistake
+	if filter.empty() == true {
+		log.Fatal(usage)
+	}
+
+	cfg := loadStoreCommandConfiguration("purge", args)
+
+	payloads, err := newPayloadStorage(*cfg)
+	if err != nil {
+		log.Fatalf("FATAL: %s", err.Error())
+	}
+
+	store, err := NewCacheStore(*cfg, newConfiguredSecretResolver(*cfg))
+	if err != nil {
+		log.Fatalf("FATAL: %s", err.Error())
+	}
+	defer store.Close()
+
+	router, err := newCacheRouter(*cfg)
+	if err != nil {
+		log.Fatalf("FATAL: %s", err.Error())
+	}
+
+	if dryRun == true {
+		total := int64(0)
+		for _, table := range router.tables() {
+			count, err := countPurge(storeHandle(store), table, filter)
+			if err != nil {
+				log.Fatalf("FATAL: %s: %s", table, err.Error())
+			}
+			fmt.Printf("%-40s %d rows\n", table, count)
+			total += count
+		}
+		fmt.Printf("%-40s %d rows would be purged (%s)\n", "total", total, filter)
+		return
+	}
+
+	var notifier purgeNotifier
+	if notify != "" {
+		if notifier, err = newSqsNotifier(*cfg, notify); err != nil {
+			log.Fatalf("FATAL: %s", err.Error())
+		}
+	}
+
+	log.Printf("[purge] purging %s from %s, %d rows at a time", filter, strings.Join(router.tables(), ", "), cfg.PostgresBatchSize)
+
+	for _, table := range router.tables() {
+		result, err := purgeTable(storeHandle(store), table, router.defaultTable+historySuffix, payloads, filter, cfg.PostgresBatchSize, pause, notifier)
+		if err != nil {
+			log.Fatalf("FATAL: %s: %s", table, err.Error())
+		}
+
+		log.Printf("[purge] %s: done; %d rows deleted, %d skipped", table, result.deleted, result.skipped)
+	}
+}
+
+//
+// end of file
+//
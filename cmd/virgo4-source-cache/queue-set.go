@@ -0,0 +1,337 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+//
+// a single process can read several queues, listed in priority order: real-time edits ahead of bulk
+// reloads, say. with no weights the queues are polled in strict priority; a lower priority queue is
+// only read when those above it are empty. with weights each queue gets its share of the polls, so
+// that a busy high priority queue can't starve the rest. messages from the first queue are also
+// processed ahead of the others by the workers
+//
+
+// how long each queue is checked for before trying the next. a zero wait is an sqs short poll,
+// which samples a few servers and can come back empty with messages waiting; the shortest long
+// poll asks them all
+const queueCheckWait = time.Second
+
+// PrioritySource is implemented by sources reading several queues in priority order
+type PrioritySource interface {
+
+	// Urgent reports whether the message came from the highest priority queue
+	Urgent(msg awssqs.Message) bool
+
+	// QueueStats summarises the messages received and deleted from each queue
+	QueueStats() string
+}
+
+// prioritizedQueue is one of the queues in a set
+type prioritizedQueue struct {
+	name      string
+	source    MessageSource
+	weight    int
+	current   int  // for the weighted round robin
+	exhausted bool // the source has run dry
+	received  int64
+	deleted   int64
+}
+
+// queueSet is the MessageSource reading several queues
+type queueSet struct {
+	queues []*prioritizedQueue
+	strict bool
+
+	sync.Mutex
+	owners map[awssqs.ReceiptHandle]*prioritizedQueue // the queue each undeleted message came from; the rare messages given up on stay
+}
+
+// parseQueueNames splits the configured queue list
+func parseQueueNames(value string) []string {
+	var names []string
+
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// parseQueueWeights parses the polling weights, one per queue; nil for strict priority
+func parseQueueWeights(value string, queues int) ([]int, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+
+	var weights []int
+
+	for _, w := range strings.Split(value, ",") {
+		weight, err := strconv.Atoi(strings.TrimSpace(w))
+		if err != nil || weight <= 0 {
+			return nil, fmt.Errorf("queue weights must be positive integers (is [%s])", value)
+		}
+		weights = append(weights, weight)
+	}
+
+	if len(weights) != queues {
+		return nil, fmt.Errorf("expected %d queue weights, one per queue (is [%s])", queues, value)
+	}
+
+	return weights, nil
+}
+
+// newQueueSet - the factory. the sources are in priority order
+func newQueueSet(names []string, sources []MessageSource, weights []int) *queueSet {
+	q := queueSet{
+		strict: weights == nil,
+		owners: make(map[awssqs.ReceiptHandle]*prioritizedQueue),
+	}
+
+	for ix := range sources {
+		pq := prioritizedQueue{name: names[ix], source: sources[ix], weight: 1}
+		if weights != nil {
+			pq.weight = weights[ix]
+		}
+		q.queues = append(q.queues, &pq)
+	}
+
+	return &q
+}
+
+// pollOrder returns the queues in the order to try them this time around
+func (q *queueSet) pollOrder() []*prioritizedQueue {
+	if q.strict == true {
+		return q.queues
+	}
+
+	// smooth weighted round robin: the first choice rotates in proportion to the weights, and the
+	// rest follow in priority order
+	total := 0
+	var first *prioritizedQueue
+
+	for _, pq := range q.queues {
+		if pq.exhausted == true {
+			continue
+		}
+		pq.current += pq.weight
+		total += pq.weight
+		if first == nil || pq.current > first.current {
+			first = pq
+		}
+	}
+
+	if first == nil {
+		return q.queues
+	}
+
+	first.current -= total
+
+	order := []*prioritizedQueue{first}
+	for _, pq := range q.queues {
+		if pq != first {
+			order = append(order, pq)
+		}
+	}
+
+	return order
+}
+
+func (q *queueSet) ReceiveBatch(maxMessages uint, waitTime time.Duration) ([]awssqs.Message, error) {
+	order := q.pollOrder()
+	deadline := time.Now().Add(waitTime)
+
+	// take what is waiting, in order, checking each queue briefly...
+	for _, pq := range order {
+		if pq.exhausted == true {
+			continue
+		}
+
+		check := queueCheckWait
+		if remaining := time.Until(deadline); remaining < check {
+			check = remaining
+		}
+		if check < 0 {
+			check = 0
+		}
+
+		messages, err := q.receive(pq, maxMessages, check)
+		if err != nil || len(messages) > 0 {
+			return messages, err
+		}
+	}
+
+	// ...and with nothing anywhere, wait out the rest of the time on the first choice still running
+	for _, pq := range order {
+		if pq.exhausted == false {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return nil, nil
+			}
+			return q.receive(pq, maxMessages, remaining)
+		}
+	}
+
+	return nil, io.EOF
+}
+
+// receive reads from a single queue, noting where the messages came from
+func (q *queueSet) receive(pq *prioritizedQueue, maxMessages uint, waitTime time.Duration) ([]awssqs.Message, error) {
+	messages, err := pq.source.ReceiveBatch(maxMessages, waitTime)
+	if err == io.EOF {
+		pq.exhausted = true
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", pq.name, err)
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	pq.received += int64(len(messages))
+	for _, msg := range messages {
+		q.owners[msg.ReceiptHandle] = pq
+	}
+
+	return messages, nil
+}
+
+// byQueue groups a block of messages by the queue they came from; the indexes are their positions
+// in the block. messages we don't know are left out
+func (q *queueSet) byQueue(messages []awssqs.Message) map[*prioritizedQueue][]int {
+	q.Lock()
+	defer q.Unlock()
+
+	groups := make(map[*prioritizedQueue][]int)
+
+	for ix, msg := range messages {
+		if pq, ok := q.owners[msg.ReceiptHandle]; ok == true {
+			groups[pq] = append(groups[pq], ix)
+		}
+	}
+
+	return groups
+}
+
+// blockStatus is the status of the whole block, given the status of each message
+func blockStatus(ops []awssqs.OpStatus) ([]awssqs.OpStatus, error) {
+	for _, ok := range ops {
+		if ok == false {
+			return ops, awssqs.ErrOneOrMoreOperationsUnsuccessful
+		}
+	}
+
+	return ops, nil
+}
+
+func (q *queueSet) DeleteBatch(messages []awssqs.Message) ([]awssqs.OpStatus, error) {
+	ops := make([]awssqs.OpStatus, len(messages))
+
+	for pq, indexes := range q.byQueue(messages) {
+		block := make([]awssqs.Message, 0, len(indexes))
+		for _, ix := range indexes {
+			block = append(block, messages[ix])
+		}
+
+		status, err := pq.source.DeleteBatch(block)
+		if err != nil && err != awssqs.ErrOneOrMoreOperationsUnsuccessful {
+			return nil, fmt.Errorf("%s: %w", pq.name, err)
+		}
+
+		q.Lock()
+		for bix, ok := range status {
+			ops[indexes[bix]] = ok
+			if ok == true {
+				pq.deleted++
+				delete(q.owners, block[bix].ReceiptHandle)
+			}
+		}
+		q.Unlock()
+	}
+
+	return blockStatus(ops)
+}
+
+func (q *queueSet) Urgent(msg awssqs.Message) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.owners[msg.ReceiptHandle] == q.queues[0]
+}
+
+func (q *queueSet) QueueStats() string {
+	q.Lock()
+	defer q.Unlock()
+
+	var s []string
+	for _, pq := range q.queues {
+		s = append(s, fmt.Sprintf("%s: received %d, deleted %d", pq.name, pq.received, pq.deleted))
+	}
+
+	return strings.Join(s, "; ")
+}
+
+// VisibilityTimeout is the shortest of the queue timeouts
+func (q *queueSet) VisibilityTimeout() (time.Duration, error) {
+	shortest := time.Duration(0)
+
+	for _, pq := range q.queues {
+		extender, ok := pq.source.(VisibilityExtender)
+		if ok == false {
+			return 0, fmt.Errorf("%s: visibility cannot be extended", pq.name)
+		}
+
+		timeout, err := extender.VisibilityTimeout()
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", pq.name, err)
+		}
+
+		if shortest == 0 || timeout < shortest {
+			shortest = timeout
+		}
+	}
+
+	return shortest, nil
+}
+
+func (q *queueSet) ExtendVisibility(messages []awssqs.Message, timeout time.Duration) ([]awssqs.OpStatus, error) {
+	ops := make([]awssqs.OpStatus, len(messages))
+
+	for pq, indexes := range q.byQueue(messages) {
+		extender, ok := pq.source.(VisibilityExtender)
+		if ok == false {
+			continue
+		}
+
+		block := make([]awssqs.Message, 0, len(indexes))
+		for _, ix := range indexes {
+			block = append(block, messages[ix])
+		}
+
+		status, err := extender.ExtendVisibility(block, timeout)
+		if err != nil && err != awssqs.ErrOneOrMoreOperationsUnsuccessful {
+			return nil, fmt.Errorf("%s: %w", pq.name, err)
+		}
+
+		for bix, ok := range status {
+			ops[indexes[bix]] = ok
+		}
+	}
+
+	return blockStatus(ops)
+}
+
+//
+// end of file
+//
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// testQueueSet builds a set of two memory sources, each holding count messages
+func testQueueSet(t *testing.T, count int, weights []int) (*queueSet, *memorySource, *memorySource) {
+	t.Helper()
+
+	high := newMemorySource(count)
+	low := newMemorySource(count)
+
+	for ix := 0; ix < count; ix++ {
+		high.Put(testMessage("high", awssqs.AttributeValueRecordOperationUpdate, "<r/>"))
+		low.Put(testMessage("low", awssqs.AttributeValueRecordOperationUpdate, "<r/>"))
+	}
+
+	high.Close()
+	low.Close()
+
+	return newQueueSet([]string{"high", "low"}, []MessageSource{high, low}, weights), high, low
+}
+
+func TestQueueWeights(t *testing.T) {
+	if weights, err := parseQueueWeights("3, 1", 2); err != nil || len(weights) != 2 || weights[0] != 3 {
+		t.Fatalf("expected weights [3 1], got %v (%v)", weights, err)
+	}
+
+	for _, bad := range []string{"3", "3,0", "3,x"} {
+		if _, err := parseQueueWeights(bad, 2); err == nil {
+			t.Errorf("expected weights [%s] to be rejected", bad)
+		}
+	}
+}
+
+func TestQueueSetStrict(t *testing.T) {
+	q, _, _ := testQueueSet(t, 3, nil)
+
+	var order []string
+	for {
+		messages, err := q.ReceiveBatch(1, 0)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("receive: %s", err.Error())
+		}
+		for _, msg := range messages {
+			id, _ := msg.GetAttribute(awssqs.AttributeKeyRecordId)
+			order = append(order, id)
+		}
+	}
+
+	expected := []string{"high", "high", "high", "low", "low", "low"}
+	if len(order) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, order)
+	}
+	for ix := range expected {
+		if order[ix] != expected[ix] {
+			t.Fatalf("expected %v, got %v", expected, order)
+		}
+	}
+}
+
+func TestQueueSetWeighted(t *testing.T) {
+	q, _, _ := testQueueSet(t, 6, []int{2, 1})
+
+	// the first six polls are shared 2:1
+	counts := make(map[string]int)
+	for ix := 0; ix < 6; ix++ {
+		messages, err := q.ReceiveBatch(1, 0)
+		if err != nil || len(messages) != 1 {
+			t.Fatalf("expected a message, got %d (%v)", len(messages), err)
+		}
+		id, _ := messages[0].GetAttribute(awssqs.AttributeKeyRecordId)
+		counts[id]++
+	}
+
+	if counts["high"] != 4 || counts["low"] != 2 {
+		t.Fatalf("expected 4 high and 2 low, got %v", counts)
+	}
+}
+
+func TestQueueSetDelete(t *testing.T) {
+	q, high, low := testQueueSet(t, 2, nil)
+
+	var received []awssqs.Message
+	for len(received) < 4 {
+		messages, err := q.ReceiveBatch(awssqs.MAX_SQS_BLOCK_COUNT, 0)
+		if err != nil {
+			t.Fatalf("receive: %s", err.Error())
+		}
+		received = append(received, messages...)
+	}
+
+	if q.Urgent(received[0]) == false || q.Urgent(received[3]) == true {
+		t.Fatalf("expected only messages from the first queue to be urgent")
+	}
+
+	// each message goes back to the queue it came from
+	if _, err := q.DeleteBatch(received); err != nil {
+		t.Fatalf("delete: %s", err.Error())
+	}
+
+	if len(high.Deleted()) != 2 || len(low.Deleted()) != 2 {
+		t.Fatalf("expected 2 deletes from each queue, got %d and %d", len(high.Deleted()), len(low.Deleted()))
+	}
+
+	if _, err := q.ReceiveBatch(1, 0); err != io.EOF {
+		t.Fatalf("expected EOF once every queue is exhausted, got %v", err)
+	}
+}
+
+func TestQueueSetWait(t *testing.T) {
+	high := newMemorySource(1)
+	low := newMemorySource(1)
+	q := newQueueSet([]string{"high", "low"}, []MessageSource{high, low}, nil)
+
+	// each queue is checked, but the whole poll waits no longer than asked
+	started := time.Now()
+	if messages, err := q.ReceiveBatch(1, 200*time.Millisecond); err != nil || len(messages) != 0 {
+		t.Fatalf("expected an empty poll, got %d (%v)", len(messages), err)
+	}
+
+	if elapsed := time.Since(started); elapsed < 200*time.Millisecond || elapsed > 350*time.Millisecond {
+		t.Fatalf("expected the poll to take about 200ms, took %s", elapsed)
+	}
+
+	// a lower priority message is found while waiting
+	low.Put(testMessage("low", awssqs.AttributeValueRecordOperationUpdate, "<r/>"))
+	if messages, err := q.ReceiveBatch(1, time.Second); err != nil || len(messages) != 1 {
+		t.Fatalf("expected the low priority message, got %d (%v)", len(messages), err)
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+)
+
+//
+// recompress rewrites the stored payloads of existing rows with the configured codec, a chunk at a
+// time so that it can run alongside the service. rows the service updates in the meantime are left
+// alone; they were written with the service's codec anyway. offloaded payloads are not touched
+//
+
+const recompressSelectQuery = `
+SELECT
+	id, payload, payload_data, payload_codec, updated_at
+FROM
+	{:table}
+WHERE
+	id > {:after} AND payload_codec <> {:codec} AND payload_ref = ''
+ORDER BY
+	id
+LIMIT
+	{:limit}
+`
+
+const recompressUpdateQuery = `
+UPDATE
+	{:table}
+SET
+	payload = {:payload}, payload_data = {:payload_data}, payload_codec = {:payload_codec}
+WHERE
+	id = {:id} AND updated_at = {:updated_at}
+`
+
+// recompressResult counts the rows visited by recompress
+type recompressResult struct {
+	examined  int
+	rewritten int
+	skipped   int // changed by someone else while we were working
+}
+
+// recompressTable rewrites the payloads in a table that aren't stored with the codec
+func recompressTable(handle *dbx.DB, table string, payloads *payloadStorage, chunkSize int, pause time.Duration) (recompressResult, error) {
+	var result recompressResult
+
+	codec := payloads.codec
+
+	// uncompressed payloads have no codec recorded
+	target := codec.name
+	if target == codecNone {
+		target = ""
+	}
+
+	selectQuery := cleanQuery(recompressSelectQuery, table)
+	updateQuery := cleanQuery(recompressUpdateQuery, table)
+
+	after := ""
+
+	for {
+		var recs []cacheRecord
+
+		err := handle.NewQuery(selectQuery).Bind(dbx.Params{"after": after, "codec": target, "limit": chunkSize}).All(&recs)
+		if err != nil {
+			return result, err
+		}
+
+		if len(recs) == 0 {
+			return result, nil
+		}
+
+		err = handle.Transactional(func(tx *dbx.Tx) error {
+			uq := tx.NewQuery(updateQuery).Prepare()
+
+			for _, rec := range recs {
+				updatedAt := rec.UpdatedAt
+				previous := rec.PayloadCodec
+
+				if err := payloads.decode(&rec); err != nil {
+					return err
+				}
+
+				stored, err := codec.encode(rec.Payload)
+				if err != nil {
+					return err
+				}
+
+				// too small (or incompressible) to be worth compressing
+				if stored.codec == previous {
+					continue
+				}
+
+				res, err := uq.Bind(dbx.Params{
+					"id":            rec.ID,
+					"updated_at":    updatedAt,
+					"payload":       stored.text,
+					"payload_data":  stored.data,
+					"payload_codec": stored.codec,
+				}).Execute()
+				if err != nil {
+					return err
+				}
+
+				if n, _ := res.RowsAffected(); n == 0 {
+					result.skipped++
+				} else {
+					result.rewritten++
+				}
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return result, err
+		}
+
+		result.examined += len(recs)
+		after = recs[len(recs)-1].ID
+
+		log.Printf("[recompress] %s: %d rows examined, %d rewritten, %d skipped", table, result.examined, result.rewritten, result.skipped)
+
+		time.Sleep(pause)
+	}
+}
+
+// recompressCommand implements the recompress subcommand
+func recompressCommand(args []string) {
+	pause := time.Duration(0)
+
+	// our own option precedes the configuration flags
+	if len(args) > 1 && args[0] == "-pause" {
+		ms, err := strconv.Atoi(args[1])
+		if err != nil || ms < 0 {
+			log.Fatalf("FATAL: usage: recompress [-pause <milliseconds>] [flags]")
+		}
+		pause = time.Duration(ms) * time.Millisecond
+		args = args[2:]
+	}
+
+	cfg := loadStoreCommandConfiguration("recompress", args)
+
+	payloads, err := newPayloadStorage(*cfg)
+	if err != nil {
+		log.Fatalf("FATAL: %s", err.Error())
+	}
+
+	store, err := NewCacheStore(*cfg, newConfiguredSecretResolver(*cfg))
+	if err != nil {
+		log.Fatalf("FATAL: %s", err.Error())
+	}
+	defer store.Close()
+
+	router, err := newCacheRouter(*cfg)
+	if err != nil {
+		log.Fatalf("FATAL: %s", err.Error())
+	}
+
+	log.Printf("[recompress] recompressing %s with %s, %d rows at a time", strings.Join(router.tables(), ", "), payloads.codec.name, cfg.PostgresBatchSize)
+
+	for _, table := range router.tables() {
+		result, err := recompressTable(storeHandle(store), table, payloads, cfg.PostgresBatchSize, pause)
+		if err != nil {
+			log.Fatalf("FATAL: %s: %s", table, err.Error())
+		}
+
+		log.Printf("[recompress] %s: done; %d rows rewritten, %d skipped", table, result.rewritten, result.skipped)
+	}
+}
+
+//
+// end of file
+//
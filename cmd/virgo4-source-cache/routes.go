@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+//
+// records can be routed to their own tables by source and/or type, so that large sources can be
+// vacuumed (and indexed) independently. routes are a comma separated list of key=table, where the key
+// is one of:
+//
+//   source           records from the source
+//   source/type      records of the type from the source
+//   */type           records of the type from any source
+//
+// the most specific matching route wins; anything unrouted goes to PostgresTable
+//
+
+// the route key wildcard
+const routeAny = "*"
+
+// cacheRouter chooses the table each record is cached in
+type cacheRouter struct {
+	defaultTable string
+	routes       map[string]string
+	all          []string // the default table, then the routed tables in order
+}
+
+// parseRoutes parses the route configuration into a map of route key to table. the tables kept
+// beside the default table can't be routed to
+func parseRoutes(value string, defaultTable string) (map[string]string, error) {
+	reserved := []string{defaultTable + quarantineSuffix, defaultTable + historySuffix}
+
+	routes := make(map[string]string)
+
+	for _, route := range strings.Split(value, ",") {
+		route = strings.TrimSpace(route)
+		if route == "" {
+			continue
+		}
+
+		key, table, found := strings.Cut(route, "=")
+		key = strings.TrimSpace(key)
+		table = strings.TrimSpace(table)
+
+		if found == false || key == "" || table == "" {
+			return nil, fmt.Errorf("route must be key=table (is [%s])", route)
+		}
+
+		if err := checkRouteKey(key); err != nil {
+			return nil, err
+		}
+
+		if validTableName.MatchString(table) == false {
+			return nil, fmt.Errorf("route table must be a lower case SQL identifier (is [%s])", table)
+		}
+
+		if slices.Contains(reserved, table) == true {
+			return nil, fmt.Errorf("route table %s is reserved for the %s table", table, strings.TrimPrefix(table, defaultTable+"_"))
+		}
+
+		if _, ok := routes[key]; ok == true {
+			return nil, fmt.Errorf("duplicate route for [%s]", key)
+		}
+
+		routes[key] = table
+	}
+
+	return routes, nil
+}
+
+// checkRouteKey checks a key is one of source, source/type or */type
+func checkRouteKey(key string) error {
+	source, recordType, typed := strings.Cut(key, "/")
+	if source == "" || (typed == true && (recordType == "" || recordType == routeAny)) || (typed == false && source == routeAny) {
+		return fmt.Errorf("route key must be source, source/type or */type (is [%s])", key)
+	}
+
+	return nil
+}
+
+// routeKeys returns the keys that match records with the source and type, most specific first
+func routeKeys(source string, recordType string) []string {
+	return []string{source + "/" + recordType, source, routeAny + "/" + recordType}
+}
+
+// newCacheRouter - the factory
+func newCacheRouter(cfg ServiceConfig) (*cacheRouter, error) {
+	routes, err := parseRoutes(cfg.PostgresRoutes, cfg.PostgresTable)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{cfg.PostgresTable: true}
+	var routed []string
+
+	for _, table := range routes {
+		if seen[table] == false {
+			seen[table] = true
+			routed = append(routed, table)
+		}
+	}
+
+	sort.Strings(routed)
+
+	// clipped, so that appending to it never writes into the router's copy
+	all := slices.Clip(append([]string{cfg.PostgresTable}, routed...))
+
+	return &cacheRouter{defaultTable: cfg.PostgresTable, routes: routes, all: all}, nil
+}
+
+// table returns the table for records with the source and type
+func (r *cacheRouter) table(source string, recordType string) string {
+	for _, key := range routeKeys(source, recordType) {
+		if table, ok := r.routes[key]; ok == true {
+			return table
+		}
+	}
+
+	return r.defaultTable
+}
+
+// tables returns every table records may be cached in: the default first, then the routed tables in order
+func (r *cacheRouter) tables() []string {
+	return r.all
+}
+
+//
+// end of file
+//
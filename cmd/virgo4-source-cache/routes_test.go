@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestRouteTable(t *testing.T) {
+	router, err := newCacheRouter(ServiceConfig{
+		PostgresTable:  "source_cache",
+		PostgresRoutes: "marc=cache_marc, marc/json=cache_marc_json, */json=cache_json",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct{ source, recordType, table string }{
+		{"marc", "json", "cache_marc_json"},
+		{"marc", "xml", "cache_marc"},
+		{"other", "json", "cache_json"},
+		{"other", "xml", "source_cache"},
+	} {
+		if table := router.table(tc.source, tc.recordType); table != tc.table {
+			t.Errorf("%s/%s: expected %s, got %s", tc.source, tc.recordType, tc.table, table)
+		}
+	}
+
+	tables := router.tables()
+	if len(tables) != 4 || tables[0] != "source_cache" {
+		t.Errorf("expected the default table and the three routed tables, got %v", tables)
+	}
+}
+
+func TestBadRoutes(t *testing.T) {
+	for _, routes := range []string{"marc", "=table", "marc=", "*=table", "marc/*=table", "marc=Bad-Name", "marc=a,marc=b", "marc=source_cache_quarantine", "*/json=source_cache_history"} {
+		if _, err := parseRoutes(routes, "source_cache"); err == nil {
+			t.Errorf("[%s]: expected an error", routes)
+		}
+	}
+}
+
+//
+// end of file
+//
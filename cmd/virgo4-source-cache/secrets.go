@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+//
+// secret configuration values (PostgresPass, PostgresDSN) may be references, resolved when they are
+// needed rather than when the configuration is loaded so that they can be refreshed:
+//
+//   file:///run/secrets/postgres_pass           the contents of a file (Docker/ECS secrets mounts)
+//   secretsmanager://secret-id                  the secret string of an AWS Secrets Manager secret
+//   secretsmanager://secret-id#password         a field of a JSON secret string (e.g. RDS managed secrets)
+//
+// anything else is used as is
+//
+
+// SecretProvider resolves secret references for a single URL scheme
+type SecretProvider interface {
+	// Resolve returns the secret identified by the reference, without the scheme
+	Resolve(reference string) (string, error)
+}
+
+// secretResolver caches resolved secrets, dispatching references to the provider for their scheme
+type secretResolver struct {
+	providers map[string]SecretProvider
+	ttl       time.Duration
+
+	sync.Mutex
+	cache map[string]cachedSecret
+}
+
+type cachedSecret struct {
+	value   string
+	expires time.Time
+}
+
+// the schemes of the providers every resolver has
+var secretSchemes = []string{"file", "secretsmanager"}
+
+// newSecretResolver - the factory
+func newSecretResolver(ttl time.Duration, secretsEndpoint string) *secretResolver {
+	r := secretResolver{
+		providers: make(map[string]SecretProvider),
+		ttl:       ttl,
+		cache:     make(map[string]cachedSecret),
+	}
+
+	r.Register(secretSchemes[0], fileSecretProvider{})
+	r.Register(secretSchemes[1], newSecretsManagerProvider(secretsEndpoint))
+
+	return &r
+}
+
+// newConfiguredSecretResolver - the factory, for the configured cache time and endpoint
+func newConfiguredSecretResolver(cfg ServiceConfig) *secretResolver {
+	return newSecretResolver(time.Duration(cfg.SecretsCacheTime)*time.Second, cfg.SecretsEndpoint)
+}
+
+// isSecretReference reports whether a value is a reference to one of the standard providers
+func isSecretReference(value string) bool {
+	scheme, _, found := strings.Cut(value, "://")
+
+	return found == true && slices.Contains(secretSchemes, scheme)
+}
+
+// Register adds a provider for references with the specified scheme
+func (r *secretResolver) Register(scheme string, provider SecretProvider) {
+	r.providers[scheme] = provider
+}
+
+// split a value into a scheme and reference, if it is a reference to a registered provider
+func (r *secretResolver) reference(value string) (SecretProvider, string, bool) {
+	scheme, reference, found := strings.Cut(value, "://")
+	if found == false {
+		return nil, "", false
+	}
+
+	provider, ok := r.providers[scheme]
+
+	return provider, reference, ok
+}
+
+// IsReference reports whether a value is a secret reference. a nil resolver has no references
+func (r *secretResolver) IsReference(value string) bool {
+	if r == nil {
+		return false
+	}
+
+	_, _, ok := r.reference(value)
+	return ok
+}
+
+// Resolve returns the secret a value refers to, or the value itself if it is not a reference
+// (or the resolver is nil)
+func (r *secretResolver) Resolve(value string) (string, error) {
+	if r == nil {
+		return value, nil
+	}
+
+	provider, reference, ok := r.reference(value)
+	if ok == false {
+		return value, nil
+	}
+
+	r.Lock()
+	cached, found := r.cache[value]
+	r.Unlock()
+
+	if found == true && time.Now().Before(cached.expires) {
+		return cached.value, nil
+	}
+
+	secret, err := provider.Resolve(reference)
+	if err != nil {
+		return "", fmt.Errorf("resolving secret %s: %w", value, err)
+	}
+
+	r.Lock()
+	r.cache[value] = cachedSecret{value: secret, expires: time.Now().Add(r.ttl)}
+	r.Unlock()
+
+	return secret, nil
+}
+
+// Refresh discards any cached secrets so that the next Resolve fetches them again (e.g. after rotation)
+func (r *secretResolver) Refresh() {
+	if r == nil {
+		return
+	}
+
+	r.Lock()
+	r.cache = make(map[string]cachedSecret)
+	r.Unlock()
+}
+
+// fileSecretProvider reads secrets from files, ignoring any trailing newline
+type fileSecretProvider struct{}
+
+func (p fileSecretProvider) Resolve(reference string) (string, error) {
+	contents, err := os.ReadFile(reference)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(contents), "\r\n"), nil
+}
+
+// secretsManagerProvider reads secrets from AWS Secrets Manager, or a compatible endpoint
+type secretsManagerProvider struct {
+	endpoint string
+
+	sync.Mutex
+	svc *secretsmanager.SecretsManager
+}
+
+// newSecretsManagerProvider - the factory
+func newSecretsManagerProvider(endpoint string) *secretsManagerProvider {
+	return &secretsManagerProvider{endpoint: endpoint}
+}
+
+// the client is created on first use so that configurations without Secrets Manager references
+// don't need AWS credentials
+func (p *secretsManagerProvider) client() (*secretsmanager.SecretsManager, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.svc == nil {
+		awsCfg := aws.NewConfig()
+		if p.endpoint != "" {
+			awsCfg = awsCfg.WithEndpoint(p.endpoint)
+		}
+
+		sess, err := session.NewSession(awsCfg)
+		if err != nil {
+			return nil, err
+		}
+
+		p.svc = secretsmanager.New(sess)
+	}
+
+	return p.svc, nil
+}
+
+func (p *secretsManagerProvider) Resolve(reference string) (string, error) {
+	id, field, _ := strings.Cut(reference, "#")
+	if id == "" {
+		return "", fmt.Errorf("missing secret id")
+	}
+
+	svc, err := p.client()
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("[secrets] INFO: fetching secret %s", id)
+
+	out, err := svc.GetSecretValue(&secretsmanager.GetSecretValueInput{SecretId: aws.String(id)})
+	if err != nil {
+		return "", err
+	}
+
+	secret := aws.StringValue(out.SecretString)
+
+	if field == "" {
+		return secret, nil
+	}
+
+	var fields map[string]interface{}
+	if err = json.Unmarshal([]byte(secret), &fields); err != nil {
+		return "", fmt.Errorf("secret is not a JSON object")
+	}
+
+	value, ok := fields[field]
+	if ok == false {
+		return "", fmt.Errorf("secret has no field [%s]", field)
+	}
+
+	return fmt.Sprint(value), nil
+}
+
+//
+// end of file
+//
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// secretsManagerStub is a minimal Secrets Manager: GetSecretValue only
+type secretsManagerStub struct {
+	sync.Mutex
+	secrets  map[string]string
+	requests int
+}
+
+func (s *secretsManagerStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Amz-Target") != "secretsmanager.GetSecretValue" {
+		http.Error(w, "unsupported operation", http.StatusBadRequest)
+		return
+	}
+
+	var in struct{ SecretId string }
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.requests++
+
+	secret, ok := s.secrets[in.SecretId]
+	if ok == false {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"ResourceNotFoundException","Message":"secret not found"}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	json.NewEncoder(w).Encode(map[string]string{"Name": in.SecretId, "SecretString": secret})
+}
+
+func (s *secretsManagerStub) set(id string, secret string) {
+	s.Lock()
+	s.secrets[id] = secret
+	s.Unlock()
+}
+
+func startSecretsManagerStub(t *testing.T) (*secretsManagerStub, string) {
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	stub := &secretsManagerStub{secrets: make(map[string]string)}
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+
+	return stub, server.URL
+}
+
+func TestFileSecret(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "postgres_pass")
+	if err := os.WriteFile(file, []byte("hunter2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newSecretResolver(time.Minute, "")
+
+	secret, err := r.Resolve("file://" + file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret != "hunter2" {
+		t.Errorf("expected [hunter2], got [%s]", secret)
+	}
+
+	// plain values are not references
+	secret, err = r.Resolve("plain://text")
+	if err != nil || secret != "plain://text" {
+		t.Errorf("expected the value back unchanged, got [%s] (%v)", secret, err)
+	}
+
+	if _, err = r.Resolve("file://" + file + ".missing"); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
+
+func TestSecretsManagerSecret(t *testing.T) {
+	stub, endpoint := startSecretsManagerStub(t)
+	stub.set("cache/postgres", `{"username":"cache","password":"hunter2"}`)
+	stub.set("cache/plain", "swordfish")
+
+	r := newSecretResolver(time.Minute, endpoint)
+
+	secret, err := r.Resolve("secretsmanager://cache/postgres#password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret != "hunter2" {
+		t.Errorf("expected [hunter2], got [%s]", secret)
+	}
+
+	secret, err = r.Resolve("secretsmanager://cache/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret != "swordfish" {
+		t.Errorf("expected [swordfish], got [%s]", secret)
+	}
+
+	if _, err = r.Resolve("secretsmanager://cache/postgres#nothing"); err == nil {
+		t.Errorf("expected an error for a missing field")
+	}
+
+	if _, err = r.Resolve("secretsmanager://cache/missing"); err == nil {
+		t.Errorf("expected an error for a missing secret")
+	}
+}
+
+func TestSecretRefresh(t *testing.T) {
+	stub, endpoint := startSecretsManagerStub(t)
+	stub.set("cache/postgres", "before")
+
+	r := newSecretResolver(time.Minute, endpoint)
+	ref := "secretsmanager://cache/postgres"
+
+	r.Resolve(ref)
+	stub.set("cache/postgres", "after")
+
+	// cached until refreshed
+	if secret, _ := r.Resolve(ref); secret != "before" {
+		t.Errorf("expected the cached secret, got [%s]", secret)
+	}
+
+	r.Refresh()
+
+	if secret, _ := r.Resolve(ref); secret != "after" {
+		t.Errorf("expected the rotated secret, got [%s]", secret)
+	}
+
+	if stub.requests != 2 {
+		t.Errorf("expected 2 requests, got %d", stub.requests)
+	}
+}
+
+func TestSecretReferenceNotRedacted(t *testing.T) {
+	cfg := defaultConfiguration()
+	cfg.PostgresPass = "secretsmanager://cache/postgres#password"
+
+	out, err := configYAML(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(out), cfg.PostgresPass) == false {
+		t.Errorf("secret reference redacted:\n%s", out)
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+//
+// a huge reload from one source shouldn't be able to saturate the database and starve the others.
+// each limited source has a token bucket of RateLimit records a second, holding up to burst of them.
+// the polling loop takes a token for each message before queueing it for the workers; when the
+// bucket is empty the message goes to the source's holding queue instead, to be released once its
+// token comes due. the workers never wait, so the other sources keep moving. records are delayed,
+// never dropped; a full holding queue pauses polling until there is room. a later message for a held
+// record (a delete with no source, say) is held behind it in the same queue, so it can't overtake it
+//
+
+// sourceBucket is the token bucket of one source
+type sourceBucket struct {
+	rate    float64 // tokens a second
+	burst   float64
+	tokens  float64 // may go negative: tokens promised to waiting workers
+	updated time.Time
+
+	held    chan limitedMessage // waiting for their tokens, in order
+	holding int                 // messages held now
+	delayed int64               // records delayed
+	delay   time.Duration       // total delay
+}
+
+// limitedMessage is a message waiting in a holding queue
+type limitedMessage struct {
+	msg    cacheMessage
+	id     string // the record id, if any
+	due    time.Time
+	target chan<- cacheMessage // the worker queue it is released to
+}
+
+// sourceLimiter holds the buckets of the limited sources; a nil limiter limits nothing
+type sourceLimiter struct {
+	normalize bool // sources are lower cased, as with NormalizeAttributes
+
+	sync.Mutex
+	buckets map[string]*sourceBucket
+	held    map[string]*heldRecord // by record id
+}
+
+// heldRecord is a record with messages in a holding queue
+type heldRecord struct {
+	bucket *sourceBucket // whose queue they are in
+	count  int
+}
+
+// parseSourceLimit parses a rate, optionally followed by :burst
+func parseSourceLimit(value string) (float64, float64, error) {
+	r, b, found := strings.Cut(value, ":")
+
+	rate, err := strconv.ParseFloat(r, 64)
+	if err != nil || rate <= 0 {
+		return 0, 0, fmt.Errorf("rate must be a positive number of records a second (is [%s])", value)
+	}
+
+	// by default a second's worth of records can go through at once
+	burst := max(rate, 1)
+	if found == true {
+		if burst, err = strconv.ParseFloat(b, 64); err != nil || burst < 1 {
+			return 0, 0, fmt.Errorf("burst must be at least 1 (is [%s])", value)
+		}
+	}
+
+	return rate, burst, nil
+}
+
+// newSourceLimiter - the factory. returns nil if no source is limited
+func newSourceLimiter(cfg ServiceConfig) (*sourceLimiter, error) {
+	limits, err := parseTypeSettings(cfg.RateLimits)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(limits) == 0 {
+		return nil, nil
+	}
+
+	l := sourceLimiter{normalize: cfg.NormalizeAttributes, buckets: make(map[string]*sourceBucket), held: make(map[string]*heldRecord)}
+	now := time.Now()
+
+	for source, limit := range limits {
+		if l.normalize == true {
+			source = strings.ToLower(source)
+		}
+
+		rate, burst, err := parseSourceLimit(limit)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", source, err)
+		}
+		l.buckets[source] = &sourceBucket{rate: rate, burst: burst, tokens: burst, updated: now, held: make(chan limitedMessage, cfg.WorkerQueueSize)}
+	}
+
+	return &l, nil
+}
+
+// reserve takes a token for a record from the source, returning how long to wait before using it
+func (l *sourceLimiter) reserve(source string, now time.Time) time.Duration {
+	if l == nil {
+		return 0
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	b, ok := l.buckets[source]
+	if ok == false {
+		return 0
+	}
+
+	if elapsed := now.Sub(b.updated); elapsed > 0 {
+		b.tokens = min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+		b.updated = now
+	}
+
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+
+	b.delayed++
+	b.delay += delay
+
+	return delay
+}
+
+// hold takes a token for the message if its source is limited. it returns false if the message can
+// go to the workers now; otherwise it has been held, to be sent to the target when its token is due.
+// a message for a record that is already held is always held behind it
+func (l *sourceLimiter) hold(msg cacheMessage, target chan<- cacheMessage) bool {
+	if l == nil {
+		return false
+	}
+
+	source, _ := msg.message.GetAttribute(awssqs.AttributeKeyRecordSource)
+	source = strings.TrimSpace(source)
+	if l.normalize == true {
+		source = strings.ToLower(source)
+	}
+
+	id, _ := msg.message.GetAttribute(awssqs.AttributeKeyRecordId)
+	id = strings.TrimSpace(id)
+
+	now := time.Now()
+	delay := l.reserve(source, now)
+
+	l.Lock()
+	b := l.buckets[source]
+	r, held := l.held[id]
+	switch {
+	case held == true:
+		b = r.bucket
+	case delay <= 0:
+		l.Unlock()
+		return false
+	case id != "":
+		r = &heldRecord{bucket: b}
+		l.held[id] = r
+	}
+	if r != nil {
+		r.count++
+	}
+	b.holding++
+	l.Unlock()
+
+	b.held <- limitedMessage{msg: msg, id: id, due: now.Add(delay), target: target}
+
+	return true
+}
+
+// release sends the held messages of each source on as their tokens come due, until the holding
+// queues are closed and drained
+func (l *sourceLimiter) release(releasing *sync.WaitGroup) {
+	if l == nil {
+		return
+	}
+
+	for _, b := range l.buckets {
+		releasing.Add(1)
+		go func(b *sourceBucket) {
+			defer releasing.Done()
+
+			for h := range b.held {
+				time.Sleep(time.Until(h.due))
+				h.target <- h.msg
+
+				l.Lock()
+				b.holding--
+				if r, ok := l.held[h.id]; ok == true {
+					if r.count--; r.count == 0 {
+						delete(l.held, h.id)
+					}
+				}
+				l.Unlock()
+			}
+		}(b)
+	}
+}
+
+// close closes the holding queues; those held are still released
+func (l *sourceLimiter) close() {
+	if l == nil {
+		return
+	}
+
+	for _, b := range l.buckets {
+		close(b.held)
+	}
+}
+
+// String summarises the delays of the limited sources that have been delayed
+func (l *sourceLimiter) String() string {
+	if l == nil {
+		return ""
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	var s []string
+	for source, b := range l.buckets {
+		if b.delayed > 0 {
+			s = append(s, fmt.Sprintf("%s = %d held, %d delayed %s", source, b.holding, b.delayed, b.delay.Round(time.Millisecond)))
+		}
+	}
+
+	sort.Strings(s)
+
+	return strings.Join(s, ", ")
+}
+
+//
+// end of file
+//
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+func TestSourceLimiter(t *testing.T) {
+	l, err := newSourceLimiter(ServiceConfig{RateLimits: "bulk = 10:2"})
+	if err != nil {
+		t.Fatalf("limiter: %s", err.Error())
+	}
+
+	now := time.Now()
+
+	// the burst goes straight through, then each record waits a tenth of a second more
+	expected := []time.Duration{0, 0, 100 * time.Millisecond, 200 * time.Millisecond}
+	for ix, e := range expected {
+		if delay := l.reserve("bulk", now); delay != e {
+			t.Fatalf("record %d: expected a delay of %s, got %s", ix+1, e, delay)
+		}
+	}
+
+	// other sources aren't limited
+	if delay := l.reserve("edits", now); delay != 0 {
+		t.Fatalf("expected an unlimited source not to wait, got %s", delay)
+	}
+
+	// the bucket refills with time, but no further than the burst
+	if delay := l.reserve("bulk", now.Add(time.Minute)); delay != 0 {
+		t.Fatalf("expected a refilled bucket not to wait, got %s", delay)
+	}
+
+	for _, bad := range []string{"bulk", "bulk=0", "bulk=10:0", "bulk=x"} {
+		if _, err := newSourceLimiter(ServiceConfig{RateLimits: bad}); err == nil {
+			t.Errorf("expected limit [%s] to be rejected", bad)
+		}
+	}
+}
+
+func TestSourceHolding(t *testing.T) {
+	l, err := newSourceLimiter(ServiceConfig{RateLimits: "test = 20:1", WorkerQueueSize: 10})
+	if err != nil {
+		t.Fatalf("limiter: %s", err.Error())
+	}
+
+	var releasing sync.WaitGroup
+	l.release(&releasing)
+
+	out := make(chan cacheMessage, 10)
+	started := time.Now()
+
+	// the first goes straight through and the rest are held, without blocking the caller
+	for ix := 0; ix < 3; ix++ {
+		msg := cacheMessage{message: testMessage("r", awssqs.AttributeValueRecordOperationUpdate, "<r/>")}
+		if held := l.hold(msg, out); held != (ix > 0) {
+			t.Fatalf("message %d: expected held to be %t", ix+1, ix > 0)
+		}
+	}
+
+	if elapsed := time.Since(started); elapsed > 20*time.Millisecond {
+		t.Fatalf("expected holding not to wait, took %s", elapsed)
+	}
+
+	l.close()
+	releasing.Wait()
+
+	if len(out) != 2 || time.Since(started) < 100*time.Millisecond {
+		t.Fatalf("expected 2 messages released after 100ms, got %d after %s", len(out), time.Since(started))
+	}
+}
+
+func TestSourceHoldingKeepsRecordOrder(t *testing.T) {
+	l, err := newSourceLimiter(ServiceConfig{RateLimits: "test = 20:1", WorkerQueueSize: 10})
+	if err != nil {
+		t.Fatalf("limiter: %s", err.Error())
+	}
+
+	var releasing sync.WaitGroup
+	l.release(&releasing)
+
+	out := make(chan cacheMessage, 10)
+
+	// the bucket's token goes on another record, so the update is held
+	l.hold(cacheMessage{message: testMessage("other", awssqs.AttributeValueRecordOperationUpdate, "<r/>")}, out)
+	if l.hold(cacheMessage{message: testMessage("r", awssqs.AttributeValueRecordOperationUpdate, "<r/>")}, out) == false {
+		t.Fatal("expected the update to be held")
+	}
+
+	// a delete with no source isn't limited, but mustn't overtake the held update
+	remove := testMessage("r", awssqs.AttributeValueRecordOperationDelete, "")
+	remove.Attribs = awssqs.Attributes{remove.Attribs[0], remove.Attribs[3]}
+	if l.hold(cacheMessage{message: remove}, out) == false {
+		t.Fatal("expected the delete to be held behind the update")
+	}
+
+	// once released, the record is no longer held
+	l.close()
+	releasing.Wait()
+
+	if len(out) != 2 {
+		t.Fatalf("expected 2 messages released, got %d", len(out))
+	}
+	for _, expected := range []string{awssqs.AttributeValueRecordOperationUpdate, awssqs.AttributeValueRecordOperationDelete} {
+		released := <-out
+		operation, _ := released.message.GetAttribute(awssqs.AttributeKeyRecordOperation)
+		if operation != expected {
+			t.Fatalf("expected %s to be released next, got %s", expected, operation)
+		}
+	}
+
+	if len(l.held) != 0 {
+		t.Fatalf("expected no held records, got %d", len(l.held))
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+)
+
+//
+// cache statistics: rows and payload bytes by source and type, the updated_at range and recent growth
+// of each table, and (for postgres) the table and index sizes and the dead tuple counts that decide
+// when autovacuum runs (see migration 000002). counting every row of a large postgres table takes a
+// while, so beyond statsExactRows the figures are scaled up from a sample and marked as estimates; the
+// updated_at range always covers the whole table, read from the updated_at index (see migration 000011).
+// a partitioned table's figures are the totals over its partitions
+//
+
+// tables with more rows than this (by the planner's estimate) are sampled
+const statsExactRows = 1000000
+
+// the payload bytes of a row; offloaded payloads are not counted
+var statsPayloadBytes = map[string]string{
+	storePostgres: "octet_length(payload) + COALESCE(octet_length(payload_data), 0)",
+	storeSqlite:   "length(CAST(payload AS BLOB)) + COALESCE(length(payload_data), 0)",
+}
+
+const statsGroupQuery = `
+SELECT
+	source, type, COUNT(*) AS rows, COALESCE(SUM({:bytes}), 0) AS payload_bytes,
+	SUM(CASE WHEN created_at >= {:day} THEN 1 ELSE 0 END) AS created_day,
+	SUM(CASE WHEN created_at >= {:week} THEN 1 ELSE 0 END) AS created_week
+FROM
+	{:table}{:sample}
+GROUP BY
+	source, type
+ORDER BY
+	source, type
+`
+
+// the oldest (or newest) update, by way of the column itself so that sqlite knows it's a time
+const statsUpdatedQuery = `
+SELECT
+	updated_at
+FROM
+	{:table}
+ORDER BY
+	updated_at {:order}
+LIMIT
+	1
+`
+
+// the update range from the ends of the updated_at index, for postgres
+const statsUpdateRangeQuery = `
+SELECT
+	MIN(updated_at) AS oldest, MAX(updated_at) AS newest
+FROM
+	{:table}
+`
+
+// the table and, if it is partitioned, its partitions; only those with storage of their own count
+const statsRelations = `
+WITH RECURSIVE rels(rel) AS (
+	SELECT to_regclass({:relation})
+	UNION ALL
+	SELECT i.inhrelid FROM pg_inherits i JOIN rels ON i.inhparent = rels.rel
+)
+`
+
+const statsEstimateQuery = statsRelations + `
+SELECT
+	COALESCE(SUM(GREATEST(c.reltuples, 0)), 0)::bigint
+FROM
+	rels JOIN pg_class c ON c.oid = rels.rel
+WHERE
+	c.relkind = 'r'
+`
+
+const statsStorageQuery = statsRelations + `
+SELECT
+	pg_table_size(c.oid) AS table_bytes, pg_indexes_size(c.oid) AS index_bytes,
+	COALESCE(s.n_live_tup, 0) AS live_tuples, COALESCE(s.n_dead_tup, 0) AS dead_tuples,
+	s.last_autovacuum AS last_autovacuum, COALESCE(s.autovacuum_count, 0) AS autovacuum_count,
+	COALESCE(array_to_string(c.reloptions, ', '), '') AS options
+FROM
+	rels JOIN pg_class c ON c.oid = rels.rel LEFT JOIN pg_stat_user_tables s ON s.relid = c.oid
+WHERE
+	c.relkind = 'r'
+`
+
+// the postgres autovacuum defaults, for tables that don't set their own
+const (
+	defaultVacuumThreshold   = 50
+	defaultVacuumScaleFactor = 0.2
+)
+
+// groupStats are the statistics of the records with a source and type
+type groupStats struct {
+	Source       string `db:"source" json:"source"`
+	Type         string `db:"type" json:"type"`
+	Rows         int64  `db:"rows" json:"rows"`
+	PayloadBytes int64  `db:"payload_bytes" json:"payload_bytes"`
+	CreatedDay   int64  `db:"created_day" json:"created_last_day"`
+	CreatedWeek  int64  `db:"created_week" json:"created_last_week"`
+}
+
+// storageStats are the postgres storage statistics of a table
+type storageStats struct {
+	TableBytes      int64      `db:"table_bytes" json:"table_bytes"`
+	IndexBytes      int64      `db:"index_bytes" json:"index_bytes"`
+	LiveTuples      int64      `db:"live_tuples" json:"live_tuples"`
+	DeadTuples      int64      `db:"dead_tuples" json:"dead_tuples"`
+	LastAutovacuum  *time.Time `db:"last_autovacuum" json:"last_autovacuum"`
+	AutovacuumCount int64      `db:"autovacuum_count" json:"autovacuum_count"`
+	VacuumAt        int64      `json:"vacuum_at_dead_tuples"` // when autovacuum will run; summed over partitions
+	Options         string     `db:"options" json:"options"`
+}
+
+// tableStats are the statistics of a cache table
+type tableStats struct {
+	Table        string        `json:"table"`
+	Estimated    bool          `json:"estimated"` // the counts are scaled up from a sample
+	Rows         int64         `json:"rows"`
+	PayloadBytes int64         `json:"payload_bytes"`
+	CreatedDay   int64         `json:"created_last_day"`
+	CreatedWeek  int64         `json:"created_last_week"`
+	OldestUpdate *time.Time    `json:"oldest_update"`
+	NewestUpdate *time.Time    `json:"newest_update"`
+	Groups       []groupStats  `json:"groups"`
+	Storage      *storageStats `json:"storage,omitempty"` // postgres only
+}
+
+// vacuumThreshold is the number of dead tuples at which autovacuum runs, given the table options
+func vacuumThreshold(options string, liveTuples int64) int64 {
+	threshold := float64(defaultVacuumThreshold)
+	scale := defaultVacuumScaleFactor
+
+	for _, option := range strings.Split(options, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(option), "=")
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			continue
+		}
+
+		switch name {
+		case "autovacuum_vacuum_threshold":
+			threshold = v
+		case "autovacuum_vacuum_scale_factor":
+			scale = v
+		}
+	}
+
+	return int64(threshold + scale*float64(liveTuples))
+}
+
+// updatedAt returns the oldest or newest update in the table, or nil if it is empty
+func updatedAt(handle *dbx.DB, table string, order string) (*time.Time, error) {
+	query := strings.ReplaceAll(cleanQuery(statsUpdatedQuery, table), "{:order}", order)
+
+	var t time.Time
+	err := handle.NewQuery(query).Row(&t)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// updateRange returns the oldest and newest updates in the whole table, nil if it is empty
+func updateRange(handle *dbx.DB, table string) (*time.Time, *time.Time, error) {
+	if handle.DriverName() != storePostgres {
+		oldest, err := updatedAt(handle, table, "ASC")
+		if err != nil {
+			return nil, nil, err
+		}
+		newest, err := updatedAt(handle, table, "DESC")
+		return oldest, newest, err
+	}
+
+	var r struct {
+		Oldest *time.Time `db:"oldest"`
+		Newest *time.Time `db:"newest"`
+	}
+
+	err := handle.NewQuery(cleanQuery(statsUpdateRangeQuery, table)).One(&r)
+
+	return r.Oldest, r.Newest, err
+}
+
+// storageTotals adds up the storage statistics of a table's relations: the table itself, or the
+// partitions of a partitioned table
+func storageTotals(relations []storageStats) storageStats {
+	var total storageStats
+
+	for _, r := range relations {
+		total.TableBytes += r.TableBytes
+		total.IndexBytes += r.IndexBytes
+		total.LiveTuples += r.LiveTuples
+		total.DeadTuples += r.DeadTuples
+		total.AutovacuumCount += r.AutovacuumCount
+		total.VacuumAt += vacuumThreshold(r.Options, r.LiveTuples)
+
+		if r.LastAutovacuum != nil && (total.LastAutovacuum == nil || r.LastAutovacuum.After(*total.LastAutovacuum) == true) {
+			total.LastAutovacuum = r.LastAutovacuum
+		}
+	}
+
+	return total
+}
+
+// computeTableStats computes the statistics of a table
+func computeTableStats(handle *dbx.DB, table string, now time.Time) (tableStats, error) {
+	stats := tableStats{Table: table}
+	driver := handle.DriverName()
+
+	// large postgres tables are sampled; the counts are scaled up to match
+	sample := ""
+	scale := int64(1)
+
+	if driver == storePostgres {
+		var estimate int64
+		if err := handle.NewQuery(statsEstimateQuery).Bind(dbx.Params{"relation": table}).Row(&estimate); err != nil {
+			return stats, err
+		}
+
+		if estimate > statsExactRows {
+			scale = (estimate + statsExactRows - 1) / statsExactRows
+			sample = fmt.Sprintf(" TABLESAMPLE SYSTEM (%f)", 100/float64(scale))
+			stats.Estimated = true
+		}
+	}
+
+	query := strings.NewReplacer("{:bytes}", statsPayloadBytes[driver], "{:sample}", sample).Replace(cleanQuery(statsGroupQuery, table))
+	params := dbx.Params{"day": now.Add(-24 * time.Hour).UTC(), "week": now.Add(-7 * 24 * time.Hour).UTC()}
+
+	if err := handle.NewQuery(query).Bind(params).All(&stats.Groups); err != nil {
+		return stats, err
+	}
+
+	for ix := range stats.Groups {
+		g := &stats.Groups[ix]
+		g.Rows *= scale
+		g.PayloadBytes *= scale
+		g.CreatedDay *= scale
+		g.CreatedWeek *= scale
+
+		stats.Rows += g.Rows
+		stats.PayloadBytes += g.PayloadBytes
+		stats.CreatedDay += g.CreatedDay
+		stats.CreatedWeek += g.CreatedWeek
+	}
+
+	// a sample would miss the extremes
+	var err error
+	if stats.OldestUpdate, stats.NewestUpdate, err = updateRange(handle, table); err != nil {
+		return stats, err
+	}
+
+	if driver == storePostgres {
+		var relations []storageStats
+		if err = handle.NewQuery(statsStorageQuery).Bind(dbx.Params{"relation": table}).All(&relations); err != nil {
+			return stats, err
+		}
+
+		storage := storageTotals(relations)
+		if storage.Options, err = tableOptions(handle, table); err != nil {
+			return stats, err
+		}
+
+		stats.Storage = &storage
+	}
+
+	return stats, nil
+}
+
+// computeStats computes the statistics of each of the tables
+func computeStats(handle *dbx.DB, tables []string, now time.Time) ([]tableStats, error) {
+	all := make([]tableStats, 0, len(tables))
+
+	for _, table := range tables {
+		stats, err := computeTableStats(handle, table, now)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", table, err)
+		}
+		all = append(all, stats)
+	}
+
+	return all, nil
+}
+
+// formatTime formats an optional time for the report
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+
+	return t.UTC().Format(time.RFC3339)
+}
+
+// writeStats writes the statistics as a readable report
+func writeStats(out io.Writer, all []tableStats) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+
+	for _, stats := range all {
+		approx := ""
+		if stats.Estimated == true {
+			approx = "~"
+		}
+
+		fmt.Fprintf(w, "table %s\n", stats.Table)
+		fmt.Fprintf(w, "  rows:\t%s%d\n", approx, stats.Rows)
+		fmt.Fprintf(w, "  payload bytes:\t%s%d\n", approx, stats.PayloadBytes)
+		fmt.Fprintf(w, "  created in the last day / week:\t%s%d / %d\n", approx, stats.CreatedDay, stats.CreatedWeek)
+		fmt.Fprintf(w, "  updated between:\t%s and %s\n", formatTime(stats.OldestUpdate), formatTime(stats.NewestUpdate))
+
+		if s := stats.Storage; s != nil {
+			fmt.Fprintf(w, "  table / index bytes:\t%d / %d\n", s.TableBytes, s.IndexBytes)
+			fmt.Fprintf(w, "  live / dead tuples:\t%d / %d (autovacuum at %d dead)\n", s.LiveTuples, s.DeadTuples, s.VacuumAt)
+			fmt.Fprintf(w, "  autovacuums:\t%d (last %s)\n", s.AutovacuumCount, formatTime(s.LastAutovacuum))
+			if s.Options != "" {
+				fmt.Fprintf(w, "  options:\t%s\n", s.Options)
+			}
+		}
+
+		fmt.Fprintf(w, "\n  source\ttype\trows\tpayload bytes\tcreated (day)\tcreated (week)\n")
+		for _, g := range stats.Groups {
+			fmt.Fprintf(w, "  %s\t%s\t%s%d\t%d\t%d\t%d\n", g.Source, g.Type, approx, g.Rows, g.PayloadBytes, g.CreatedDay, g.CreatedWeek)
+		}
+
+		fmt.Fprintln(w)
+	}
+
+	w.Flush()
+}
+
+// statsCommand implements the stats subcommand
+func statsCommand(args []string) {
+	asJSON := false
+
+	// our own option precedes the configuration flags
+	if len(args) > 0 && args[0] == "-json" {
+		asJSON = true
+		args = args[1:]
+	}
+
+	cfg := loadStoreCommandConfiguration("stats", args)
+
+	store, err := NewCacheStore(*cfg, newConfiguredSecretResolver(*cfg))
+	if err != nil {
+		log.Fatalf("FATAL: %s", err.Error())
+	}
+	defer store.Close()
+
+	router, err := newCacheRouter(*cfg)
+	if err != nil {
+		log.Fatalf("FATAL: %s", err.Error())
+	}
+
+	all, err := computeStats(storeHandle(store), router.tables(), time.Now())
+	if err != nil {
+		log.Fatalf("FATAL: %s", err.Error())
+	}
+
+	if asJSON == true {
+		out, _ := json.MarshalIndent(all, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+
+	writeStats(os.Stdout, all)
+}
+
+//
+// end of file
+//
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVacuumThreshold(t *testing.T) {
+	// the postgres defaults...
+	if at := vacuumThreshold("", 1000); at != 250 {
+		t.Errorf("expected autovacuum at 250 dead tuples, got %d", at)
+	}
+
+	// ...and the settings of migration 000002
+	options := "autovacuum_vacuum_scale_factor=0.0, autovacuum_vacuum_threshold=10000, autovacuum_analyze_threshold=10000"
+	if at := vacuumThreshold(options, 1000000); at != 10000 {
+		t.Errorf("expected autovacuum at 10000 dead tuples, got %d", at)
+	}
+}
+
+func TestStorageTotals(t *testing.T) {
+	earlier := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	later := earlier.Add(time.Hour)
+
+	// the partitions of a partitioned table, each with its own autovacuum threshold
+	total := storageTotals([]storageStats{
+		{TableBytes: 100, LiveTuples: 1000, DeadTuples: 10, LastAutovacuum: &earlier, AutovacuumCount: 1},
+		{TableBytes: 200, LiveTuples: 1000000, DeadTuples: 20, LastAutovacuum: &later, AutovacuumCount: 2,
+			Options: "autovacuum_vacuum_scale_factor=0.0, autovacuum_vacuum_threshold=10000"},
+	})
+
+	if total.TableBytes != 300 || total.LiveTuples != 1001000 || total.DeadTuples != 30 || total.AutovacuumCount != 3 {
+		t.Fatalf("expected the partitions to be added up, got %+v", total)
+	}
+
+	if total.VacuumAt != 250+10000 || total.LastAutovacuum.Equal(later) == false {
+		t.Fatalf("expected autovacuum at 10250 dead tuples and last at %s, got %d and %s", later, total.VacuumAt, total.LastAutovacuum)
+	}
+}
+
+//
+// end of file
+//
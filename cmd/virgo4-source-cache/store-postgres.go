@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"github.com/lib/pq"
+)
+
+const postgresUpsertQuery = `
+INSERT
+INTO
+	{:table}
+		(id, type, source, payload, payload_data, payload_codec, payload_ref, expires_at, created_at, updated_at)
+VALUES
+	({:id}, {:type}, {:source}, {:payload}, {:payload_data}, {:payload_codec}, {:payload_ref}, {:expires_at}, now(), now())
+ON CONFLICT
+	(id)
+DO
+	UPDATE SET
+		(type, source, payload, payload_data, payload_codec, payload_ref, expires_at, updated_at)
+			= (EXCLUDED.type, EXCLUDED.source, EXCLUDED.payload, EXCLUDED.payload_data, EXCLUDED.payload_codec, EXCLUDED.payload_ref, EXCLUDED.expires_at, EXCLUDED.updated_at)
+`
+
+// when the table is partitioned by source, the source is part of the key
+const postgresPartitionedUpsertQuery = `
+INSERT
+INTO
+	{:table}
+		(id, type, source, payload, payload_data, payload_codec, payload_ref, expires_at, created_at, updated_at)
+VALUES
+	({:id}, {:type}, {:source}, {:payload}, {:payload_data}, {:payload_codec}, {:payload_ref}, {:expires_at}, now(), now())
+ON CONFLICT
+	(id, source)
+DO
+	UPDATE SET
+		(type, payload, payload_data, payload_codec, payload_ref, expires_at, updated_at)
+			= (EXCLUDED.type, EXCLUDED.payload, EXCLUDED.payload_data, EXCLUDED.payload_codec, EXCLUDED.payload_ref, EXCLUDED.expires_at, EXCLUDED.updated_at)
+`
+
+// the prior payload reference of a record is read under a lock on the id in the table, so that updates of
+// the same id wait for each other (even when the record is new) and each sees the object the previous one
+// left. batches are in table then id order, so the locks are taken in a consistent order
+const postgresPayloadRefQuery = `
+SELECT
+	COALESCE((SELECT payload_ref FROM {:table} WHERE id = {:id} FOR UPDATE), '')
+FROM
+	(SELECT pg_advisory_xact_lock(hashtext('{:table}'), hashtext({:id}))) locked
+`
+
+// an id is kept to one source of a partitioned table: updates of the id wait for each other, and remove
+// it from the other sources before upserting
+const postgresIDLockQuery = `
+SELECT pg_advisory_xact_lock(hashtext('{:table}'), hashtext({:id}))
+`
+
+const postgresMovedQuery = `
+DELETE
+FROM
+	{:table}
+WHERE
+	id = {:id} AND source <> {:source}
+`
+
+const postgresDeleteQuery = `
+DELETE
+FROM
+	{:table}
+WHERE
+	id = {:id}
+`
+
+// the table routed records go to, when it doesn't already exist
+const postgresCreateTableQuery = `
+CREATE TABLE IF NOT EXISTS {:table} (LIKE {:like} INCLUDING ALL)
+`
+
+// postgresStore is the CacheStore backed by Postgres; the production default
+type postgresStore struct {
+	sync.Mutex      // guards queries, which change when a table is converted while we run
+	handle          *dbx.DB
+	router          *cacheRouter
+	payloads        *payloadStorage
+	queries         storeQueries
+	historyVersions int
+}
+
+// newPostgresStore - the factory
+func newPostgresStore(cfg ServiceConfig, secrets *secretResolver) (*postgresStore, error) {
+
+	// connect to database
+	log.Printf("[store] creating postgres connection")
+
+	// secrets are resolved as each connection is made, so rotated credentials are picked up
+	db := dbx.NewFromDB(sql.OpenDB(&postgresConnector{cfg: cfg, secrets: secrets}), "postgres")
+	if err := db.DB().Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// the handle is shared by every worker; size the pool to match
+	maxOpen, maxIdle := postgresPoolSize(cfg)
+	db.DB().SetMaxOpenConns(maxOpen)
+	db.DB().SetMaxIdleConns(maxIdle)
+	db.DB().SetConnMaxLifetime(time.Duration(cfg.PostgresLifetime) * time.Second)
+
+	log.Printf("[store] postgres pool: max open = %d, max idle = %d, lifetime = %ds", maxOpen, maxIdle, cfg.PostgresLifetime)
+
+	router, err := newCacheRouter(cfg)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	payloads, err := newPayloadStorage(cfg)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// routed tables start out like the cache table; their storage settings are then up to us
+	if cfg.PostgresCreateTables == true {
+		for _, table := range router.tables()[1:] {
+			log.Printf("[store] creating table %s (if necessary)", table)
+
+			query := strings.ReplaceAll(cleanQuery(postgresCreateTableQuery, table), "{:like}", cfg.PostgresTable)
+			if _, err = db.NewQuery(query).Execute(); err != nil {
+				db.Close()
+				return nil, err
+			}
+		}
+	}
+
+	s := postgresStore{
+		handle:          db,
+		router:          router,
+		payloads:        payloads,
+		historyVersions: cfg.HistoryVersions,
+	}
+
+	if s.queries, err = s.detectQueries(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// postgresPoolSize returns the connection pool limits, derived from the worker count unless configured
+func postgresPoolSize(cfg ServiceConfig) (int, int) {
+	// enough for the largest the worker pool may grow to
+	workers := max(cfg.Workers, cfg.WorkersMax)
+
+	maxOpen := cfg.PostgresMaxOpen
+	if maxOpen == 0 {
+		// a connection per worker, plus headroom for everything else
+		maxOpen = workers + 2
+	}
+
+	maxIdle := cfg.PostgresMaxIdle
+	if maxIdle == 0 {
+		maxIdle = workers
+	}
+
+	if maxIdle > maxOpen {
+		maxIdle = maxOpen
+	}
+
+	return maxOpen, maxIdle
+}
+
+// quote a value for a key=value connection string
+func postgresQuote(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
+}
+
+// postgresConnectionString builds the connection string from either the configured DSN (in key=value
+// or URL form) or the individual settings. TLS and timeout settings apply to both, overriding the DSN
+func postgresConnectionString(cfg ServiceConfig) (string, error) {
+	options := make(map[string]string)
+
+	if cfg.PostgresSSLMode != "" {
+		options["sslmode"] = cfg.PostgresSSLMode
+	}
+
+	if cfg.PostgresSSLCA != "" {
+		options["sslrootcert"] = cfg.PostgresSSLCA
+	}
+
+	if cfg.PostgresTimeout > 0 {
+		options["connect_timeout"] = strconv.Itoa(cfg.PostgresTimeout)
+	}
+
+	// predictable ordering
+	keys := make([]string, 0, len(options))
+	for k := range options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	dsn := cfg.PostgresDSN
+
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			// don't echo the DSN, it probably contains a password
+			return "", fmt.Errorf("invalid postgres URL")
+		}
+
+		q := u.Query()
+		for _, k := range keys {
+			q.Set(k, options[k])
+		}
+		u.RawQuery = q.Encode()
+
+		return u.String(), nil
+	}
+
+	if dsn == "" {
+		dsn = fmt.Sprintf("user=%s password=%s dbname=%s host=%s port=%d",
+			postgresQuote(cfg.PostgresUser), postgresQuote(cfg.PostgresPass), postgresQuote(cfg.PostgresDatabase),
+			postgresQuote(cfg.PostgresHost), cfg.PostgresPort)
+	}
+
+	// later settings take precedence
+	for _, k := range keys {
+		dsn += fmt.Sprintf(" %s=%s", k, postgresQuote(options[k]))
+	}
+
+	return dsn, nil
+}
+
+// postgresConnector makes connections using the current secret values. When a connection fails
+// authentication the secrets are refreshed and it is tried again, in case they have been rotated
+type postgresConnector struct {
+	cfg     ServiceConfig
+	secrets *secretResolver
+}
+
+func (c *postgresConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.connect(ctx)
+
+	if postgresAuthFailure(err) == true && (c.secrets.IsReference(c.cfg.PostgresPass) || c.secrets.IsReference(c.cfg.PostgresDSN)) {
+		log.Printf("[store] WARNING: postgres authentication failed, refreshing secrets")
+		c.secrets.Refresh()
+		conn, err = c.connect(ctx)
+	}
+
+	return conn, err
+}
+
+func (c *postgresConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+func (c *postgresConnector) connect(ctx context.Context) (driver.Conn, error) {
+	cfg := c.cfg
+
+	var err error
+	if cfg.PostgresPass, err = c.secrets.Resolve(cfg.PostgresPass); err != nil {
+		return nil, err
+	}
+
+	if cfg.PostgresDSN, err = c.secrets.Resolve(cfg.PostgresDSN); err != nil {
+		return nil, err
+	}
+
+	connStr, err := postgresConnectionString(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	connector, err := pq.NewConnector(connStr)
+	if err != nil {
+		return nil, err
+	}
+
+	return connector.Connect(ctx)
+}
+
+// postgresAuthFailure reports whether an error is the server rejecting our credentials
+func postgresAuthFailure(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) == false {
+		return false
+	}
+
+	// invalid_password, invalid_authorization_specification
+	return pqErr.Code == "28P01" || pqErr.Code == "28000"
+}
+
+// detectQueries builds the queries for the tables as they are now: partitioned tables (and tables
+// created like them) upsert on the partitioned key
+func (s *postgresStore) detectQueries() (storeQueries, error) {
+	queries := newStoreQueries(s.router, postgresUpsertQuery, postgresDeleteQuery, s.historyVersions)
+
+	for table := range queries.payloadRef {
+		queries.payloadRef[table] = cleanQuery(postgresPayloadRefQuery, table)
+	}
+
+	for _, table := range s.router.tables() {
+		partitioned, err := keyIncludesSource(s.handle, table)
+		if err != nil {
+			return storeQueries{}, err
+		}
+
+		if partitioned == true {
+			log.Printf("[store] %s is keyed on (id, source)", table)
+			queries.upsert[table] = cleanQuery(postgresPartitionedUpsertQuery, table)
+			queries.moved[table] = []string{cleanQuery(postgresIDLockQuery, table), cleanQuery(postgresMovedQuery, table)}
+		}
+	}
+
+	return queries, nil
+}
+
+// postgresKeyChanged reports whether an error is an upsert no longer matching the table's key,
+// as happens once "partition convert" swaps in the partitioned table
+func postgresKeyChanged(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) == false {
+		return false
+	}
+
+	// invalid_column_reference: no unique or exclusion constraint matching the ON CONFLICT specification
+	return pqErr.Code == "42P10"
+}
+
+func (s *postgresStore) WriteBatch(ops []cacheOperation) error {
+	s.Lock()
+	queries := s.queries
+	s.Unlock()
+
+	err := writeBatch(s.handle, queries, s.payloads, ops, nil)
+	if postgresKeyChanged(err) == false {
+		return err
+	}
+
+	// the batch was rolled back; pick up the new key and write it again
+	log.Printf("[store] a table key has changed (%s); detecting the keys again", err.Error())
+
+	if queries, err = s.detectQueries(); err != nil {
+		return err
+	}
+
+	s.Lock()
+	s.queries = queries
+	s.Unlock()
+
+	return writeBatch(s.handle, queries, s.payloads, ops, nil)
+}
+
+func (s *postgresStore) Get(id string) (*cacheRecord, error) {
+	return getRecord(s.handle, s.router.tables(), s.payloads, id)
+}
+
+func (s *postgresStore) GetBatch(ids []string) (map[string]*cacheRecord, error) {
+	return getRecords(s.handle, s.router.tables(), s.payloads, ids)
+}
+
+func (s *postgresStore) History(id string) ([]recordVersion, error) {
+	return getHistory(s.handle, s.router.defaultTable+historySuffix, s.payloads, id)
+}
+
+func (s *postgresStore) Iterate(filter cacheFilter, fn func(cacheRecord) error) error {
+	return iterateRecords(s.handle, s.router.tables(), s.payloads, filter, fn)
+}
+
+func (s *postgresStore) Close() error {
+	return s.handle.Close()
+}
+
+//
+// end of file
+//
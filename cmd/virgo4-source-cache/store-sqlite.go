@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	_ "modernc.org/sqlite"
+)
+
+// sqlite has no migrations of its own; the schema mirrors db/migrations
+const sqliteSchemaQuery = `
+CREATE TABLE IF NOT EXISTS {:table} (
+	id         VARCHAR(256) PRIMARY KEY,
+	type       VARCHAR(32) NOT NULL,
+	source     VARCHAR(32) NOT NULL,
+	payload    TEXT NOT NULL,
+	payload_data  BLOB,
+	payload_codec VARCHAR(16) NOT NULL DEFAULT '',
+	payload_ref   VARCHAR(1024) NOT NULL DEFAULT '',
+	expires_at    TIMESTAMP,
+	created_at TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP NOT NULL
+)
+`
+
+const sqliteIndexQuery = `
+CREATE INDEX IF NOT EXISTS {:table}_source_idx ON {:table}(source)
+`
+
+// the update range of the stats, and purges by update time
+const sqliteUpdatedIndexQuery = `
+CREATE INDEX IF NOT EXISTS {:table}_updated_idx ON {:table}(updated_at)
+`
+
+const sqliteQuarantineSchemaQuery = `
+CREATE TABLE IF NOT EXISTS {:table} (
+	seq         INTEGER PRIMARY KEY AUTOINCREMENT,
+	id          VARCHAR(256) NOT NULL,
+	type        VARCHAR(32) NOT NULL,
+	source      VARCHAR(32) NOT NULL,
+	payload     BLOB NOT NULL,
+	reason      TEXT NOT NULL,
+	received_at TIMESTAMP NOT NULL
+)
+`
+
+var sqliteHistorySchemaQueries = []string{`
+CREATE TABLE IF NOT EXISTS {:table} (
+	seq           INTEGER PRIMARY KEY AUTOINCREMENT,
+	id            VARCHAR(256) NOT NULL,
+	type          VARCHAR(32) NOT NULL,
+	source        VARCHAR(32) NOT NULL,
+	payload       TEXT NOT NULL,
+	payload_data  BLOB,
+	payload_codec VARCHAR(16) NOT NULL DEFAULT '',
+	updated_at    TIMESTAMP NOT NULL,
+	replaced_at   TIMESTAMP NOT NULL
+)`, `
+CREATE INDEX IF NOT EXISTS {:table}_id_idx ON {:table}(id, seq)
+`}
+
+// columns added since the schema was first created, for existing databases
+var sqliteAddedColumns = []struct{ name, definition string }{
+	{"payload_data", "BLOB"},
+	{"payload_codec", "VARCHAR(16) NOT NULL DEFAULT ''"},
+	{"payload_ref", "VARCHAR(1024) NOT NULL DEFAULT ''"},
+	{"expires_at", "TIMESTAMP"},
+}
+
+// the reaper looks for expired records; most never expire
+const sqliteExpiresIndexQuery = `
+CREATE INDEX IF NOT EXISTS {:table}_expires_idx ON {:table}(expires_at) WHERE expires_at IS NOT NULL
+`
+
+const sqliteUpsertQuery = `
+INSERT
+INTO
+	{:table}
+		(id, type, source, payload, payload_data, payload_codec, payload_ref, expires_at, created_at, updated_at)
+VALUES
+	({:id}, {:type}, {:source}, {:payload}, {:payload_data}, {:payload_codec}, {:payload_ref}, {:expires_at}, {:now}, {:now})
+ON CONFLICT
+	(id)
+DO
+	UPDATE SET
+		type = excluded.type,
+		source = excluded.source,
+		payload = excluded.payload,
+		payload_data = excluded.payload_data,
+		payload_codec = excluded.payload_codec,
+		payload_ref = excluded.payload_ref,
+		expires_at = excluded.expires_at,
+		updated_at = excluded.updated_at
+`
+
+const sqliteDeleteQuery = `
+DELETE
+FROM
+	{:table}
+WHERE
+	id = {:id}
+`
+
+// sqliteStore is the CacheStore backed by an SQLite database file, so that the full pipeline
+// can be run without a Postgres server
+type sqliteStore struct {
+	handle   *dbx.DB
+	router   *cacheRouter
+	payloads *payloadStorage
+	queries  storeQueries
+}
+
+// newSqliteStore - the factory
+func newSqliteStore(cfg ServiceConfig) (*sqliteStore, error) {
+
+	log.Printf("[store] opening sqlite database %s", cfg.SqlitePath)
+
+	// writers wait on each other rather than failing with SQLITE_BUSY
+	connStr := fmt.Sprintf("file:%s?_pragma=busy_timeout(30000)&_pragma=journal_mode(WAL)", cfg.SqlitePath)
+
+	db, err := dbx.MustOpen("sqlite", connStr)
+	if err != nil {
+		return nil, err
+	}
+
+	// sqlite supports a single writer; serialize everything through one connection
+	db.DB().SetMaxOpenConns(1)
+
+	router, err := newCacheRouter(cfg)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	payloads, err := newPayloadStorage(cfg)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	for _, table := range router.tables() {
+		if err = sqliteCreateTable(db, table); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	if _, err = db.NewQuery(cleanQuery(sqliteQuarantineSchemaQuery, router.defaultTable+quarantineSuffix)).Execute(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	for _, q := range sqliteHistorySchemaQueries {
+		if _, err = db.NewQuery(cleanQuery(q, router.defaultTable+historySuffix)).Execute(); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	s := sqliteStore{
+		handle:   db,
+		router:   router,
+		payloads: payloads,
+		queries:  newStoreQueries(router, sqliteUpsertQuery, sqliteDeleteQuery, cfg.HistoryVersions),
+	}
+
+	return &s, nil
+}
+
+// sqliteCreateTable creates the table, or brings an existing one up to date
+func sqliteCreateTable(db *dbx.DB, table string) error {
+	for _, q := range []string{sqliteSchemaQuery, sqliteIndexQuery, sqliteUpdatedIndexQuery} {
+		if _, err := db.NewQuery(cleanQuery(q, table)).Execute(); err != nil {
+			return err
+		}
+	}
+
+	for _, column := range sqliteAddedColumns {
+		var count int
+
+		err := db.NewQuery("SELECT COUNT(*) FROM pragma_table_info({:table}) WHERE name = {:column}").
+			Bind(dbx.Params{"table": table, "column": column.name}).Row(&count)
+		if err != nil {
+			return err
+		}
+
+		if count == 0 {
+			if _, err = db.NewQuery("ALTER TABLE " + table + " ADD COLUMN " + column.name + " " + column.definition).Execute(); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := db.NewQuery(cleanQuery(sqliteExpiresIndexQuery, table)).Execute()
+
+	return err
+}
+
+func (s *sqliteStore) WriteBatch(ops []cacheOperation) error {
+	return writeBatch(s.handle, s.queries, s.payloads, ops, dbx.Params{"now": time.Now().UTC()})
+}
+
+func (s *sqliteStore) Get(id string) (*cacheRecord, error) {
+	return getRecord(s.handle, s.router.tables(), s.payloads, id)
+}
+
+func (s *sqliteStore) GetBatch(ids []string) (map[string]*cacheRecord, error) {
+	return getRecords(s.handle, s.router.tables(), s.payloads, ids)
+}
+
+func (s *sqliteStore) History(id string) ([]recordVersion, error) {
+	return getHistory(s.handle, s.router.defaultTable+historySuffix, s.payloads, id)
+}
+
+func (s *sqliteStore) Iterate(filter cacheFilter, fn func(cacheRecord) error) error {
+	return iterateRecords(s.handle, s.router.tables(), s.payloads, filter, fn)
+}
+
+func (s *sqliteStore) Close() error {
+	return s.handle.Close()
+}
+
+//
+// end of file
+//
@@ -0,0 +1,622 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+)
+
+// the supported storage backends
+const (
+	storePostgres = "postgres"
+	storeSqlite   = "sqlite"
+)
+
+// the number of records read at a time when iterating
+const iterateChunkSize = 1000
+
+// errRecordNotFound is returned by CacheStore.Get when there is no record with the requested id
+var errRecordNotFound = fmt.Errorf("record not found")
+
+// cacheRecord is a single cached source record. Payload is always uncompressed; the stored form
+// is only seen by the stores
+type cacheRecord struct {
+	ID           string     `db:"id"`
+	Type         string     `db:"type"`
+	Source       string     `db:"source"`
+	Payload      []byte     `db:"payload"`
+	PayloadData  []byte     `db:"payload_data"`
+	PayloadCodec string     `db:"payload_codec"`
+	PayloadRef   string     `db:"payload_ref"`
+	CreatedAt    time.Time  `db:"created_at"`
+	UpdatedAt    time.Time  `db:"updated_at"`
+	ExpiresAt    *time.Time `db:"expires_at"` // nil if the record doesn't expire
+}
+
+// the operations that can be applied to the cache
+type cacheOperationType int
+
+const (
+	cacheOperationUpsert cacheOperationType = iota
+	cacheOperationDelete
+	cacheOperationQuarantine
+)
+
+// cacheOperation is a single write to the cache table. deletes only require the record id
+type cacheOperation struct {
+	operation cacheOperationType
+	table     string // empty for the default table
+	record    cacheRecord
+	reason    string // why a quarantined record failed validation
+}
+
+// cacheFilter restricts the records visited by CacheStore.Iterate.  empty fields match everything
+type cacheFilter struct {
+	Source string
+	Type   string
+}
+
+// CacheStore is the storage backend for the cache
+type CacheStore interface {
+
+	// WriteBatch applies a batch of upserts, deletes and quarantines within a single transaction. operations are
+	// applied in the order given; if any of them fail the whole batch is rolled back
+	WriteBatch(ops []cacheOperation) error
+
+	// Get returns the record with the specified id from whichever table holds it, or errRecordNotFound
+	Get(id string) (*cacheRecord, error)
+
+	// GetBatch returns those of the records with the specified ids that exist, by id. payloads offloaded
+	// to the object store are not fetched; those records carry only their PayloadRef
+	GetBatch(ids []string) (map[string]*cacheRecord, error)
+
+	// History returns the earlier versions kept of the record with the specified id, newest first
+	History(id string) ([]recordVersion, error)
+
+	// Iterate calls fn for each record matching the filter, table by table and in id order within each.
+	// iteration stops at the first error returned by fn, and that error is returned
+	Iterate(filter cacheFilter, fn func(cacheRecord) error) error
+
+	// Close releases any resources held by the store
+	Close() error
+}
+
+// NewCacheStore creates the configured storage backend, resolving its secrets with the resolver
+func NewCacheStore(cfg ServiceConfig, secrets *secretResolver) (CacheStore, error) {
+	switch cfg.CacheStore {
+	case storePostgres:
+		return newPostgresStore(cfg, secrets)
+	case storeSqlite:
+		return newSqliteStore(cfg)
+	}
+
+	return nil, fmt.Errorf("unsupported cache store: [%s]", cfg.CacheStore)
+}
+
+// storeHandle returns the database handle behind the dbx based stores
+func storeHandle(store CacheStore) *dbx.DB {
+	switch s := store.(type) {
+	case *postgresStore:
+		return s.handle
+	case *sqliteStore:
+		return s.handle
+	}
+
+	return nil
+}
+
+func cleanQuery(query string, table string) string {
+	// converts a query to a more compact form
+	// maybe it makes a difference to pq?
+
+	q := query
+
+	q = strings.ReplaceAll(q, "{:table}", table)
+	q = strings.ReplaceAll(q, "\n", " ")
+	q = strings.ReplaceAll(q, "\t", "")
+	q = strings.Trim(q, " ")
+
+	return q
+}
+
+// the object a record's payload was offloaded to, if any
+const cachePayloadRefQuery = `
+SELECT
+	payload_ref
+FROM
+	{:table}
+WHERE
+	id = {:id}
+`
+
+// records that fail validation are kept as they were received, along with the reason
+const quarantineInsertQuery = `
+INSERT
+INTO
+	{:table}
+		(id, type, source, payload, reason, received_at)
+VALUES
+	({:id}, {:type}, {:source}, {:payload}, {:reason}, {:received_at})
+`
+
+// the versions replaced by updates and deletes are kept beside the default table, with HistoryVersions
+const historySuffix = "_history"
+
+// the version of a record about to be replaced; offloaded payloads would be removed from under it
+const historyInsertQuery = `
+INSERT
+INTO
+	{:history}
+		(id, type, source, payload, payload_data, payload_codec, updated_at, replaced_at)
+SELECT
+	id, type, source, payload, payload_data, payload_codec, updated_at, {:replaced_at}
+FROM
+	{:table}
+WHERE
+	id = {:id} AND payload_ref = ''
+`
+
+const historyPruneQuery = `
+DELETE
+FROM
+	{:table}
+WHERE
+	id = {:id} AND seq NOT IN (SELECT seq FROM {:table} WHERE id = {:id} ORDER BY seq DESC LIMIT {:keep})
+`
+
+const historyGetQuery = `
+SELECT
+	seq, id, type, source, payload, payload_data, payload_codec, updated_at
+FROM
+	{:table}
+WHERE
+	id = {:id}
+ORDER BY
+	seq DESC
+`
+
+// recordVersion is an earlier version of a record
+type recordVersion struct {
+	Seq int64 `db:"seq"`
+	cacheRecord
+}
+
+// storeQueries are a store's write queries for each of its tables
+type storeQueries struct {
+	defaultTable string
+	upsert       map[string]string
+	delete       map[string]string
+	payloadRef   map[string]string
+	quarantine   map[string]string
+	moved        map[string][]string // run before an upsert, for tables keyed on (id, source)
+	history      map[string]string   // keeps the version an upsert or delete replaces; empty without history
+	historyPrune string
+	historyKeep  int
+}
+
+// newStoreQueries - the factory. historyVersions is the number of earlier versions of each record to keep
+func newStoreQueries(router *cacheRouter, upsertQuery string, deleteQuery string, historyVersions int) storeQueries {
+	q := storeQueries{
+		defaultTable: router.defaultTable,
+		upsert:       make(map[string]string),
+		delete:       make(map[string]string),
+		payloadRef:   make(map[string]string),
+		quarantine:   make(map[string]string),
+		moved:        make(map[string][]string),
+		history:      make(map[string]string),
+		historyKeep:  historyVersions,
+	}
+
+	table := router.defaultTable + quarantineSuffix
+	q.quarantine[table] = cleanQuery(quarantineInsertQuery, table)
+
+	history := router.defaultTable + historySuffix
+	q.historyPrune = cleanQuery(historyPruneQuery, history)
+
+	for _, table := range router.tables() {
+		q.upsert[table] = cleanQuery(upsertQuery, table)
+		q.delete[table] = cleanQuery(deleteQuery, table)
+		q.payloadRef[table] = cleanQuery(cachePayloadRefQuery, table)
+
+		if historyVersions > 0 {
+			q.history[table] = strings.ReplaceAll(cleanQuery(historyInsertQuery, table), "{:history}", history)
+		}
+	}
+
+	return q
+}
+
+// table returns the table the operation applies to
+func (q storeQueries) table(op cacheOperation) string {
+	if op.table == "" {
+		return q.defaultTable
+	}
+
+	return op.table
+}
+
+// txStatements prepares the statements for a transaction as each table is first written to
+type txStatements struct {
+	tx       *dbx.Tx
+	queries  storeQueries
+	prepared map[string]*dbx.Query
+}
+
+func newTxStatements(tx *dbx.Tx, queries storeQueries) *txStatements {
+	return &txStatements{tx: tx, queries: queries, prepared: make(map[string]*dbx.Query)}
+}
+
+// statement returns the prepared statement for the operation
+func (s *txStatements) statement(op cacheOperation) (*dbx.Query, error) {
+	switch op.operation {
+	case cacheOperationDelete:
+		return s.prepare(s.queries.delete, op)
+	case cacheOperationQuarantine:
+		return s.prepare(s.queries.quarantine, op)
+	}
+
+	return s.prepare(s.queries.upsert, op)
+}
+
+// payloadRef returns the prepared statement looking up the current payload reference for the operation
+func (s *txStatements) payloadRef(op cacheOperation) (*dbx.Query, error) {
+	return s.prepare(s.queries.payloadRef, op)
+}
+
+// moved returns the prepared statements removing an upserted id from the table's other sources, if any
+func (s *txStatements) moved(op cacheOperation) []*dbx.Query {
+	var statements []*dbx.Query
+
+	for _, query := range s.queries.moved[s.queries.table(op)] {
+		statements = append(statements, s.prepareQuery(query))
+	}
+
+	return statements
+}
+
+// history returns the prepared statements keeping the version the operation replaces and pruning the
+// older ones, or nils without history
+func (s *txStatements) history(op cacheOperation) (*dbx.Query, *dbx.Query) {
+	query, ok := s.queries.history[s.queries.table(op)]
+	if ok == false || op.operation == cacheOperationQuarantine {
+		return nil, nil
+	}
+
+	return s.prepareQuery(query), s.prepareQuery(s.queries.historyPrune)
+}
+
+func (s *txStatements) prepare(queries map[string]string, op cacheOperation) (*dbx.Query, error) {
+	table := s.queries.table(op)
+
+	query, ok := queries[table]
+	if ok == false {
+		return nil, fmt.Errorf("unknown cache table [%s]", table)
+	}
+
+	return s.prepareQuery(query), nil
+}
+
+func (s *txStatements) prepareQuery(query string) *dbx.Query {
+	q, ok := s.prepared[query]
+	if ok == false {
+		q = s.tx.NewQuery(query).Prepare()
+		s.prepared[query] = q
+	}
+
+	return q
+}
+
+const cacheGetQuery = `
+SELECT
+	id, type, source, payload, payload_data, payload_codec, payload_ref, created_at, updated_at, expires_at
+FROM
+	{:table}
+WHERE
+	id = {:id} AND (expires_at IS NULL OR expires_at > {:now})
+`
+
+const cacheGetBatchQuery = `
+SELECT
+	id, type, source, payload, payload_data, payload_codec, payload_ref, created_at, updated_at, expires_at
+FROM
+	{:table}
+WHERE
+	id IN ({:ids}) AND (expires_at IS NULL OR expires_at > {:now})
+`
+
+const cacheIterateQuery = `
+SELECT
+	id, type, source, payload, payload_data, payload_codec, payload_ref, created_at, updated_at, expires_at
+FROM
+	{:table}
+WHERE
+	{:conditions}
+ORDER BY
+	id
+LIMIT
+	{:limit}
+`
+
+// writeBatch implements CacheStore.WriteBatch for the dbx based stores. params are any store specific
+// parameters for the upsert query
+func writeBatch(handle *dbx.DB, queries storeQueries, payloads *payloadStorage, ops []cacheOperation, params dbx.Params) error {
+
+	// offloaded payloads are written before the transaction rather than holding it open
+	stored := make([]storedPayload, len(ops))
+	var written []string
+
+	for ix, op := range ops {
+		if op.operation != cacheOperationUpsert {
+			continue
+		}
+
+		var err error
+		if stored[ix], err = payloads.encode(queries.table(op), op.record); err != nil {
+			payloads.remove(written)
+			return fmt.Errorf("payload encoding failed: %w", err)
+		}
+
+		if stored[ix].ref != "" {
+			written = append(written, stored[ix].ref)
+		}
+	}
+
+	// the objects replaced or deleted by the batch
+	var obsolete []string
+
+	replacedAt := time.Now().UTC()
+
+	// execute a transaction inline
+	// note: commits at the end automatically, or rolls back if error
+	err := handle.Transactional(func(tx *dbx.Tx) error {
+		obsolete = nil
+
+		statements := newTxStatements(tx, queries)
+
+		// execute statements within the transaction
+		for ix, op := range ops {
+			// the lookup also locks the record, before its current version is copied to the history
+			if (payloads.objects != nil || queries.historyKeep > 0) && op.operation != cacheOperationQuarantine {
+				rq, err := statements.payloadRef(op)
+				if err != nil {
+					return err
+				}
+
+				var ref string
+				err = rq.Bind(dbx.Params{"id": op.record.ID}).Row(&ref)
+				if err != nil && err != sql.ErrNoRows {
+					return fmt.Errorf("payload reference lookup failed: %w", err)
+				}
+
+				// without an offload location there is nothing to remove a stale reference from
+				if ref != "" && payloads.objects != nil {
+					obsolete = append(obsolete, ref)
+				}
+			}
+
+			if hq, pq := statements.history(op); hq != nil {
+				res, err := hq.Bind(dbx.Params{"id": op.record.ID, "replaced_at": replacedAt}).Execute()
+				if err != nil {
+					return fmt.Errorf("history execution failed: %w", err)
+				}
+
+				if n, _ := res.RowsAffected(); n > 0 {
+					if _, err = pq.Bind(dbx.Params{"id": op.record.ID, "keep": queries.historyKeep}).Execute(); err != nil {
+						return fmt.Errorf("history execution failed: %w", err)
+					}
+				}
+			}
+
+			q, err := statements.statement(op)
+			if err != nil {
+				return err
+			}
+
+			switch op.operation {
+			case cacheOperationUpsert:
+				for _, mq := range statements.moved(op) {
+					if _, err = mq.Bind(dbx.Params{"id": op.record.ID, "source": op.record.Source}).Execute(); err != nil {
+						return fmt.Errorf("update execution failed: %w", err)
+					}
+				}
+
+				bind := dbx.Params{
+					"id":            op.record.ID,
+					"type":          op.record.Type,
+					"source":        op.record.Source,
+					"payload":       stored[ix].text,
+					"payload_data":  stored[ix].data,
+					"payload_codec": stored[ix].codec,
+					"payload_ref":   stored[ix].ref,
+					"expires_at":    op.record.ExpiresAt,
+				}
+				for k, v := range params {
+					bind[k] = v
+				}
+
+				if _, err = q.Bind(bind).Execute(); err != nil {
+					return fmt.Errorf("update execution failed: %w", err)
+				}
+
+			case cacheOperationDelete:
+				if _, err = q.Bind(dbx.Params{"id": op.record.ID}).Execute(); err != nil {
+					return fmt.Errorf("delete execution failed: %w", err)
+				}
+
+			case cacheOperationQuarantine:
+				bind := dbx.Params{
+					"id":          op.record.ID,
+					"type":        op.record.Type,
+					"source":      op.record.Source,
+					"payload":     op.record.Payload,
+					"reason":      op.reason,
+					"received_at": time.Now().UTC(),
+				}
+
+				if _, err = q.Bind(bind).Execute(); err != nil {
+					return fmt.Errorf("quarantine execution failed: %w", err)
+				}
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		payloads.remove(written)
+		return err
+	}
+
+	payloads.remove(obsolete)
+
+	return nil
+}
+
+// getRecord implements CacheStore.Get for the dbx based stores
+func getRecord(handle *dbx.DB, tables []string, payloads *payloadStorage, id string) (*cacheRecord, error) {
+	for _, table := range tables {
+		var rec cacheRecord
+
+		err := handle.NewQuery(cleanQuery(cacheGetQuery, table)).Bind(dbx.Params{"id": id, "now": time.Now().UTC()}).One(&rec)
+		if err == sql.ErrNoRows {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err = payloads.decode(&rec); err != nil {
+			return nil, err
+		}
+
+		return &rec, nil
+	}
+
+	return nil, errRecordNotFound
+}
+
+// getRecords implements CacheStore.GetBatch for the dbx based stores, a chunk of ids at a time
+func getRecords(handle *dbx.DB, tables []string, payloads *payloadStorage, ids []string) (map[string]*cacheRecord, error) {
+	found := make(map[string]*cacheRecord)
+
+	for start := 0; start < len(ids); start += iterateChunkSize {
+		chunk := ids[start:min(start+iterateChunkSize, len(ids))]
+
+		params := dbx.Params{"now": time.Now().UTC()}
+		placeholders := make([]string, len(chunk))
+		for ix, id := range chunk {
+			name := fmt.Sprintf("id%d", ix)
+			placeholders[ix] = "{:" + name + "}"
+			params[name] = id
+		}
+
+		for _, table := range tables {
+			var recs []cacheRecord
+
+			query := strings.ReplaceAll(cleanQuery(cacheGetBatchQuery, table), "{:ids}", strings.Join(placeholders, ", "))
+			if err := handle.NewQuery(query).Bind(params).All(&recs); err != nil {
+				return nil, err
+			}
+
+			for ix := range recs {
+				rec := &recs[ix]
+
+				// the first table to hold a record wins, as with Get
+				if _, ok := found[rec.ID]; ok == true {
+					continue
+				}
+
+				if rec.PayloadRef == "" {
+					if err := payloads.decode(rec); err != nil {
+						return nil, err
+					}
+				}
+
+				found[rec.ID] = rec
+			}
+		}
+	}
+
+	return found, nil
+}
+
+// getHistory returns the earlier versions kept of a record, newest first
+func getHistory(handle *dbx.DB, table string, payloads *payloadStorage, id string) ([]recordVersion, error) {
+	var versions []recordVersion
+
+	if err := handle.NewQuery(cleanQuery(historyGetQuery, table)).Bind(dbx.Params{"id": id}).All(&versions); err != nil {
+		return nil, err
+	}
+
+	for ix := range versions {
+		if err := payloads.decode(&versions[ix].cacheRecord); err != nil {
+			return nil, err
+		}
+	}
+
+	return versions, nil
+}
+
+// iterateRecords implements CacheStore.Iterate for the dbx based stores
+func iterateRecords(handle *dbx.DB, tables []string, payloads *payloadStorage, filter cacheFilter, fn func(cacheRecord) error) error {
+	for _, table := range tables {
+		if err := iterateTable(handle, table, payloads, filter, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// iterateTable visits the matching records in a single table.  records are read a chunk at a time
+// (keyed on the last id seen) so that no long running query is held open while fn executes
+func iterateTable(handle *dbx.DB, table string, payloads *payloadStorage, filter cacheFilter, fn func(cacheRecord) error) error {
+	// expired records are gone, whether or not they have been reaped yet
+	conditions := []string{"id > {:after}", "(expires_at IS NULL OR expires_at > {:now})"}
+	params := dbx.Params{"after": "", "limit": iterateChunkSize, "now": time.Now().UTC()}
+
+	if filter.Source != "" {
+		conditions = append(conditions, "source = {:source}")
+		params["source"] = filter.Source
+	}
+
+	if filter.Type != "" {
+		conditions = append(conditions, "type = {:type}")
+		params["type"] = filter.Type
+	}
+
+	query := cleanQuery(cacheIterateQuery, table)
+	query = strings.ReplaceAll(query, "{:conditions}", strings.Join(conditions, " AND "))
+
+	for {
+		var recs []cacheRecord
+
+		if err := handle.NewQuery(query).Bind(params).All(&recs); err != nil {
+			return err
+		}
+
+		for _, rec := range recs {
+			if err := payloads.decode(&rec); err != nil {
+				return err
+			}
+
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+
+		if len(recs) < iterateChunkSize {
+			return nil
+		}
+
+		params["after"] = recs[len(recs)-1].ID
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+//
+// payloads can be validated before they are cached, by record type. each type configured with an
+// action is checked for well-formedness (xml and json; other types only have to be non-empty) and
+// against the schema configured for it, if any. invalid payloads are then rejected (dropped from
+// the queue without being cached), quarantined (kept in the quarantine table instead of the cache)
+// or cached anyway with a warning. types without an action are not validated.
+//
+// there is no XML Schema support in Go, so xsd validation runs xmllint for every payload: a process
+// start and a parse of the schema each time, typically a few milliseconds but more for large schemas.
+// that is paid by the worker holding the batch, so budget for it (more workers, or a JSON Schema or
+// well-formedness check instead) on busy record types
+//
+
+// the validation failure actions
+const (
+	validationReject     = "reject"
+	validationQuarantine = "quarantine"
+	validationWarn       = "warn"
+)
+
+// the suffix of the quarantine table, after the cache table name
+const quarantineSuffix = "_quarantine"
+
+// PayloadValidator checks the payload of a record
+type PayloadValidator interface {
+	Validate(payload []byte) error
+}
+
+// validatorFunc adapts a function to a PayloadValidator
+type validatorFunc func(payload []byte) error
+
+func (f validatorFunc) Validate(payload []byte) error {
+	return f(payload)
+}
+
+// validationRule is how records of a type are validated
+type validationRule struct {
+	action     string
+	validators []PayloadValidator
+}
+
+// validationRegistry holds the validation rules by record type
+type validationRegistry struct {
+	rules       map[string]*validationRule
+	defaultRule *validationRule // for the types without a rule of their own; nil to leave them alone
+}
+
+// parseTypeSettings parses a comma separated list of type=value settings
+func parseTypeSettings(value string) (map[string]string, error) {
+	settings := make(map[string]string)
+
+	for _, setting := range strings.Split(value, ",") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+
+		recordType, v, found := strings.Cut(setting, "=")
+		recordType = strings.TrimSpace(recordType)
+		v = strings.TrimSpace(v)
+
+		if found == false || recordType == "" || v == "" {
+			return nil, fmt.Errorf("setting must be type=value (is [%s])", setting)
+		}
+
+		if _, ok := settings[recordType]; ok == true {
+			return nil, fmt.Errorf("duplicate setting for [%s]", recordType)
+		}
+
+		settings[recordType] = v
+	}
+
+	return settings, nil
+}
+
+// newValidationRegistry - the factory
+func newValidationRegistry(cfg ServiceConfig) (*validationRegistry, error) {
+	actions, err := parseTypeSettings(cfg.ValidateActions)
+	if err != nil {
+		return nil, err
+	}
+
+	schemas, err := parseTypeSettings(cfg.ValidateSchemas)
+	if err != nil {
+		return nil, err
+	}
+
+	r := validationRegistry{rules: make(map[string]*validationRule)}
+
+	for recordType, action := range actions {
+		switch action {
+		case validationReject, validationQuarantine, validationWarn:
+		default:
+			return nil, fmt.Errorf("validation action for [%s] must be %s, %s or %s (is [%s])", recordType, validationReject, validationQuarantine, validationWarn, action)
+		}
+
+		rule := &validationRule{action: action}
+
+		if recordType == routeAny {
+			r.defaultRule = rule
+			continue
+		}
+
+		rule.validators = append(rule.validators, formatValidator(recordType))
+		r.rules[recordType] = rule
+	}
+
+	for recordType, schema := range schemas {
+		if _, ok := r.rules[recordType]; ok == false {
+			return nil, fmt.Errorf("schema for [%s] has no validation action", recordType)
+		}
+
+		v, err := newSchemaValidator(schema)
+		if err != nil {
+			return nil, fmt.Errorf("schema for [%s]: %w", recordType, err)
+		}
+
+		r.Register(recordType, v)
+	}
+
+	return &r, nil
+}
+
+// Register adds a validator for a record type that has a validation action
+func (r *validationRegistry) Register(recordType string, v PayloadValidator) {
+	if rule, ok := r.rules[recordType]; ok == true {
+		rule.validators = append(rule.validators, v)
+	}
+}
+
+// validate checks the payload of a record of the type, returning the action to take if it is invalid
+// along with the reason. the error is nil if the payload is valid or the type is not validated
+func (r *validationRegistry) validate(recordType string, payload []byte) (string, error) {
+	rule, ok := r.rules[recordType]
+	if ok == false {
+		if r.defaultRule == nil {
+			return "", nil
+		}
+
+		// other types are held to whatever their format can tell us
+		rule = &validationRule{action: r.defaultRule.action, validators: []PayloadValidator{formatValidator(recordType)}}
+	}
+
+	for _, v := range rule.validators {
+		if err := v.Validate(payload); err != nil {
+			return rule.action, err
+		}
+	}
+
+	return "", nil
+}
+
+// formatValidator returns the well-formedness check for payloads of the record type
+func formatValidator(recordType string) PayloadValidator {
+	switch recordType {
+	case "xml":
+		return validatorFunc(validateXML)
+	case "json":
+		return validatorFunc(validateJSON)
+	}
+
+	return validatorFunc(validateNotEmpty)
+}
+
+func validateNotEmpty(payload []byte) error {
+	if len(bytes.TrimSpace(payload)) == 0 {
+		return errors.New("empty payload")
+	}
+
+	return nil
+}
+
+// validateXML checks the payload is well-formed XML
+func validateXML(payload []byte) error {
+	if err := validateNotEmpty(payload); err != nil {
+		return err
+	}
+
+	d := xml.NewDecoder(bytes.NewReader(payload))
+	root := false
+
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("malformed xml: %w", err)
+		}
+
+		if _, ok := tok.(xml.StartElement); ok == true {
+			root = true
+		}
+	}
+
+	if root == false {
+		return errors.New("malformed xml: no root element")
+	}
+
+	return nil
+}
+
+// validateJSON checks the payload is a single valid JSON value
+func validateJSON(payload []byte) error {
+	if err := validateNotEmpty(payload); err != nil {
+		return err
+	}
+
+	if json.Valid(payload) == false {
+		return errors.New("malformed json")
+	}
+
+	return nil
+}
+
+// newSchemaValidator returns a validator for the schema file: XML Schema (.xsd, checked with xmllint)
+// or JSON Schema
+func newSchemaValidator(path string) (PayloadValidator, error) {
+	if strings.EqualFold(filepath.Ext(path), ".xsd") == true {
+		return newXSDValidator(path)
+	}
+
+	schema, err := jsonschema.NewCompiler().Compile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return validatorFunc(func(payload []byte) error {
+		doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(payload))
+		if err != nil {
+			return fmt.Errorf("malformed json: %w", err)
+		}
+
+		return schema.Validate(doc)
+	}), nil
+}
+
+// newXSDValidator returns a validator using xmllint, as there is no XML Schema support in Go. each
+// payload validated starts an xmllint process
+func newXSDValidator(path string) (PayloadValidator, error) {
+	xmllint, err := exec.LookPath("xmllint")
+	if err != nil {
+		return nil, fmt.Errorf("XML Schema validation needs xmllint: %w", err)
+	}
+
+	// check the schema itself up front
+	if out, err := exec.Command(xmllint, "--noout", path).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%s", strings.TrimSpace(string(out)))
+	}
+
+	log.Printf("[validate] INFO: validating against %s with xmllint, a process per payload", path)
+
+	return validatorFunc(func(payload []byte) error {
+		cmd := exec.Command(xmllint, "--noout", "--nonet", "--schema", path, "-")
+		cmd.Stdin = bytes.NewReader(payload)
+
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("schema validation failed: %s", strings.TrimSpace(string(out)))
+		}
+
+		return nil
+	}), nil
+}
+
+//
+// end of file
+//
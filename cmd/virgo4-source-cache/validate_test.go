@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFormatValidation(t *testing.T) {
+	for _, tc := range []struct {
+		recordType string
+		payload    string
+		valid      bool
+	}{
+		{"xml", "<record><id>1</id></record>", true},
+		{"xml", "<record><id>1</id>", false},
+		{"xml", "just text", false},
+		{"xml", " ", false},
+		{"json", `{"id": 1}`, true},
+		{"json", `{"id": 1`, false},
+		{"base64/marc", "TUFSQw==", true},
+		{"base64/marc", "", false},
+	} {
+		err := formatValidator(tc.recordType).Validate([]byte(tc.payload))
+		if (err == nil) != tc.valid {
+			t.Errorf("%s [%s]: expected valid = %t, got %v", tc.recordType, tc.payload, tc.valid, err)
+		}
+	}
+}
+
+func TestValidationRegistry(t *testing.T) {
+	schema := filepath.Join(t.TempDir(), "record.json")
+	contents := `{"type": "object", "required": ["id"]}`
+	if err := os.WriteFile(schema, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := newValidationRegistry(ServiceConfig{
+		ValidateActions: "json=reject, *=warn",
+		ValidateSchemas: "json=" + schema,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if action, err := r.validate("json", []byte(`{"title": "no id"}`)); action != validationReject || err == nil {
+		t.Errorf("expected the schema to reject the record, got %s, %v", action, err)
+	}
+
+	if _, err := r.validate("json", []byte(`{"id": 1}`)); err != nil {
+		t.Errorf("expected a valid record, got %v", err)
+	}
+
+	if action, err := r.validate("xml", []byte("<r>")); action != validationWarn || err == nil {
+		t.Errorf("expected the default action, got %s, %v", action, err)
+	}
+
+	for _, cfg := range []ServiceConfig{
+		{ValidateActions: "xml=ignore"},
+		{ValidateActions: "xml"},
+		{ValidateActions: "xml=warn", ValidateSchemas: "json=" + schema},
+	} {
+		if _, err := newValidationRegistry(cfg); err == nil {
+			t.Errorf("%+v: expected an error", cfg)
+		}
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+//
+// messages are held from when they are received until they are deleted: in the worker queue, in a
+// worker batch and in the delete queue. if that takes longer than the visibility timeout they are
+// delivered again, to us or to another consumer. the heartbeat keeps held messages invisible by
+// extending the timeout of those getting close to it
+//
+
+// the longest visibility timeout SQS allows (seconds)
+const maxVisibilityTimeout = 12 * 60 * 60
+
+// messages are extended once less than 1/visibilityMargin of the timeout remains
+const visibilityMargin = 3
+
+// heldMessage is a message we have yet to delete, and when it becomes visible again
+type heldMessage struct {
+	message awssqs.Message
+	expires time.Time
+}
+
+// visibilityHeartbeat extends the visibility timeout of held messages
+type visibilityHeartbeat struct {
+	source  VisibilityExtender
+	timeout time.Duration
+
+	sync.Mutex
+	held map[awssqs.ReceiptHandle]*heldMessage
+}
+
+// newVisibilityHeartbeat - the factory. returns nil if the source has no visibility timeout to extend
+// or extension is disabled; a nil heartbeat ignores everything
+func newVisibilityHeartbeat(cfg ServiceConfig, source MessageSource) *visibilityHeartbeat {
+	extender, ok := source.(VisibilityExtender)
+	if ok == false || cfg.VisibilityExtend == false {
+		return nil
+	}
+
+	timeout := time.Duration(cfg.VisibilityTimeout) * time.Second
+
+	if timeout == 0 {
+		var err error
+		if timeout, err = extender.VisibilityTimeout(); err != nil {
+			log.Printf("[visibility] WARNING: cannot get the queue visibility timeout, not extending: %s", err.Error())
+			return nil
+		}
+	}
+
+	if timeout <= 0 {
+		return nil
+	}
+
+	log.Printf("[visibility] extending the %s visibility timeout of slow messages", timeout)
+
+	return &visibilityHeartbeat{
+		source:  extender,
+		timeout: timeout,
+		held:    make(map[awssqs.ReceiptHandle]*heldMessage),
+	}
+}
+
+// hold notes messages just received
+func (h *visibilityHeartbeat) hold(messages []awssqs.Message, received time.Time) {
+	if h == nil {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	for _, msg := range messages {
+		h.held[msg.ReceiptHandle] = &heldMessage{message: msg, expires: received.Add(h.timeout)}
+	}
+}
+
+// release forgets messages that have been deleted (or given up on)
+func (h *visibilityHeartbeat) release(messages []cacheMessage) {
+	if h == nil {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	for _, msg := range messages {
+		delete(h.held, msg.message.ReceiptHandle)
+	}
+}
+
+// run extends held messages as needed until stop is closed
+func (h *visibilityHeartbeat) run(stop <-chan struct{}) {
+	if h == nil {
+		return
+	}
+
+	interval := h.timeout / (2 * visibilityMargin)
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			h.extend(now)
+		}
+	}
+}
+
+// extend extends the held messages that will soon be visible again
+func (h *visibilityHeartbeat) extend(now time.Time) {
+	due := make([]*heldMessage, 0)
+
+	h.Lock()
+	for _, m := range h.held {
+		if m.expires.Sub(now) < h.timeout/visibilityMargin {
+			due = append(due, m)
+		}
+	}
+	h.Unlock()
+
+	if len(due) == 0 {
+		return
+	}
+
+	extended := 0
+
+	for start := 0; start < len(due); start += int(awssqs.MAX_SQS_BLOCK_COUNT) {
+		end := min(start+int(awssqs.MAX_SQS_BLOCK_COUNT), len(due))
+		block := due[start:end]
+
+		msgs := make([]awssqs.Message, 0, len(block))
+		for _, m := range block {
+			msgs = append(msgs, m.message)
+		}
+
+		opStatus, err := h.source.ExtendVisibility(msgs, h.timeout)
+		if err != nil && err != awssqs.ErrOneOrMoreOperationsUnsuccessful {
+			log.Printf("[visibility] WARNING: extending visibility: %s", err.Error())
+			continue
+		}
+
+		// messages deleted in the meantime fail; that's fine
+		h.Lock()
+		for ix, ok := range opStatus {
+			if ok == true {
+				block[ix].expires = now.Add(h.timeout)
+				extended++
+			}
+		}
+		h.Unlock()
+	}
+
+	log.Printf("[visibility] extended the visibility of %d of %d slow message(s)", extended, len(due))
+}
+
+//
+// end of file
+//
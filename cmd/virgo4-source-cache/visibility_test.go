@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// extendingSource is a memorySource with a visibility timeout, recording extensions
+type extendingSource struct {
+	*memorySource
+	extended map[awssqs.ReceiptHandle]int
+}
+
+func (e *extendingSource) VisibilityTimeout() (time.Duration, error) {
+	return 30 * time.Second, nil
+}
+
+func (e *extendingSource) ExtendVisibility(messages []awssqs.Message, timeout time.Duration) ([]awssqs.OpStatus, error) {
+	ops := make([]awssqs.OpStatus, len(messages))
+	for ix, msg := range messages {
+		e.extended[msg.ReceiptHandle]++
+		ops[ix] = true
+	}
+
+	return ops, nil
+}
+
+func TestVisibilityHeartbeat(t *testing.T) {
+	source := &extendingSource{memorySource: newMemorySource(100), extended: make(map[awssqs.ReceiptHandle]int)}
+
+	h := newVisibilityHeartbeat(ServiceConfig{VisibilityExtend: true}, source)
+	if h == nil || h.timeout != 30*time.Second {
+		t.Fatalf("expected a heartbeat using the queue visibility timeout")
+	}
+
+	for ix := 0; ix < 15; ix++ {
+		source.Put(testMessage("r", awssqs.AttributeValueRecordOperationUpdate, "<r/>"))
+	}
+
+	start := time.Now()
+
+	var received []awssqs.Message
+	for len(received) < 15 {
+		msgs, err := source.ReceiveBatch(awssqs.MAX_SQS_BLOCK_COUNT, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, msgs...)
+	}
+
+	h.hold(received, start)
+
+	// one is deleted in good time
+	h.release([]cacheMessage{{message: received[0]}})
+
+	// plenty of time left
+	h.extend(start.Add(10 * time.Second))
+	if len(source.extended) != 0 {
+		t.Fatalf("expected no extensions yet, got %d", len(source.extended))
+	}
+
+	// running out
+	h.extend(start.Add(25 * time.Second))
+	if len(source.extended) != 14 {
+		t.Fatalf("expected 14 messages to be extended, got %d", len(source.extended))
+	}
+
+	// and they now have until 55s
+	h.extend(start.Add(30 * time.Second))
+	for handle, count := range source.extended {
+		if count != 1 {
+			t.Fatalf("%s: expected a single extension, got %d", handle, count)
+		}
+	}
+
+	if newVisibilityHeartbeat(ServiceConfig{VisibilityExtend: true}, newMemorySource(1)) != nil {
+		t.Fatalf("expected no heartbeat for a source without a visibility timeout")
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+//
+// the worker pool starts with Workers workers and, given a range with WorkersMin and WorkersMax, the
+// supervisor grows it while the worker queue backs up and the database is keeping up, and shrinks it
+// when the queue is idle or flushes get slow (more workers would only add to the contention). a retired
+// worker flushes its pending batch before it exits
+//
+
+// how often the supervisor reconsiders the pool size
+const workerScaleInterval = 5 * time.Second
+
+// the pool grows while the worker queue is at least this full (percent)
+const workerScaleBacklog = 50
+
+// the pool shrinks after this many idle checks in a row
+const workerScaleIdleChecks = 3
+
+// workerPool is the set of running workers
+type workerPool struct {
+	cfg         ServiceConfig
+	cache       *cacheService
+	urgentChan  chan cacheMessage
+	processChan chan cacheMessage
+	deleteChan  chan []cacheMessage
+
+	min, max int
+	maxFlush time.Duration
+
+	wg     sync.WaitGroup
+	retire chan struct{} // a worker that receives from this exits
+	count  int           // running workers
+	nextID int
+	idle   int // idle checks in a row
+}
+
+// newWorkerPool - the factory
+func newWorkerPool(cfg ServiceConfig, cache *cacheService, urgentChan chan cacheMessage, processChan chan cacheMessage, deleteChan chan []cacheMessage) *workerPool {
+	w := workerPool{
+		cfg:         cfg,
+		cache:       cache,
+		urgentChan:  urgentChan,
+		processChan: processChan,
+		deleteChan:  deleteChan,
+		min:         cfg.Workers,
+		max:         cfg.Workers,
+		maxFlush:    time.Duration(cfg.FlowMaxFlushTime) * time.Millisecond,
+		retire:      make(chan struct{}),
+	}
+
+	if cfg.WorkersMin > 0 {
+		w.min = cfg.WorkersMin
+	}
+
+	if cfg.WorkersMax > 0 {
+		w.max = cfg.WorkersMax
+	}
+
+	return &w
+}
+
+// scalable reports whether the pool size can change
+func (w *workerPool) scalable() bool {
+	return w.min != w.max
+}
+
+// add starts another worker
+func (w *workerPool) add() {
+	w.nextID++
+	w.count++
+
+	id := w.nextID
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		worker(id, w.cfg, w.cache, w.urgentChan, w.processChan, w.deleteChan, w.retire)
+	}()
+}
+
+// remove retires a worker, waiting until one is free to go
+func (w *workerPool) remove(stop <-chan struct{}) {
+	select {
+	case w.retire <- struct{}{}:
+		w.count--
+	case <-stop:
+	}
+}
+
+// decide returns whether the pool should grow (1), shrink (-1) or stay as it is (0), and why
+func (w *workerPool) decide(now time.Time) (int, string) {
+	// the workers take from both queues; the fuller one decides
+	queued := len(w.processChan)
+	backlog := len(w.processChan) * 100 / cap(w.processChan)
+	if w.urgentChan != nil {
+		queued += len(w.urgentChan)
+		backlog = max(backlog, len(w.urgentChan)*100/cap(w.urgentChan))
+	}
+
+	slow := w.maxFlush > 0 && w.cache.flushTimes.recent(now) >= w.maxFlush
+
+	if queued == 0 {
+		w.idle++
+	} else {
+		w.idle = 0
+	}
+
+	switch {
+	case backlog >= workerScaleBacklog && slow == false && w.count < w.max:
+		return 1, fmt.Sprintf("worker queue %d%% full", backlog)
+
+	case slow == true && w.count > w.min:
+		return -1, "flushes are slow"
+
+	case w.idle >= workerScaleIdleChecks && w.count > w.min:
+		w.idle = 0
+		return -1, "worker queue idle"
+	}
+
+	return 0, ""
+}
+
+// scale grows or shrinks the pool by a worker if it should
+func (w *workerPool) scale(stop <-chan struct{}, now time.Time) {
+	change, reason := w.decide(now)
+
+	switch change {
+	case 1:
+		w.add()
+	case -1:
+		w.remove(stop)
+	default:
+		return
+	}
+
+	log.Printf("[workers] %s; %d workers", reason, w.count)
+}
+
+// supervise resizes the pool until stop is closed
+func (w *workerPool) supervise(stop <-chan struct{}) {
+	ticker := time.NewTicker(workerScaleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			w.scale(stop, now)
+		}
+	}
+}
+
+// wait waits for the workers to exit, once the worker queue is closed
+func (w *workerPool) wait() {
+	w.wg.Wait()
+}
+
+//
+// end of file
+//
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+func TestWorkerPoolScaling(t *testing.T) {
+	cfg := ServiceConfig{Workers: 2, WorkersMin: 1, WorkersMax: 3, FlowMaxFlushTime: 1000}
+	cache := &cacheService{flushTimes: newFlushLatency()}
+
+	processChan := make(chan cacheMessage, 10)
+	w := newWorkerPool(cfg, cache, nil, processChan, nil)
+	w.count = cfg.Workers
+
+	now := time.Now()
+
+	// idle, but not for long enough
+	if change, _ := w.decide(now); change != 0 {
+		t.Fatalf("expected no change, got %d", change)
+	}
+
+	// backed up, and the database is keeping up
+	for ix := 0; ix < 5; ix++ {
+		processChan <- cacheMessage{}
+	}
+	if change, _ := w.decide(now); change != 1 {
+		t.Fatalf("expected the pool to grow, got %d", change)
+	}
+
+	// but not when flushes are slow; more workers would only make it worse
+	cache.flushTimes.observe(2*time.Second, now)
+	if change, _ := w.decide(now); change != -1 {
+		t.Fatalf("expected the pool to shrink, got %d", change)
+	}
+
+	// and never beyond the bounds
+	w.count = cfg.WorkersMin
+	if change, _ := w.decide(now); change != 0 {
+		t.Fatalf("expected no change at the minimum, got %d", change)
+	}
+}
+
+func TestWorkerPoolUrgentBacklog(t *testing.T) {
+	cfg := ServiceConfig{Workers: 1, WorkersMin: 1, WorkersMax: 2}
+	cache := &cacheService{flushTimes: newFlushLatency()}
+
+	urgentChan := make(chan cacheMessage, 10)
+	w := newWorkerPool(cfg, cache, urgentChan, make(chan cacheMessage, 10), nil)
+	w.count = cfg.Workers
+
+	// a backed up urgent queue grows the pool as the worker queue would
+	for ix := 0; ix < 5; ix++ {
+		urgentChan <- cacheMessage{}
+	}
+	if change, _ := w.decide(time.Now()); change != 1 {
+		t.Fatalf("expected the pool to grow, got %d", change)
+	}
+	if w.idle != 0 {
+		t.Fatalf("expected the pool not to be idle, got %d idle checks", w.idle)
+	}
+}
+
+func TestWorkerRetirement(t *testing.T) {
+	cfg := testConfig(ServiceConfig{
+		CacheStore:    storeSqlite,
+		SqlitePath:    filepath.Join(t.TempDir(), "cache.db"),
+		PostgresTable: "source_cache",
+		PayloadCodec:  codecNone,
+	})
+	cfg.WorkerFlushTime = 60
+
+	cache := NewDbCache(1, cfg, nil)
+	defer cache.store.Close()
+
+	processChan := make(chan cacheMessage, 10)
+	deleteChan := make(chan []cacheMessage, 10)
+	stop := make(chan struct{})
+
+	w := newWorkerPool(cfg, cache, nil, processChan, deleteChan)
+	w.add()
+
+	processChan <- cacheMessage{message: testMessage("r", awssqs.AttributeValueRecordOperationUpdate, "<r/>")}
+	for len(processChan) > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the retired worker flushes its partial batch on the way out
+	w.remove(stop)
+	close(processChan)
+	w.wait()
+
+	if w.count != 0 || len(deleteChan) != 1 {
+		t.Fatalf("expected the worker to flush and exit, got %d workers and %d flushes", w.count, len(deleteChan))
+	}
+
+	expectPayload(t, cache.store, "r", "<r/>")
+}
+
+//
+// end of file
+//
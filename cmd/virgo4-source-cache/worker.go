@@ -10,44 +10,79 @@ import (
 	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
 )
 
-func worker(id int, cfg ServiceConfig, cache *cacheService, messageChan <-chan cacheMessage, deleteChan chan<- []cacheMessage) {
+func worker(id int, cfg ServiceConfig, cache *cacheService, urgentChan <-chan cacheMessage, messageChan <-chan cacheMessage, deleteChan chan<- []cacheMessage, retire <-chan struct{}) {
 	bx := newBatchTransaction(id, cache, deleteChan)
 
 	processed := newRate()
 
 	flushAfter := time.Duration(cfg.WorkerFlushTime) * time.Second
 
+	queue := func(msg cacheMessage) {
+		// queue record; pipeline will self-flush if full
+		bx.queueRecord(msg)
+
+		processed.incrementCount()
+
+		if processed.count%1000 == 0 {
+			log.Printf("[process] worker %d: INFO: pipelined %d records", id, processed.count)
+		}
+	}
+
 	for {
+		// urgent messages go ahead of the rest, and aren't kept waiting for the batch to fill
+		select {
+		case msg, ok := <-urgentChan:
+			if ok == true {
+				queue(msg)
+				if len(urgentChan) == 0 {
+					bx.flushRecords()
+				}
+				continue
+			}
+			urgentChan = nil
+		default:
+		}
+
 		// process a message or wait...
 		select {
+		case msg, ok := <-urgentChan:
+			if ok == false {
+				urgentChan = nil
+				continue
+			}
+			queue(msg)
+			bx.flushRecords()
+
 		case msg, ok := <-messageChan:
 			if ok == false {
 				// channel was closed
 				log.Printf("[process] worker %d: INFO: channel closed; flushing pending cache writes", id)
+				if urgentChan != nil {
+					for msg := range urgentChan {
+						queue(msg)
+					}
+				}
 				bx.flushRecords()
 				return
 			}
 
 			// new message to process; add it to pipeline
-
-			// queue record; pipeline will self-flush if full
-			bx.queueRecord(msg)
-
-			processed.incrementCount()
-
-			if processed.count%1000 == 0 {
-				log.Printf("[process] worker %d: INFO: pipelined %d records", id, processed.count)
-			}
+			queue(msg)
 
 		case <-time.After(flushAfter):
 			bx.flushRecords()
+
+		case <-retire:
+			log.Printf("[process] worker %d: INFO: retiring; flushing pending cache writes", id)
+			bx.flushRecords()
+			return
 		}
 	}
 
 	// should never get here
 }
 
-func deleter(id int, cfg ServiceConfig, aws awssqs.AWS_SQS, queue awssqs.QueueHandle, messageChan <-chan []cacheMessage) {
+func deleter(id int, cfg ServiceConfig, source MessageSource, deliveries *deliveryTracker, heartbeat *visibilityHeartbeat, messageChan <-chan []cacheMessage) {
 	overallGroups := newRate()
 	overallMessages := newRate()
 
@@ -62,10 +97,12 @@ func deleter(id int, cfg ServiceConfig, aws awssqs.AWS_SQS, queue awssqs.QueueHa
 
 		batch := newRate()
 
-		if err := batchDelete(id, aws, queue, msgs); err != nil {
+		if err := batchDelete(id, cfg, source, deliveries, msgs); err != nil {
 			log.Fatalf("[delete] deleter %d: FATAL: %s", id, err.Error())
 		}
 
+		heartbeat.release(msgs)
+
 		batch.setStopNow()
 		batch.setCount(int64(len(msgs)))
 
@@ -98,7 +135,7 @@ func intCountMapToString(countMap map[int]int) string {
 	return strings.Join(s, "; ")
 }
 
-func batchDelete(id int, aws awssqs.AWS_SQS, queue awssqs.QueueHandle, messages []cacheMessage) error {
+func batchDelete(id int, cfg ServiceConfig, source MessageSource, deliveries *deliveryTracker, messages []cacheMessage) error {
 	// ensure there is work to do
 	count := uint(len(messages))
 	if count == 0 {
@@ -141,7 +178,7 @@ func batchDelete(id int, aws awssqs.AWS_SQS, queue awssqs.QueueHandle, messages
 		//log.Printf( "Deleting slice [%d:%d]", start, end )
 
 		// and delete them
-		err := blockDelete(aws, queue, messages[start:end])
+		err := blockDelete(id, cfg, source, deliveries, messages[start:end])
 		if err != nil {
 			return err
 		}
@@ -157,7 +194,7 @@ func batchDelete(id int, aws awssqs.AWS_SQS, queue awssqs.QueueHandle, messages
 		//log.Printf( "Deleting slice [%d:%d]", start, end )
 
 		// and delete them
-		err := blockDelete(aws, queue, messages[start:end])
+		err := blockDelete(id, cfg, source, deliveries, messages[start:end])
 		if err != nil {
 			return err
 		}
@@ -166,31 +203,54 @@ func batchDelete(id int, aws awssqs.AWS_SQS, queue awssqs.QueueHandle, messages
 	return nil
 }
 
-func blockDelete(aws awssqs.AWS_SQS, queue awssqs.QueueHandle, messages []cacheMessage) error {
+// blockDelete deletes a block of messages, retrying those that fail with backoff. messages that still
+// can't be deleted are given up on; they will be redelivered and cached again
+func blockDelete(id int, cfg ServiceConfig, source MessageSource, deliveries *deliveryTracker, messages []cacheMessage) error {
 	var msgs []awssqs.Message
 
 	for _, msg := range messages {
 		msgs = append(msgs, msg.message)
 	}
 
-	// delete the block
-	opStatus, err := aws.BatchMessageDelete(queue, msgs)
-	if err != nil {
-		if err != awssqs.ErrOneOrMoreOperationsUnsuccessful {
-			return err
+	wait := time.Duration(cfg.DeleteRetryWait) * time.Millisecond
+
+	for attempt := 0; ; attempt++ {
+		// delete the block
+		opStatus, err := source.DeleteBatch(msgs)
+		if err != nil {
+			if err != awssqs.ErrOneOrMoreOperationsUnsuccessful {
+				return err
+			}
 		}
-	}
 
-	// did we fail
-	if err == awssqs.ErrOneOrMoreOperationsUnsuccessful {
+		// just the ones that failed
+		var failed []awssqs.Message
 		for ix, op := range opStatus {
 			if op == false {
-				log.Printf("ERROR: message %d failed to delete", ix)
+				failed = append(failed, msgs[ix])
 			}
 		}
-	}
 
-	return nil
+		deliveries.deleted(len(msgs) - len(failed))
+
+		if len(failed) == 0 {
+			return nil
+		}
+
+		if attempt >= cfg.DeleteRetries {
+			log.Printf("[delete] deleter %d: ERROR: %d message(s) failed to delete after %d attempt(s); they will be redelivered", id, len(failed), attempt+1)
+			deliveries.undeletable(failed, time.Now())
+			return nil
+		}
+
+		log.Printf("[delete] deleter %d: WARNING: %d message(s) failed to delete; retrying in %s", id, len(failed), wait)
+
+		time.Sleep(wait)
+		wait *= 2
+
+		deliveries.retried(len(failed))
+		msgs = failed
+	}
 }
 
 //
@@ -0,0 +1,8 @@
+DO $$
+BEGIN
+   IF EXISTS (SELECT 1 FROM source_cache WHERE payload_codec <> '') THEN
+      RAISE EXCEPTION 'source_cache has compressed payloads; run recompress -codec none first';
+   END IF;
+END $$;
+ALTER TABLE source_cache DROP COLUMN IF EXISTS payload_codec;
+ALTER TABLE source_cache DROP COLUMN IF EXISTS payload_data;
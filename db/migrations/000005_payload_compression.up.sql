@@ -0,0 +1,2 @@
+ALTER TABLE source_cache ADD COLUMN IF NOT EXISTS payload_data BYTEA;
+ALTER TABLE source_cache ADD COLUMN IF NOT EXISTS payload_codec VARCHAR(16) NOT NULL DEFAULT '';
@@ -0,0 +1,7 @@
+DO $$
+BEGIN
+   IF EXISTS (SELECT 1 FROM source_cache WHERE payload_ref <> '') THEN
+      RAISE EXCEPTION 'source_cache has offloaded payloads; dropping payload_ref would lose them';
+   END IF;
+END $$;
+ALTER TABLE source_cache DROP COLUMN IF EXISTS payload_ref;
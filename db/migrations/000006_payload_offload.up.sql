@@ -0,0 +1 @@
+ALTER TABLE source_cache ADD COLUMN IF NOT EXISTS payload_ref VARCHAR(1024) NOT NULL DEFAULT '';
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS source_cache_quarantine (
+   seq         BIGSERIAL PRIMARY KEY,
+   id          VARCHAR(256) NOT NULL,
+   type        VARCHAR(32) NOT NULL,
+   source      VARCHAR(32) NOT NULL,
+   payload     BYTEA NOT NULL,
+   reason      TEXT NOT NULL,
+   received_at timestamptz NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS source_cache_quarantine_id_idx ON source_cache_quarantine(id);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS source_cache_expires_idx;
+ALTER TABLE source_cache DROP COLUMN IF EXISTS expires_at;
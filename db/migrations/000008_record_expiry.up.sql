@@ -0,0 +1,2 @@
+ALTER TABLE source_cache ADD COLUMN IF NOT EXISTS expires_at timestamptz;
+CREATE INDEX IF NOT EXISTS source_cache_expires_idx ON source_cache(expires_at) WHERE expires_at IS NOT NULL;
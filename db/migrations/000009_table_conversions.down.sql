@@ -0,0 +1,7 @@
+DO $$
+BEGIN
+   IF EXISTS (SELECT 1 FROM schema_conversions) THEN
+      RAISE EXCEPTION 'tables have been converted (see schema_conversions); revert them by hand first';
+   END IF;
+END $$;
+DROP TABLE IF EXISTS schema_conversions;
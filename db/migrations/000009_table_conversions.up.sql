@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS schema_conversions (
+   table_name     VARCHAR(63) PRIMARY KEY,
+   conversion     VARCHAR(32) NOT NULL,
+   schema_version BIGINT NOT NULL,
+   state          VARCHAR(16) NOT NULL,
+   copied_after   VARCHAR(256) NOT NULL DEFAULT '',
+   started_at     timestamptz NOT NULL DEFAULT NOW(),
+   finished_at    timestamptz
+);
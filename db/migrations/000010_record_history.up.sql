@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS source_cache_history (
+   seq           BIGSERIAL PRIMARY KEY,
+   id            VARCHAR(256) NOT NULL,
+   type          VARCHAR(32) NOT NULL,
+   source        VARCHAR(32) NOT NULL,
+   payload       TEXT NOT NULL,
+   payload_data  BYTEA,
+   payload_codec VARCHAR(16) NOT NULL DEFAULT '',
+   updated_at    timestamptz NOT NULL,
+   replaced_at   timestamptz NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS source_cache_history_id_idx ON source_cache_history(id, seq);
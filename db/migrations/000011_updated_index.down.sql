@@ -0,0 +1 @@
+DROP INDEX IF EXISTS source_cache_updated_idx;
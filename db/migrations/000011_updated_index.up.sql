@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS source_cache_updated_idx ON source_cache(updated_at);
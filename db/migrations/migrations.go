@@ -0,0 +1,13 @@
+// Package migrations holds the cache database schema, embedded in the service binary
+package migrations
+
+import "embed"
+
+// Files are the schema migrations, named <version>_<title>.<up|down>.sql
+//
+//go:embed *.sql
+var Files embed.FS
+
+//
+// end of file
+//
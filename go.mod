@@ -1,13 +1,33 @@
 module github.com/uvalib/virgo4-source-cache
 
-go 1.14
+go 1.26.0
 
 require (
-	github.com/aws/aws-sdk-go v1.55.8 // indirect
+	github.com/aws/aws-sdk-go v1.55.8
+	github.com/fergusstrange/embedded-postgres v1.34.0
 	github.com/go-ozzo/ozzo-dbx v1.5.0
-	github.com/go-sql-driver/mysql v1.5.0 // indirect
+	github.com/klauspost/compress v1.20.1
 	github.com/lib/pq v1.10.9
 	github.com/rs/xid v1.6.0
-	github.com/stretchr/testify v1.5.1 // indirect
+	github.com/santhosh-tekuri/jsonschema/v6 v6.0.3
 	github.com/uvalib/virgo4-sqs-sdk/awssqs v0.0.0-20240403123433-2102b063dbb8
+	gopkg.in/yaml.v3 v3.0.1
+	modernc.org/sqlite v1.60.1
+)
+
+require (
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/go-sql-driver/mysql v1.5.0 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	github.com/mattn/go-isatty v0.0.24 // indirect
+	github.com/ncruces/go-strftime v1.0.0 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
+	github.com/uvalib/uva-aws-s3-sdk/uva-s3 v0.0.0-20240202155653-277e11cf83e3 // indirect
+	github.com/xi2/xz v0.0.0-20171230120015-48954b6210f8 // indirect
+	golang.org/x/sys v0.48.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	modernc.org/libc v1.77.1 // indirect
+	modernc.org/mathutil v1.7.1 // indirect
+	modernc.org/memory v1.12.1 // indirect
 )
@@ -1,35 +1,10 @@
 #!/usr/bin/env bash
 #
-# run any necessary migrations
+# run any necessary migrations; the migrations are embedded in the service and use
+# the service configuration (VIRGO4_SOURCE_CACHE_POSTGRES_HOST, etc)
 #
 
-if [ -z "$DB_HOST" ]; then
-   echo "ERROR: DB_HOST is not defined"
-   exit 1
-fi
-
-if [ -z "$DB_PORT" ]; then
-   echo "ERROR: DB_PORT is not defined"
-   exit 1
-fi
-
-if [ -z "$DB_USER" ]; then
-   echo "ERROR: DB_USER is not defined"
-   exit 1
-fi
-
-if [ -z "$DB_PASSWD" ]; then
-   echo "ERROR: DB_PASSWD is not defined"
-   exit 1
-fi
-
-if [ -z "$DB_NAME" ]; then
-   echo "ERROR: DB_NAME is not defined"
-   exit 1
-fi
-
-# run the migrations
-bin/migrate -path db/migrations -verbose -database postgres://$DB_USER:$DB_PASSWD@$DB_HOST:$DB_PORT/$DB_NAME up
+bin/virgo4-source-cache migrate up "$@"
 
 # return the status
 exit $?